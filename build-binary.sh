@@ -34,6 +34,7 @@ sed -i "s/1.0.0/$version/g" $GOPATH/src/$source_dir/main.go
 echo "building source..."
 cd $GOPATH/src
 go install -v ./oam-docker-ipam
+go build -v -o $GOBIN/skylark-ipam ./oam-docker-ipam/skylarkipam
 
 echo "completed !!"
 
@@ -0,0 +1,225 @@
+package arp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ethPArp       = 0x0806
+	ethPIPv4      = 0x0800
+	ethHeaderLen  = 14
+	arpPacketLen  = 28
+	arpOpRequest  = 1
+	hwTypeEther   = 1
+	probeInterval = 200 * time.Millisecond
+)
+
+var broadcastMac = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Packet is an ethernet/IPv4 ARP packet as described in RFC 826
+type Packet struct {
+	Operation uint16
+	SenderMac net.HardwareAddr
+	SenderIP  net.IP
+	TargetMac net.HardwareAddr
+	TargetIP  net.IP
+}
+
+// Marshal encodes the packet into an ethernet frame sent to dst
+func (p *Packet) Marshal(dst net.HardwareAddr) []byte {
+	b := make([]byte, ethHeaderLen+arpPacketLen)
+	copy(b[0:6], dst)
+	copy(b[6:12], p.SenderMac)
+	binary.BigEndian.PutUint16(b[12:14], ethPArp)
+
+	a := b[ethHeaderLen:]
+	binary.BigEndian.PutUint16(a[0:2], hwTypeEther)
+	binary.BigEndian.PutUint16(a[2:4], ethPIPv4)
+	a[4] = 6
+	a[5] = 4
+	binary.BigEndian.PutUint16(a[6:8], p.Operation)
+	copy(a[8:14], p.SenderMac)
+	copy(a[14:18], p.SenderIP.To4())
+	copy(a[18:24], p.TargetMac)
+	copy(a[24:28], p.TargetIP.To4())
+	return b
+}
+
+// Unmarshal decodes an ARP packet from an ethernet frame
+func Unmarshal(frame []byte) (*Packet, error) {
+	if len(frame) < ethHeaderLen+arpPacketLen {
+		return nil, errors.New("frame too short for an arp packet")
+	}
+	if binary.BigEndian.Uint16(frame[12:14]) != ethPArp {
+		return nil, errors.New("not an arp frame")
+	}
+	a := frame[ethHeaderLen:]
+	if binary.BigEndian.Uint16(a[0:2]) != hwTypeEther || binary.BigEndian.Uint16(a[2:4]) != ethPIPv4 {
+		return nil, errors.New("unsupported arp hardware or protocol type")
+	}
+	p := &Packet{
+		Operation: binary.BigEndian.Uint16(a[6:8]),
+		SenderMac: net.HardwareAddr(append([]byte{}, a[8:14]...)),
+		SenderIP:  net.IP(append([]byte{}, a[14:18]...)),
+		TargetMac: net.HardwareAddr(append([]byte{}, a[18:24]...)),
+		TargetIP:  net.IP(append([]byte{}, a[24:28]...)),
+	}
+	return p, nil
+}
+
+// conn is a raw AF_PACKET socket bound to one interface
+type conn struct {
+	fd    int
+	iface *net.Interface
+}
+
+func htons(v uint16) uint16 {
+	return (v << 8) | (v >> 8)
+}
+
+func dial(ifname string) (*conn, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("interface %s has no ethernet address", ifname)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPArp)))
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: iface.Index}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &conn{fd: fd, iface: iface}, nil
+}
+
+func (c *conn) send(p *Packet, dst net.HardwareAddr) error {
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: c.iface.Index, Halen: 6}
+	copy(sa.Addr[:], dst)
+	return syscall.Sendto(c.fd, p.Marshal(dst), 0, sa)
+}
+
+// receive waits until the deadline for an arp packet accepted by match
+func (c *conn) receive(deadline time.Time, match func(*Packet) bool) (*Packet, error) {
+	buf := make([]byte, 1500)
+	for {
+		remain := deadline.Sub(time.Now())
+		if remain <= 0 {
+			return nil, nil
+		}
+		tv := syscall.NsecToTimeval(remain.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, err
+		}
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, err := Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		if match(p) {
+			return p, nil
+		}
+	}
+}
+
+func (c *conn) close() error {
+	return syscall.Close(c.fd)
+}
+
+// Probe sends RFC 5227 ARP probes for ip on interface ifname and waits up to
+// timeout for another station to claim it. It returns the hardware address of
+// the station using ip, or nil if nobody answered.
+func Probe(ifname string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	ip = ip.To4()
+	if ip == nil {
+		return nil, errors.New("arp probe only supports IPv4 addresses")
+	}
+	c, err := dial(ifname)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	probe := &Packet{
+		Operation: arpOpRequest,
+		SenderMac: c.iface.HardwareAddr,
+		SenderIP:  net.IPv4zero.To4(),
+		TargetMac: make(net.HardwareAddr, 6),
+		TargetIP:  ip,
+	}
+	// any packet claiming ip as sender address, or another probe for the same
+	// address from a different station, means the address is in use
+	match := func(p *Packet) bool {
+		if p.SenderMac.String() == c.iface.HardwareAddr.String() {
+			return false
+		}
+		if p.SenderIP.Equal(ip) {
+			return true
+		}
+		return p.Operation == arpOpRequest && p.SenderIP.Equal(net.IPv4zero) && p.TargetIP.Equal(ip)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := c.send(probe, broadcastMac); err != nil {
+			return nil, err
+		}
+		next := time.Now().Add(probeInterval)
+		if next.After(deadline) {
+			next = deadline
+		}
+		p, err := c.receive(next, match)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			log.Warnf("IP %s is in use by %s on %s", ip, p.SenderMac, ifname)
+			return p.SenderMac, nil
+		}
+	}
+	return nil, nil
+}
+
+// Announce broadcasts a gratuitous ARP for ip from interface ifname so that
+// neighbours update stale cache entries for the address
+func Announce(ifname string, ip net.IP) error {
+	ip = ip.To4()
+	if ip == nil {
+		return errors.New("arp announce only supports IPv4 addresses")
+	}
+	c, err := dial(ifname)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	announcement := &Packet{
+		Operation: arpOpRequest,
+		SenderMac: c.iface.HardwareAddr,
+		SenderIP:  ip,
+		TargetMac: make(net.HardwareAddr, 6),
+		TargetIP:  ip,
+	}
+	if err := c.send(announcement, broadcastMac); err != nil {
+		return err
+	}
+	log.Debugf("Sent gratuitous arp for %s on %s", ip, ifname)
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"oam-docker-ipam/db"
 	"oam-docker-ipam/util"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -14,40 +15,181 @@ import (
 
 const (
 	network_key_prefix = "/skylark/hosts"
+	DefaultNetwork     = "mynet"
+	DefaultBridge      = "br0"
+	DefaultMTU         = 1500
 )
 
+// docker network drivers of a host network
+const (
+	DriverBridge  = "bridge"
+	DriverMacvlan = "macvlan"
+	DriverIpvlan  = "ipvlan"
+)
+
+// Config describes one named L2 segment the hosts attach to
 type Config struct {
-	Subnet  string
-	Gateway string
+	Name          string
+	Subnet        string
+	Gateway       string
+	Bridge        string
+	DockerNetwork string
+	// Vlan tags the segment on the uplink of each host, 0 when untagged
+	Vlan int
+	// Driver is the docker network driver. Only the bridge driver takes a
+	// host IP from the pool, macvlan and ipvlan attach to the uplink.
+	Driver     string
+	IpvlanMode string // l2 or l3
+
+	// options of the docker network
+	MTU                int
+	EnableICC          bool
+	EnableIPMasquerade bool
+	HostBindingIPv4    string
+	AuxAddresses       map[string]string
 }
 
-func AllocateHostRange(ip_start, ip_end, gateway string) []string {
+// keys of the pre multi-network layout which kept a single network directly
+// under network_key_prefix
+var legacy_keys = []string{"config", "pool", "assigned"}
+
+func networkKey(name string, keys ...string) string {
+	return filepath.Join(append([]string{network_key_prefix, name}, keys...)...)
+}
+
+func validNetworkName(name string) error {
+	if name == "" {
+		return errors.New("network name is empty")
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("network name %s must not contain '/'", name)
+	}
+	for _, key := range legacy_keys {
+		if name == key {
+			return fmt.Errorf("network name %s is reserved", name)
+		}
+	}
+	return nil
+}
+
+func validDriver(config *Config) error {
+	switch config.Driver {
+	case "", DriverBridge, DriverMacvlan:
+	case DriverIpvlan:
+		if config.IpvlanMode != "" && config.IpvlanMode != "l2" && config.IpvlanMode != "l3" {
+			return fmt.Errorf("invalid ipvlan mode %s, must be l2 or l3", config.IpvlanMode)
+		}
+	default:
+		return fmt.Errorf("unsupported driver %s, must be one of %s, %s, %s", config.Driver, DriverBridge, DriverMacvlan, DriverIpvlan)
+	}
+	return nil
+}
+
+// migrateLegacyConfig moves a single global host config written by older
+// releases under the default network name
+func migrateLegacyConfig() error {
+	legacy_config := filepath.Join(network_key_prefix, "config")
+	if !db.IsKeyExist(legacy_config) || db.IsKeyExist(networkKey(DefaultNetwork, "config")) {
+		return nil
+	}
+	config, err := db.GetKey(legacy_config)
+	if err != nil {
+		return err
+	}
+	conf := &Config{}
+	json.Unmarshal([]byte(config), conf)
+	conf.Name = DefaultNetwork
+	conf.Bridge = DefaultBridge
+	conf.DockerNetwork = DefaultNetwork
+	conf.EnableICC = true
+	setDefaults(conf)
+	for _, dir := range []string{"pool", "assigned"} {
+		legacy_dir := filepath.Join(network_key_prefix, dir)
+		if !db.IsKeyExist(legacy_dir) {
+			continue
+		}
+		nodes, err := db.GetKeys(legacy_dir)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if err = db.SetKey(networkKey(DefaultNetwork, dir, filepath.Base(node.Key)), node.Value); err != nil {
+				return err
+			}
+		}
+		if err = db.DeleteKey(legacy_dir); err != nil {
+			return err
+		}
+	}
+	if err = setConfig(conf); err != nil {
+		return err
+	}
+	log.Infof("Migrated legacy host config to network %s", DefaultNetwork)
+	return db.DeleteKey(legacy_config)
+}
+
+func AllocateHostRange(ip_start, ip_end string, config *Config) []string {
+	if err := validNetworkName(config.Name); err != nil {
+		log.Fatal(err)
+	}
+	if err := validDriver(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateLegacyConfig(); err != nil {
+		log.Fatal(err)
+	}
 	ips := util.GetIPRange(ip_start, ip_end)
 	ip_net, mask := util.GetIPNetAndMask(ip_start)
 	for _, ip := range ips {
-		if checkIPAssigned(ip) {
+		if checkIPAssigned(config.Name, ip) {
 			log.Warnf("IP %s has been allocated", ip)
 			continue
 		}
-		db.SetKey(filepath.Join(network_key_prefix, "pool", ip), "")
+		db.SetKey(networkKey(config.Name, "pool", ip), "")
 	}
-	initializeConfig(ip_net, fmt.Sprint(ip_net, "/", mask), gateway)
+	config.Subnet = fmt.Sprint(ip_net, "/", mask)
+	initializeConfig(ip_net, config)
 	fmt.Println("Allocate Hosts Done! Total:", len(ips))
 	return ips
 }
 
-func initializeConfig(ip_net, subnet, gateway string) error {
-	config := &Config{Subnet: subnet, Gateway: gateway}
-	config_bytes, _ := json.Marshal(config)
-	err := db.SetKey(filepath.Join(network_key_prefix, "config"), string(config_bytes))
+func setDefaults(config *Config) {
+	if config.Driver == "" {
+		config.Driver = DriverBridge
+	}
+	if config.Driver == DriverIpvlan && config.IpvlanMode == "" {
+		config.IpvlanMode = "l2"
+	}
+	if config.Bridge == "" {
+		config.Bridge = DefaultBridge
+	}
+	if config.DockerNetwork == "" {
+		config.DockerNetwork = config.Name
+	}
+	if config.MTU == 0 {
+		config.MTU = DefaultMTU
+	}
+	if config.HostBindingIPv4 == "" {
+		config.HostBindingIPv4 = "0.0.0.0"
+	}
+}
+
+func initializeConfig(ip_net string, config *Config) error {
+	setDefaults(config)
+	err := setConfig(config)
 	if err == nil {
-		log.Infof("Initialized Config %s for network %s", string(config_bytes), ip_net)
+		log.Infof("Initialized Config of %s for network %s", config.Name, ip_net)
 	}
 	return err
 }
 
-func getConfig() (*Config, error) {
-	config, err := db.GetKey(filepath.Join(network_key_prefix, "config"))
+func setConfig(config *Config) error {
+	config_bytes, _ := json.Marshal(config)
+	return db.SetKey(networkKey(config.Name, "config"), string(config_bytes))
+}
+
+func getConfig(name string) (*Config, error) {
+	config, err := db.GetKey(networkKey(name, "config"))
 	if err == nil {
 		log.Debugf("getConfig %s", config)
 	}
@@ -56,23 +198,50 @@ func getConfig() (*Config, error) {
 	return conf, err
 }
 
-func allocateHost(ip string) error {
-	if ip == "" {
+// ListNetworks returns the configs of all named host networks
+func ListNetworks() ([]*Config, error) {
+	if err := migrateLegacyConfig(); err != nil {
+		return nil, err
+	}
+	nodes, err := db.GetKeys(network_key_prefix)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*Config
+	for _, node := range nodes {
+		if !node.Dir {
+			continue
+		}
+		conf, err := getConfig(filepath.Base(node.Key))
+		if err != nil {
+			continue
+		}
+		setDefaults(conf)
+		configs = append(configs, conf)
+	}
+	return configs, nil
+}
+
+func allocateHost(host *Host) error {
+	if host.IP == "" {
 		return errors.New("arg ip is lack")
 	}
-	err := db.DeleteKey(filepath.Join(network_key_prefix, "pool", ip))
+	err := db.DeleteKey(networkKey(host.Network, "pool", host.IP))
 	if err != nil {
 		return err
 	}
-	if err = db.SetKey(filepath.Join(network_key_prefix, "assigned", ip), ""); err != nil {
+	if err = setHost(host); err != nil {
+		if perr := db.SetKey(networkKey(host.Network, "pool", host.IP), ""); perr != nil {
+			log.Errorf("Failed to return host %s to the pool: %v", host.IP, perr)
+		}
 		return err
 	}
-	log.Infof("Allocated host %s", ip)
+	log.Infof("Allocated host %s to %s", host.IP, host.Hostname)
 	return nil
 }
 
-func getHost(ip string) (string, error) {
-	ip_pool, err := db.GetKeys(filepath.Join(network_key_prefix, "pool"))
+func getHost(name, ip string) (string, error) {
+	ip_pool, err := db.GetKeys(networkKey(name, "pool"))
 	if err != nil {
 		return "", err
 	}
@@ -82,54 +251,149 @@ func getHost(ip string) (string, error) {
 	if ip == "" {
 		find_ip := strings.Split(ip_pool[0].Key, "/")
 		ip = find_ip[len(find_ip)-1]
-	} else if exist := db.IsKeyExist(filepath.Join(network_key_prefix, "pool", ip)); exist != true {
+	} else if exist := db.IsKeyExist(networkKey(name, "pool", ip)); exist != true {
 		return "", errors.New(fmt.Sprintf("Host %s not in pool", ip))
 	}
-	if assigned := checkIPAssigned(ip); assigned == true {
+	if assigned := checkIPAssigned(name, ip); assigned == true {
 		return "", errors.New(fmt.Sprintf("Host %s has been allocated", ip))
 	}
 	return ip, nil
 }
 
-func checkIPAssigned(ip string) bool {
-	if exist := db.IsKeyExist(filepath.Join(network_key_prefix, "assigned", ip)); exist {
+func checkIPAssigned(name, ip string) bool {
+	if exist := db.IsKeyExist(networkKey(name, "assigned", ip)); exist {
 		return true
 	}
 	return false
 }
 
-func ReleaseHost(ip string) error {
-	err := db.DeleteKey(filepath.Join(network_key_prefix, "assigned", ip))
+// ReleaseHost returns ip to the pool. It refuses while the host holding it
+// still reports in, unless force is set.
+func ReleaseHost(name, ip string, force bool) error {
+	host, err := LookupHost(name, ip)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	err = db.SetKey(filepath.Join(network_key_prefix, "pool", ip), "")
+	if host.Alive() && !force {
+		return fmt.Errorf("host %s (%s) still reports in, drain it first or use --force", ip, host.Hostname)
+	}
+	return releaseHost(name, ip)
+}
+
+func releaseHost(name, ip string) error {
+	err := db.DeleteKey(networkKey(name, "assigned", ip))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	log.Infof("Release host %s", ip)
-	return err
+	err = db.SetKey(networkKey(name, "pool", ip), "")
+	if err != nil {
+		return err
+	}
+	log.Infof("Release host %s of network %s", ip, name)
+	return nil
+}
+
+// CreateOptions tune how create-network sets up the host
+type CreateOptions struct {
+	// Renderer persists the bridge, "auto" detects it from the host
+	Renderer string
+	// ConfigRoot is prepended to the paths of the written network files
+	ConfigRoot string
+	// DryRun prints the plan instead of applying it
+	DryRun bool
+	// Uplink is the device to enslave, detected from the default route
+	// when empty
+	Uplink string
+	// Bond is the bond parent of the vlan, an alternative to Uplink that
+	// must be a bond device
+	Bond string
+	// Vlan overrides the vlan of the network config when not 0
+	Vlan int
 }
 
-func CreateNetwork(ip string) {
+// CreateNetwork attaches this host to the named network. Either every step
+// succeeds or the host IP, the docker network and the interface files are
+// put back as they were.
+func CreateNetwork(name, ip string, opts *CreateOptions) error {
 	var assigned_ip string
 	var config *Config
 	var err error
 
-	if config, err = getConfig(); err != nil {
-		log.Fatal(err)
+	if err = migrateLegacyConfig(); err != nil {
+		return err
 	}
-	if assigned_ip, err = getHost(ip); err != nil {
-		log.Fatal(err)
+	if config, err = getConfig(name); err != nil {
+		return err
 	}
-	if err = allocateHost(assigned_ip); err != nil {
-		log.Fatal(err)
+	setDefaults(config)
+	uplink, err := resolveCreateUplink(config, opts)
+	if err != nil {
+		return err
 	}
-	if err = createBridge(assigned_ip, config.Subnet, config.Gateway); err != nil {
-		log.Fatal(err)
+	var renderer Renderer
+	if config.Driver == DriverBridge {
+		if renderer, err = GetRenderer(opts.Renderer, opts.ConfigRoot); err != nil {
+			return err
+		}
+		if err = checkDraining(name); err != nil {
+			return err
+		}
+		if assigned_ip, err = getHost(name, ip); err != nil {
+			return err
+		}
 	}
-	if err = restart_network(); err != nil {
-		log.Fatal(err)
+	plan, err := planNetwork(assigned_ip, uplink, config, renderer, opts.ConfigRoot)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		plan.Print(os.Stdout)
+		return nil
+	}
+	if err = plan.Apply(); err != nil {
+		return err
+	}
+	if config.Driver != DriverBridge {
+		log.Infof("Create network %s with driver %s on %s done", config.DockerNetwork, config.Driver, uplink.Name)
+		return nil
+	}
+	log.Infof("Create network %s with bridge %s at %s done", config.DockerNetwork, config.Bridge, assigned_ip)
+	return nil
+}
+
+// checkDraining refuses to attach this machine again while it drains
+func checkDraining(name string) error {
+	hosts, err := ListHosts(name)
+	if err != nil {
+		return err
+	}
+	local := localHost(name, "")
+	for _, host := range hosts {
+		if host.Draining && host.isLocal(local) {
+			return fmt.Errorf("this host is draining %s of network %s", host.IP, name)
+		}
+	}
+	return nil
+}
+
+func resolveCreateUplink(config *Config, opts *CreateOptions) (*Uplink, error) {
+	parent := opts.Uplink
+	if opts.Bond != "" {
+		if opts.Uplink != "" {
+			return nil, errors.New("--uplink and --bond are exclusive")
+		}
+		parent = opts.Bond
+	}
+	vlan := config.Vlan
+	if opts.Vlan != 0 {
+		vlan = opts.Vlan
+	}
+	uplink, err := resolveUplink(parent, vlan)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Bond != "" && linkKindByName(opts.Bond) != UplinkBond {
+		return nil, fmt.Errorf("%s is not a bond device", opts.Bond)
 	}
-	log.Infof("Create network %s done", assigned_ip)
+	return uplink, nil
 }
@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"testing"
+)
+
+func TestNetworkKey(t *testing.T) {
+	tests := []struct {
+		keys []string
+		want string
+	}{
+		{nil, "/skylark/hosts/vlan52"},
+		{[]string{"config"}, "/skylark/hosts/vlan52/config"},
+		{[]string{"pool", "10.190.52.34"}, "/skylark/hosts/vlan52/pool/10.190.52.34"},
+	}
+	for _, test := range tests {
+		if key := networkKey("vlan52", test.keys...); key != test.want {
+			t.Errorf("%v: got %s, want %s", test.keys, key, test.want)
+		}
+	}
+}
+
+func TestValidNetworkName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"mynet", true},
+		{"vlan52", true},
+		{"", false},
+		{"vlan/52", false},
+		// the keys of the single network layout
+		{"config", false},
+		{"pool", false},
+		{"assigned", false},
+	}
+	for _, test := range tests {
+		if err := validNetworkName(test.name); (err == nil) != test.valid {
+			t.Errorf("%q: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	config := &Config{Name: "vlan52"}
+	setDefaults(config)
+	if config.Bridge != DefaultBridge || config.DockerNetwork != "vlan52" || config.MTU != DefaultMTU ||
+		config.HostBindingIPv4 != "0.0.0.0" || config.Driver != DriverBridge {
+		t.Errorf("got %+v", config)
+	}
+
+	// the settings of the network are kept
+	config = &Config{Name: "vlan52", Bridge: "br52", DockerNetwork: "web", MTU: 9000, HostBindingIPv4: "10.190.52.34"}
+	setDefaults(config)
+	if config.Bridge != "br52" || config.DockerNetwork != "web" || config.MTU != 9000 || config.HostBindingIPv4 != "10.190.52.34" {
+		t.Errorf("got %+v", config)
+	}
+}
+
+func TestValidDriver(t *testing.T) {
+	tests := []struct {
+		config *Config
+		valid  bool
+	}{
+		{&Config{}, true},
+		{&Config{Driver: DriverBridge}, true},
+		{&Config{Driver: DriverMacvlan}, true},
+		{&Config{Driver: DriverIpvlan}, true},
+		{&Config{Driver: DriverIpvlan, IpvlanMode: "l3"}, true},
+		{&Config{Driver: DriverIpvlan, IpvlanMode: "l3s"}, false},
+		{&Config{Driver: "overlay"}, false},
+	}
+	for _, test := range tests {
+		if err := validDriver(test.config); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.config, err, test.valid)
+		}
+	}
+
+	config := &Config{Name: "vlan52", Driver: DriverIpvlan}
+	setDefaults(config)
+	if config.IpvlanMode != "l2" {
+		t.Errorf("got ipvlan mode %q, want l2", config.IpvlanMode)
+	}
+}
@@ -0,0 +1,178 @@
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/network"
+	"golang.org/x/net/context"
+)
+
+const (
+	docker_socket = "unix:///var/run/docker.sock"
+	ipam_driver   = "skylark"
+)
+
+func newDockerClient() (*client.Client, error) {
+	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
+	return client.NewClient(docker_socket, "", nil, defaultHeaders)
+}
+
+// networkCreateOptions builds the docker network of a host network. With
+// the bridge driver ip is the address of the bridge on this host, the
+// macvlan and ipvlan drivers attach the containers to parent instead and use
+// the gateway of the segment.
+func networkCreateOptions(ip, parent string, config *Config) types.NetworkCreate {
+	aux_addresses := map[string]string{}
+	for name, addr := range config.AuxAddresses {
+		aux_addresses[name] = addr
+	}
+	options := map[string]string{
+		"com.docker.network.driver.mtu": strconv.Itoa(config.MTU),
+	}
+	gateway := ip
+	switch config.Driver {
+	case DriverMacvlan:
+		gateway = config.Gateway
+		options["parent"] = parent
+		options["macvlan_mode"] = "bridge"
+	case DriverIpvlan:
+		gateway = config.Gateway
+		options["parent"] = parent
+		options["ipvlan_mode"] = config.IpvlanMode
+	default:
+		if _, ok := aux_addresses["DefaultGatewayIPv4"]; !ok {
+			aux_addresses["DefaultGatewayIPv4"] = config.Gateway
+		}
+		options["com.docker.network.bridge.enable_icc"] = strconv.FormatBool(config.EnableICC)
+		options["com.docker.network.bridge.enable_ip_masquerade"] = strconv.FormatBool(config.EnableIPMasquerade)
+		options["com.docker.network.bridge.host_binding_ipv4"] = config.HostBindingIPv4
+		options["com.docker.network.bridge.name"] = config.Bridge
+	}
+	return types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         config.Driver,
+		IPAM: network.IPAM{
+			Driver: ipam_driver,
+			Config: []network.IPAMConfig{{
+				Subnet:     config.Subnet,
+				Gateway:    gateway,
+				AuxAddress: aux_addresses,
+			}},
+		},
+		Options: options,
+	}
+}
+
+// sameNetwork reports whether an existing docker network already matches
+// the wanted options
+func sameNetwork(existing types.NetworkResource, wanted types.NetworkCreate) bool {
+	if existing.Driver != wanted.Driver || existing.IPAM.Driver != wanted.IPAM.Driver {
+		return false
+	}
+	if len(existing.IPAM.Config) != len(wanted.IPAM.Config) {
+		return false
+	}
+	for i, c := range wanted.IPAM.Config {
+		e := existing.IPAM.Config[i]
+		if e.Subnet != c.Subnet || e.Gateway != c.Gateway || !reflect.DeepEqual(e.AuxAddress, c.AuxAddress) {
+			return false
+		}
+	}
+	for k, v := range wanted.Options {
+		if existing.Options[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// createDockerNetwork creates the docker network name through the engine
+// API. An existing network with the same options is reused, one with
+// different options is recreated as long as no container is attached.
+// created reports whether a new network was made, replaced is the network
+// that was removed for it, also when the create failed.
+func createDockerNetwork(name string, wanted types.NetworkCreate) (id string, created bool, replaced *types.NetworkResource, err error) {
+	c, err := newDockerClient()
+	if err != nil {
+		return "", false, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	existing, err := c.NetworkInspect(ctx, name)
+	if err == nil {
+		if sameNetwork(existing, wanted) {
+			log.Infof("Docker network %s already exists", name)
+			return existing.ID, false, nil, nil
+		}
+		if len(existing.Containers) != 0 {
+			return "", false, nil, fmt.Errorf("docker network %s differs from config but has %d containers attached", name, len(existing.Containers))
+		}
+		log.Infof("Recreating docker network %s", name)
+		if err = c.NetworkRemove(ctx, existing.ID); err != nil {
+			return "", false, nil, err
+		}
+		replaced = &existing
+	} else if !client.IsErrNetworkNotFound(err) {
+		return "", false, nil, err
+	}
+
+	resp, err := c.NetworkCreate(ctx, name, wanted)
+	if err != nil {
+		return "", false, replaced, err
+	}
+	if resp.Warning != "" {
+		log.Warn(resp.Warning)
+	}
+	log.Infof("Created docker network %s %s", name, resp.ID)
+	return resp.ID, true, replaced, nil
+}
+
+// restoreDockerNetwork creates a network createDockerNetwork removed again
+// with its old options, it gets a new id
+func restoreDockerNetwork(old *types.NetworkResource) error {
+	c, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	log.Infof("Restoring docker network %s", old.Name)
+	_, err = c.NetworkCreate(ctx, old.Name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         old.Driver,
+		EnableIPv6:     old.EnableIPv6,
+		IPAM:           old.IPAM,
+		Internal:       old.Internal,
+		Options:        old.Options,
+		Labels:         old.Labels,
+	})
+	return err
+}
+
+// removeDockerNetwork deletes the docker network of config if it exists
+func removeDockerNetwork(config *Config) error {
+	c, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	existing, err := c.NetworkInspect(ctx, config.DockerNetwork)
+	if client.IsErrNetworkNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Removing docker network %s", config.DockerNetwork)
+	return c.NetworkRemove(ctx, existing.ID)
+}
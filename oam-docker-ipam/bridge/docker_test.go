@@ -0,0 +1,117 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/network"
+)
+
+var testConfig = &Config{
+	Name:               "vlan52",
+	Subnet:             "10.190.52.0/24",
+	Gateway:            "10.190.52.1",
+	Bridge:             "br0",
+	DockerNetwork:      "vlan52",
+	Driver:             DriverBridge,
+	MTU:                1500,
+	EnableICC:          true,
+	EnableIPMasquerade: false,
+	HostBindingIPv4:    "0.0.0.0",
+	AuxAddresses:       map[string]string{"router": "10.190.52.2"},
+}
+
+func TestNetworkCreateOptions(t *testing.T) {
+	create := networkCreateOptions("10.190.52.34", "bond0.52", testConfig)
+	if create.Driver != DriverBridge || create.IPAM.Driver != ipam_driver || !create.CheckDuplicate {
+		t.Errorf("got driver %s ipam %s", create.Driver, create.IPAM.Driver)
+	}
+	want := []network.IPAMConfig{{
+		Subnet:     "10.190.52.0/24",
+		Gateway:    "10.190.52.34",
+		AuxAddress: map[string]string{"router": "10.190.52.2", "DefaultGatewayIPv4": "10.190.52.1"},
+	}}
+	if !reflect.DeepEqual(create.IPAM.Config, want) {
+		t.Errorf("got ipam %+v, want %+v", create.IPAM.Config, want)
+	}
+	options := map[string]string{
+		"com.docker.network.driver.mtu":                  "1500",
+		"com.docker.network.bridge.enable_icc":           "true",
+		"com.docker.network.bridge.enable_ip_masquerade": "false",
+		"com.docker.network.bridge.host_binding_ipv4":    "0.0.0.0",
+		"com.docker.network.bridge.name":                 "br0",
+	}
+	if !reflect.DeepEqual(create.Options, options) {
+		t.Errorf("got options %v, want %v", create.Options, options)
+	}
+	if len(testConfig.AuxAddresses) != 1 {
+		t.Errorf("the aux addresses of the config were changed: %v", testConfig.AuxAddresses)
+	}
+}
+
+func TestNetworkCreateOptionsUplinkDrivers(t *testing.T) {
+	tests := []struct {
+		driver  string
+		mode    string
+		options map[string]string
+	}{
+		{DriverMacvlan, "", map[string]string{"com.docker.network.driver.mtu": "1500", "parent": "bond0.52", "macvlan_mode": "bridge"}},
+		{DriverIpvlan, "l3", map[string]string{"com.docker.network.driver.mtu": "1500", "parent": "bond0.52", "ipvlan_mode": "l3"}},
+	}
+	for _, test := range tests {
+		config := *testConfig
+		config.Driver, config.IpvlanMode = test.driver, test.mode
+		create := networkCreateOptions("", "bond0.52", &config)
+		if create.Driver != test.driver || !reflect.DeepEqual(create.Options, test.options) {
+			t.Errorf("%s: got driver %s options %v, want %v", test.driver, create.Driver, create.Options, test.options)
+		}
+		// the containers use the gateway of the segment, the host has no
+		// address on it
+		want := []network.IPAMConfig{{Subnet: "10.190.52.0/24", Gateway: "10.190.52.1", AuxAddress: map[string]string{"router": "10.190.52.2"}}}
+		if !reflect.DeepEqual(create.IPAM.Config, want) {
+			t.Errorf("%s: got ipam %+v, want %+v", test.driver, create.IPAM.Config, want)
+		}
+	}
+
+	// only the docker network is created, the host keeps its addressing
+	config := *testConfig
+	config.Driver = DriverMacvlan
+	plan, err := planNetwork("", &Uplink{Name: "bond0.52", Exists: false}, &config, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.steps) != 1 || plan.steps[0].kind != "docker" {
+		t.Errorf("got %d steps, want the docker network only", len(plan.steps))
+	}
+}
+
+func TestSameNetwork(t *testing.T) {
+	wanted := networkCreateOptions("10.190.52.34", "", testConfig)
+	existing := types.NetworkResource{
+		Name:    "vlan52",
+		Driver:  wanted.Driver,
+		IPAM:    wanted.IPAM,
+		Options: map[string]string{"com.docker.network.bridge.default_bridge": "false"},
+	}
+	for k, v := range wanted.Options {
+		existing.Options[k] = v
+	}
+	if !sameNetwork(existing, wanted) {
+		t.Error("expected the network to match")
+	}
+
+	other := *testConfig
+	other.MTU = 9000
+	if sameNetwork(existing, networkCreateOptions("10.190.52.34", "", &other)) {
+		t.Error("expected a different mtu to differ")
+	}
+	if sameNetwork(existing, networkCreateOptions("10.190.52.35", "", testConfig)) {
+		t.Error("expected a different bridge address to differ")
+	}
+	other = *testConfig
+	other.AuxAddresses = nil
+	if sameNetwork(existing, networkCreateOptions("10.190.52.34", "", &other)) {
+		t.Error("expected different aux addresses to differ")
+	}
+}
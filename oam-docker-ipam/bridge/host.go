@@ -0,0 +1,254 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"oam-docker-ipam/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// HeartbeatInterval is how often the server of a host refreshes LastSeen
+	HeartbeatInterval = 30 * time.Second
+	// a host missing this many heartbeats no longer reports in
+	host_stale_after = 3 * HeartbeatInterval
+)
+
+var machine_id_files = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// Host is the record kept under assigned/<ip> for the machine holding a
+// bridge address of a host network
+type Host struct {
+	IP          string
+	Network     string
+	Hostname    string
+	MachineID   string
+	Uplink      string
+	Bridge      string
+	NetworkID   string // the id of the docker network
+	AllocatedAt time.Time
+	LastSeen    time.Time
+	// Draining hosts stop reporting in so their address can be released
+	Draining bool
+}
+
+// Alive tells whether the host reported in recently
+func (h *Host) Alive() bool {
+	return !h.LastSeen.IsZero() && time.Since(h.LastSeen) < host_stale_after
+}
+
+// State is live, stale or draining
+func (h *Host) State() string {
+	switch {
+	case h.Draining:
+		return "draining"
+	case h.Alive():
+		return "live"
+	}
+	return "stale"
+}
+
+func machineID() string {
+	for _, path := range machine_id_files {
+		if id, err := ioutil.ReadFile(path); err == nil {
+			return strings.TrimSpace(string(id))
+		}
+	}
+	return ""
+}
+
+// localHost returns the record of this machine for ip
+func localHost(name, ip string) *Host {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Could not retrieve hostname: %v", err)
+	}
+	now := time.Now()
+	return &Host{
+		IP:          ip,
+		Network:     name,
+		Hostname:    hostname,
+		MachineID:   machineID(),
+		AllocatedAt: now,
+		LastSeen:    now,
+	}
+}
+
+// isLocal matches the machine-id when both sides have one, the hostname
+// otherwise
+func (h *Host) isLocal(local *Host) bool {
+	if h.MachineID != "" && local.MachineID != "" {
+		return h.MachineID == local.MachineID
+	}
+	return h.Hostname == local.Hostname
+}
+
+func setHost(host *Host) error {
+	host_bytes, _ := json.Marshal(host)
+	return db.SetKey(networkKey(host.Network, "assigned", host.IP), string(host_bytes))
+}
+
+// LookupHost returns the record of ip in the named network. Hosts allocated
+// by older releases have an empty record and only carry their IP.
+func LookupHost(name, ip string) (*Host, error) {
+	if err := migrateLegacyConfig(); err != nil {
+		return nil, err
+	}
+	value, err := db.GetKey(networkKey(name, "assigned", ip))
+	if err != nil {
+		return nil, fmt.Errorf("host %s is not allocated in network %s", ip, name)
+	}
+	host := &Host{}
+	if value != "" {
+		if err = json.Unmarshal([]byte(value), host); err != nil {
+			return nil, fmt.Errorf("invalid record of host %s: %v", ip, err)
+		}
+	}
+	host.IP = ip
+	host.Network = name
+	return host, nil
+}
+
+// ListHosts returns the hosts allocated in the named network
+func ListHosts(name string) ([]*Host, error) {
+	if err := migrateLegacyConfig(); err != nil {
+		return nil, err
+	}
+	assigned := networkKey(name, "assigned")
+	if !db.IsKeyExist(assigned) {
+		return nil, nil
+	}
+	nodes, err := db.GetKeys(assigned)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []*Host
+	for _, node := range nodes {
+		host, err := LookupHost(name, filepath.Base(node.Key))
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// DrainHost marks the host of ip draining. Its server stops reporting in,
+// so the address can be released once the host is stale.
+func DrainHost(name, ip string) error {
+	host, err := LookupHost(name, ip)
+	if err != nil {
+		return err
+	}
+	host.Draining = true
+	if err = setHost(host); err != nil {
+		return err
+	}
+	log.Infof("Draining host %s (%s) of network %s", ip, host.Hostname, name)
+	return nil
+}
+
+func setNetworkID(name, ip, id string) error {
+	host, err := LookupHost(name, ip)
+	if err != nil {
+		return err
+	}
+	host.NetworkID = id
+	return setHost(host)
+}
+
+// ReportHosts refreshes LastSeen of the addresses held by this machine in
+// every host network, every HeartbeatInterval
+func ReportHosts() {
+	local := localHost("", "")
+	for {
+		reportHosts(local)
+		time.Sleep(HeartbeatInterval)
+	}
+}
+
+func reportHosts(local *Host) {
+	if !db.IsKeyExist(network_key_prefix) {
+		return
+	}
+	configs, err := ListNetworks()
+	if err != nil {
+		log.Warnf("Could not list host networks: %v", err)
+		return
+	}
+	for _, config := range configs {
+		hosts, err := ListHosts(config.Name)
+		if err != nil {
+			log.Warnf("Could not list hosts of network %s: %v", config.Name, err)
+			continue
+		}
+		for _, host := range hosts {
+			if !host.isLocal(local) || host.Draining {
+				continue
+			}
+			if err = reportHost(host_records, config.Name, host.IP, local); err != nil {
+				log.Warnf("Could not report host %s of network %s: %v", host.IP, config.Name, err)
+			}
+		}
+	}
+}
+
+// hostRecords reads and compare-and-swaps the host records
+type hostRecords interface {
+	Get(key string) (value string, index uint64, err error)
+	CompareAndSwap(key, value string, index uint64) error
+}
+
+type etcdHostRecords struct{}
+
+func (etcdHostRecords) Get(key string) (string, uint64, error) {
+	return db.GetKeyIndex(key)
+}
+
+func (etcdHostRecords) CompareAndSwap(key, value string, index uint64) error {
+	return db.CompareAndSwapKey(key, value, index)
+}
+
+var host_records hostRecords = etcdHostRecords{}
+
+// report_retries bounds the compare and swap attempts of a heartbeat
+const report_retries = 5
+
+// reportHost refreshes LastSeen of the record of ip. The record is swapped
+// only if nobody wrote it since it was read, so a concurrent DrainHost is
+// never overwritten.
+func reportHost(records hostRecords, name, ip string, local *Host) error {
+	key := networkKey(name, "assigned", ip)
+	for i := 0; i < report_retries; i++ {
+		value, index, err := records.Get(key)
+		if err != nil {
+			return err
+		}
+		host := &Host{}
+		if value != "" {
+			if err = json.Unmarshal([]byte(value), host); err != nil {
+				return fmt.Errorf("invalid record of host %s: %v", ip, err)
+			}
+		}
+		host.IP = ip
+		host.Network = name
+		if !host.isLocal(local) || host.Draining {
+			return nil
+		}
+		host.LastSeen = time.Now()
+		host_bytes, _ := json.Marshal(host)
+		err = records.CompareAndSwap(key, string(host_bytes), index)
+		if !db.IsCompareFailed(err) {
+			return err
+		}
+		log.Debugf("Host %s of network %s changed while reporting in, retrying", ip, name)
+	}
+	return fmt.Errorf("host %s of network %s keeps changing", ip, name)
+}
@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// fakeHostRecords keeps the records in memory, before is called between a
+// Get and the following CompareAndSwap
+type fakeHostRecords struct {
+	values  map[string]string
+	indexes map[string]uint64
+	index   uint64
+	before  func()
+	swaps   int
+}
+
+func (f *fakeHostRecords) set(key, value string) {
+	f.index++
+	f.values[key] = value
+	f.indexes[key] = f.index
+}
+
+func (f *fakeHostRecords) Get(key string) (string, uint64, error) {
+	value, ok := f.values[key]
+	if !ok {
+		return "", 0, client.Error{Code: client.ErrorCodeKeyNotFound}
+	}
+	return value, f.indexes[key], nil
+}
+
+func (f *fakeHostRecords) CompareAndSwap(key, value string, index uint64) error {
+	if f.before != nil {
+		before := f.before
+		f.before = nil
+		before()
+	}
+	f.swaps++
+	if f.indexes[key] != index {
+		return client.Error{Code: client.ErrorCodeTestFailed}
+	}
+	f.set(key, value)
+	return nil
+}
+
+func (f *fakeHostRecords) host(t *testing.T, key string) *Host {
+	host := &Host{}
+	if err := json.Unmarshal([]byte(f.values[key]), host); err != nil {
+		t.Fatal(err)
+	}
+	return host
+}
+
+func newFakeHostRecords(key string, host *Host) *fakeHostRecords {
+	f := &fakeHostRecords{values: map[string]string{}, indexes: map[string]uint64{}}
+	host_bytes, _ := json.Marshal(host)
+	f.set(key, string(host_bytes))
+	return f
+}
+
+func TestReportHost(t *testing.T) {
+	local := &Host{Hostname: "node-1", MachineID: "m1"}
+	key := networkKey("web", "assigned", "10.0.0.2")
+	stale := time.Now().Add(-time.Hour)
+	records := newFakeHostRecords(key, &Host{Hostname: "node-1", MachineID: "m1", LastSeen: stale})
+
+	if err := reportHost(records, "web", "10.0.0.2", local); err != nil {
+		t.Fatal(err)
+	}
+	if host := records.host(t, key); !host.LastSeen.After(stale) || host.IP != "10.0.0.2" {
+		t.Errorf("got %+v, want LastSeen refreshed", host)
+	}
+
+	// another machine's record is left alone
+	records = newFakeHostRecords(key, &Host{Hostname: "node-2", MachineID: "m2", LastSeen: stale})
+	if err := reportHost(records, "web", "10.0.0.2", local); err != nil {
+		t.Fatal(err)
+	}
+	if records.swaps != 0 {
+		t.Errorf("got %d swaps of the record of another host", records.swaps)
+	}
+}
+
+func TestReportHostRacesDrain(t *testing.T) {
+	local := &Host{Hostname: "node-1", MachineID: "m1"}
+	key := networkKey("web", "assigned", "10.0.0.2")
+	stale := time.Now().Add(-time.Hour)
+	records := newFakeHostRecords(key, &Host{Hostname: "node-1", MachineID: "m1", LastSeen: stale})
+	// the host is drained after the heartbeat read its record
+	records.before = func() {
+		host := records.host(t, key)
+		host.Draining = true
+		host_bytes, _ := json.Marshal(host)
+		records.set(key, string(host_bytes))
+	}
+
+	if err := reportHost(records, "web", "10.0.0.2", local); err != nil {
+		t.Fatal(err)
+	}
+	host := records.host(t, key)
+	if !host.Draining {
+		t.Error("the heartbeat overwrote the drain")
+	}
+	if !host.LastSeen.Equal(stale) {
+		t.Errorf("got LastSeen %v, a draining host must not report in", host.LastSeen)
+	}
+	if records.swaps != 1 {
+		t.Errorf("got %d swaps, want 1 failed swap", records.swaps)
+	}
+}
@@ -0,0 +1,82 @@
+package bridge
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const network_scripts = "/etc/sysconfig/network-scripts"
+
+// ifcfgRenderer writes RHEL/CentOS network-scripts
+type ifcfgRenderer struct{}
+
+func (r *ifcfgRenderer) Name() string {
+	return "ifcfg"
+}
+
+func (r *ifcfgRenderer) Detect(root string) bool {
+	return pathExists(filepath.Join(root, network_scripts))
+}
+
+// keys of an uplink ifcfg file that belong to the bridge once it is enslaved
+var ifcfg_address_keys = []string{"BOOTPROTO", "IPADDR", "NETMASK", "PREFIX", "GATEWAY", "BRIDGE", "DNS1", "DNS2"}
+
+func (r *ifcfgRenderer) Render(root string, spec *BridgeSpec) ([]File, error) {
+	ip, _, netmask := splitAddress(spec.Address)
+	bridge_content := fmt.Sprint("DEVICE=", spec.Bridge, "\n",
+		"TYPE=Bridge\n",
+		"BOOTPROTO=static\n",
+		"IPADDR=", ip, "\n",
+		"GATEWAY=", spec.Gateway, "\n",
+		"NETMASK=", netmask, "\n",
+		"MTU=", spec.MTU, "\n",
+		"ONBOOT=yes\n",
+		"NOZEROCONF=yes\n",
+		"IPV6INIT=no\n",
+		"NM_CONTROLLED=no\n",
+		"DELAY=0\n")
+
+	// keep the uplink settings such as bonding or vlan options and only
+	// replace its addressing with the bridge
+	uplink_path := filepath.Join(network_scripts, "ifcfg-"+spec.Uplink)
+	var lines []string
+	existing, err := ioutil.ReadFile(filepath.Join(root, uplink_path))
+	if err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(existing)))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if isIfcfgAddressLine(line) {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	} else if spec.UplinkKind == UplinkVlan {
+		lines = []string{"VLAN=yes", "DEVICE=" + spec.Uplink, "NAME=" + spec.Uplink, "PHYSDEV=" + spec.VlanParent,
+			"ONBOOT=yes", "ONPARENT=yes", "NM_CONTROLLED=no"}
+	} else {
+		lines = []string{"DEVICE=" + spec.Uplink, "ONBOOT=yes", "NM_CONTROLLED=no"}
+	}
+	lines = append(lines, "BOOTPROTO=none", "BRIDGE="+spec.Bridge)
+
+	return []File{
+		{Path: filepath.Join(network_scripts, "ifcfg-"+spec.Bridge), Content: bridge_content, Mode: 0644},
+		{Path: uplink_path, Content: strings.Join(lines, "\n") + "\n", Mode: 0644},
+	}, nil
+}
+
+func isIfcfgAddressLine(line string) bool {
+	key := strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+	for _, k := range ifcfg_address_keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ifcfgRenderer) Reload() error {
+	return nil
+}
@@ -0,0 +1,233 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// BridgeSpec is the host side layout of a host network: the bridge carrying
+// the host address and the uplink enslaved to it
+type BridgeSpec struct {
+	Bridge     string
+	Uplink     string
+	UplinkKind string
+	BondMode   string
+	VlanParent string
+	VlanID     int
+	Address    string // in CIDR format
+	Gateway    string
+	MTU        int
+}
+
+func newBridgeSpec(ip string, uplink *Uplink, config *Config) *BridgeSpec {
+	_, subnet, _ := net.ParseCIDR(config.Subnet)
+	prefix, _ := subnet.Mask.Size()
+	spec := &BridgeSpec{
+		Bridge:     config.Bridge,
+		Uplink:     uplink.Name,
+		UplinkKind: uplink.Kind,
+		VlanParent: uplink.Parent,
+		VlanID:     uplink.VlanID,
+		Address:    fmt.Sprintf("%s/%d", ip, prefix),
+		Gateway:    config.Gateway,
+		MTU:        config.MTU,
+	}
+	if uplink.Kind == UplinkBond {
+		if link, err := netlink.LinkByName(uplink.Name); err == nil {
+			if bond, ok := link.(*netlink.Bond); ok {
+				spec.BondMode = bond.Mode.String()
+			}
+		}
+	}
+	return spec
+}
+
+func ensureBridge(name string, mtu int) (*netlink.Bridge, error) {
+	br := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  mtu,
+			// leaving TxQLen unset means a zero-length TX queue
+			TxQLen: -1,
+		},
+	}
+	err := netlink.LinkAdd(br)
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", name, err)
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", name, err)
+	}
+	br, ok := l.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists but is not a bridge", name)
+	}
+	if err = netlink.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// setupBridge applies spec to the running host: the bridge is created with
+// the host address, the uplink is enslaved and its IPv4 addresses and routes
+// move to the bridge. The routes are checked before the host is changed, the
+// address is added to the bridge before the uplink loses its own so the host
+// stays reachable on the segment.
+func setupBridge(spec *BridgeSpec) error {
+	addr, err := netlink.ParseAddr(spec.Address)
+	if err != nil {
+		return err
+	}
+	uplink, err := netlink.LinkByName(spec.Uplink)
+	if err != nil {
+		return fmt.Errorf("could not lookup uplink %q: %v", spec.Uplink, err)
+	}
+	uplink_routes, err := netlink.RouteList(uplink, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	// the routes are re-targeted once the bridge index is known
+	if _, err = bridgeRoutes(uplink_routes, 0, addr, net.ParseIP(spec.Gateway)); err != nil {
+		return fmt.Errorf("could not move the routes of %q to %q: %v", spec.Uplink, spec.Bridge, err)
+	}
+
+	br, err := ensureBridge(spec.Bridge, spec.MTU)
+	if err != nil {
+		return err
+	}
+	if err = netlink.AddrAdd(br, addr); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("could not add IP address %s to %q: %v", spec.Address, spec.Bridge, err)
+	}
+	if uplink.Attrs().MasterIndex != br.Attrs().Index {
+		if err = netlink.LinkSetMaster(uplink, br); err != nil {
+			return fmt.Errorf("could not enslave %q to %q: %v", spec.Uplink, spec.Bridge, err)
+		}
+	}
+	if err = netlink.LinkSetUp(uplink); err != nil {
+		return err
+	}
+
+	addrs, err := netlink.AddrList(uplink, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		log.Infof("Removing address %s from uplink %s", a.IPNet, spec.Uplink)
+		if err = netlink.AddrDel(uplink, &a); err != nil {
+			return fmt.Errorf("could not remove IP address %s from %q: %v", a.IPNet, spec.Uplink, err)
+		}
+	}
+	routes, _ := bridgeRoutes(uplink_routes, br.Attrs().Index, addr, net.ParseIP(spec.Gateway))
+	for _, route := range routes {
+		route := route
+		if err = netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("could not add route %s on %q: %v", route, spec.Bridge, err)
+		}
+	}
+	log.Infof("Bridge %s is up with %s on uplink %s", spec.Bridge, spec.Address, spec.Uplink)
+	return nil
+}
+
+// bridgeRoutes returns the IPv4 routes of the uplink moved to the bridge at
+// bridge_index. The connected routes of the uplink addresses are left out,
+// the bridge gets its own for addr. The default route goes via gateway when
+// set. Routes the bridge can not carry are an error.
+func bridgeRoutes(routes []netlink.Route, bridge_index int, addr *netlink.Addr, gateway net.IP) ([]netlink.Route, error) {
+	var moved []netlink.Route
+	for _, route := range routes {
+		if route.Protocol == syscall.RTPROT_KERNEL {
+			continue
+		}
+		if len(route.MultiPath) != 0 {
+			return nil, fmt.Errorf("multipath route %s is not supported", route)
+		}
+		if route.Dst == nil && gateway != nil {
+			route.Gw = gateway
+		}
+		if route.Gw != nil && !addr.IPNet.Contains(route.Gw) {
+			return nil, fmt.Errorf("gateway %s of route %s is outside of %s", route.Gw, route, addr.IPNet)
+		}
+		// the source addresses of the uplink are gone
+		if route.Src != nil && !route.Src.Equal(addr.IP) {
+			route.Src = nil
+		}
+		route.LinkIndex = bridge_index
+		moved = append(moved, route)
+	}
+	return moved, nil
+}
+
+// linkSnapshot is the state of the links touched by setupBridge, taken
+// before it runs so a failed create-network can put the host back
+type linkSnapshot struct {
+	spec           *BridgeSpec
+	bridge_existed bool
+	uplink_master  int
+	uplink_addrs   []netlink.Addr
+	uplink_routes  []netlink.Route
+}
+
+func takeLinkSnapshot(spec *BridgeSpec) (*linkSnapshot, error) {
+	snapshot := &linkSnapshot{spec: spec}
+	if _, err := netlink.LinkByName(spec.Bridge); err == nil {
+		snapshot.bridge_existed = true
+	}
+	uplink, err := netlink.LinkByName(spec.Uplink)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup uplink %q: %v", spec.Uplink, err)
+	}
+	snapshot.uplink_master = uplink.Attrs().MasterIndex
+	if snapshot.uplink_addrs, err = netlink.AddrList(uplink, netlink.FAMILY_V4); err != nil {
+		return nil, err
+	}
+	if snapshot.uplink_routes, err = netlink.RouteList(uplink, netlink.FAMILY_V4); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// restore releases the uplink from the bridge and gives it back its
+// addresses and routes. A bridge created by setupBridge is deleted.
+func (s *linkSnapshot) restore() error {
+	if s == nil {
+		return nil
+	}
+	uplink, err := netlink.LinkByName(s.spec.Uplink)
+	if err != nil {
+		return err
+	}
+	if br, err := netlink.LinkByName(s.spec.Bridge); err == nil {
+		if !s.bridge_existed {
+			log.Infof("Deleting bridge %s", s.spec.Bridge)
+			if err = netlink.LinkDel(br); err != nil {
+				return err
+			}
+		} else {
+			if addr, err := netlink.ParseAddr(s.spec.Address); err == nil {
+				netlink.AddrDel(br, addr)
+			}
+			if s.uplink_master != br.Attrs().Index {
+				if err = netlink.LinkSetNoMaster(uplink); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, a := range s.uplink_addrs {
+		if err = netlink.AddrAdd(uplink, &a); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not restore IP address %s on %q: %v", a.IPNet, s.spec.Uplink, err)
+		}
+	}
+	for _, r := range s.uplink_routes {
+		if err = netlink.RouteReplace(&r); err != nil {
+			log.Warnf("Could not restore route %s on %s: %v", r, s.spec.Uplink, err)
+		}
+	}
+	log.Infof("Restored uplink %s", s.spec.Uplink)
+	return nil
+}
@@ -0,0 +1,64 @@
+package bridge
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestBridgeRoutes(t *testing.T) {
+	addr, _ := netlink.ParseAddr("10.190.52.34/24")
+	_, segment, _ := net.ParseCIDR("10.190.52.0/24")
+	_, other, _ := net.ParseCIDR("10.8.0.0/16")
+	_, scoped, _ := net.ParseCIDR("192.168.7.0/24")
+	gw, router := net.ParseIP("10.190.52.1"), net.ParseIP("10.190.52.6")
+	uplink_routes := []netlink.Route{
+		// the connected route of the old uplink address
+		{LinkIndex: 3, Dst: segment, Src: net.ParseIP("10.190.52.99"), Protocol: syscall.RTPROT_KERNEL, Scope: netlink.SCOPE_LINK},
+		{LinkIndex: 3, Gw: net.ParseIP("10.190.52.254"), Protocol: syscall.RTPROT_BOOT},
+		{LinkIndex: 3, Dst: other, Gw: router, Src: net.ParseIP("10.190.52.99"), Protocol: syscall.RTPROT_STATIC},
+		{LinkIndex: 3, Dst: scoped, Scope: netlink.SCOPE_LINK, Protocol: syscall.RTPROT_BOOT},
+	}
+	tests := []struct {
+		gateway net.IP
+		want    []netlink.Route
+	}{
+		{gw, []netlink.Route{
+			{LinkIndex: 7, Gw: gw, Protocol: syscall.RTPROT_BOOT},
+			{LinkIndex: 7, Dst: other, Gw: router, Protocol: syscall.RTPROT_STATIC},
+			{LinkIndex: 7, Dst: scoped, Scope: netlink.SCOPE_LINK, Protocol: syscall.RTPROT_BOOT},
+		}},
+		// without a gateway in the config the default route keeps its own
+		{nil, []netlink.Route{
+			{LinkIndex: 7, Gw: net.ParseIP("10.190.52.254"), Protocol: syscall.RTPROT_BOOT},
+			{LinkIndex: 7, Dst: other, Gw: router, Protocol: syscall.RTPROT_STATIC},
+			{LinkIndex: 7, Dst: scoped, Scope: netlink.SCOPE_LINK, Protocol: syscall.RTPROT_BOOT},
+		}},
+	}
+	for _, test := range tests {
+		routes, err := bridgeRoutes(uplink_routes, 7, addr, test.gateway)
+		if err != nil {
+			t.Errorf("gateway %v: %v", test.gateway, err)
+			continue
+		}
+		if !reflect.DeepEqual(routes, test.want) {
+			t.Errorf("gateway %v: got %v, want %v", test.gateway, routes, test.want)
+		}
+	}
+	if uplink_routes[1].LinkIndex != 3 || uplink_routes[2].Src == nil {
+		t.Error("the routes of the uplink were changed")
+	}
+
+	for _, route := range []netlink.Route{
+		// the gateway is not on the segment of the bridge
+		{LinkIndex: 3, Dst: other, Gw: net.ParseIP("10.190.53.1")},
+		{LinkIndex: 3, Dst: other, MultiPath: []*netlink.NexthopInfo{{LinkIndex: 3, Gw: router}}},
+	} {
+		if routes, err := bridgeRoutes([]netlink.Route{route}, 7, addr, gw); err == nil {
+			t.Errorf("%s: got %v, want an error", route, routes)
+		}
+	}
+}
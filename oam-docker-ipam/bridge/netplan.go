@@ -0,0 +1,131 @@
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const netplan_dir = "/etc/netplan"
+
+// netplanRenderer writes a netplan v2 yaml file, netplan merges it with the
+// existing files describing the uplink
+type netplanRenderer struct{}
+
+func (r *netplanRenderer) Name() string {
+	return "netplan"
+}
+
+func (r *netplanRenderer) Detect(root string) bool {
+	files, err := ioutil.ReadDir(filepath.Join(root, netplan_dir))
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".yaml") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *netplanRenderer) Render(root string, spec *BridgeSpec) ([]File, error) {
+	// netplan merges definitions of the same device across files, so the
+	// uplink only needs its addressing turned off here. Addresses defined
+	// elsewhere can not be taken away by a later file.
+	if file := findNetplanAddress(root, spec.Uplink); file != "" {
+		return nil, fmt.Errorf("%s configures addresses on uplink %s, remove them before adding it to bridge %s",
+			filepath.Join(netplan_dir, file), spec.Uplink, spec.Bridge)
+	}
+	section := "ethernets"
+	switch spec.UplinkKind {
+	case UplinkBond:
+		section = "bonds"
+	case UplinkVlan:
+		section = "vlans"
+	}
+	uplink_content := fmt.Sprint("  ", section, ":\n",
+		"    ", spec.Uplink, ":\n",
+		"      dhcp4: false\n",
+		"      dhcp6: false\n")
+	if spec.UplinkKind == UplinkVlan {
+		uplink_content += fmt.Sprint("      id: ", spec.VlanID, "\n",
+			"      link: ", spec.VlanParent, "\n")
+	}
+	content := fmt.Sprint("# generated by oam-docker-ipam create-network\n",
+		"network:\n",
+		"  version: 2\n",
+		uplink_content,
+		"  bridges:\n",
+		"    ", spec.Bridge, ":\n",
+		"      interfaces: [", spec.Uplink, "]\n",
+		"      addresses: [", spec.Address, "]\n",
+		"      gateway4: ", spec.Gateway, "\n",
+		"      mtu: ", spec.MTU, "\n",
+		"      dhcp4: false\n",
+		"      dhcp6: false\n",
+		"      parameters:\n",
+		"        stp: false\n",
+		"        forward-delay: 0\n")
+
+	// netplan warns about group or world readable files
+	return []File{
+		{Path: filepath.Join(netplan_dir, "60-skylark-"+spec.Bridge+".yaml"), Content: content, Mode: 0600},
+	}, nil
+}
+
+// findNetplanAddress returns the yaml file giving device name addresses or a
+// gateway, the files skylark wrote itself are skipped
+func findNetplanAddress(root, name string) string {
+	files, err := ioutil.ReadDir(filepath.Join(root, netplan_dir))
+	if err != nil {
+		return ""
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".yaml") || strings.HasPrefix(f.Name(), "60-skylark-") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(root, netplan_dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		// the keys indented below "<name>:" belong to the device, the
+		// nameservers addresses are nested one level deeper
+		device_indent, key_indent := -1, -1
+		for _, line := range strings.Split(string(content), "\n") {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			if device_indent >= 0 && indent <= device_indent {
+				device_indent = -1
+			}
+			if device_indent < 0 {
+				if strings.Trim(strings.TrimSuffix(trimmed, ":"), `"'`) == name && strings.HasSuffix(trimmed, ":") {
+					device_indent, key_indent = indent, -1
+				}
+				continue
+			}
+			if key_indent < 0 {
+				key_indent = indent
+			}
+			if indent != key_indent {
+				continue
+			}
+			for _, key := range []string{"addresses:", "gateway4:"} {
+				if strings.HasPrefix(trimmed, key) && strings.TrimSpace(strings.TrimPrefix(trimmed, key)) != "[]" {
+					return f.Name()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// netplan generate only renders the backend files, netplan apply would
+// bounce the interfaces
+func (r *netplanRenderer) Reload() error {
+	return runCommand("netplan", "generate")
+}
@@ -0,0 +1,148 @@
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const networkd_dir = "/etc/systemd/network"
+
+// networkdRenderer writes systemd-networkd netdev and network units.
+// networkd only applies the first unit in lexical order matching a link, so
+// links that already have a unit are configured through a drop-in of it.
+type networkdRenderer struct{}
+
+func (r *networkdRenderer) Name() string {
+	return "networkd"
+}
+
+func (r *networkdRenderer) Detect(root string) bool {
+	return pathExists(filepath.Join(root, "/run/systemd/netif"))
+}
+
+func (r *networkdRenderer) Render(root string, spec *BridgeSpec) ([]File, error) {
+	netdev_content := fmt.Sprint("[NetDev]\n",
+		"Name=", spec.Bridge, "\n",
+		"Kind=bridge\n",
+		"MTUBytes=", spec.MTU, "\n",
+		"\n",
+		"[Bridge]\n",
+		"STP=false\n",
+		"ForwardDelaySec=0\n")
+
+	bridge_content := fmt.Sprint("[Match]\n",
+		"Name=", spec.Bridge, "\n",
+		"\n",
+		"[Network]\n",
+		"Address=", spec.Address, "\n",
+		"Gateway=", spec.Gateway, "\n",
+		"IPv6AcceptRA=false\n",
+		"LinkLocalAddressing=no\n")
+
+	uplink_content := fmt.Sprint("[Network]\n",
+		"Bridge=", spec.Bridge, "\n",
+		"DHCP=no\n",
+		"LinkLocalAddressing=no\n")
+
+	files := []File{
+		{Path: filepath.Join(networkd_dir, "40-skylark-"+spec.Bridge+".netdev"), Content: netdev_content, Mode: 0644},
+		{Path: filepath.Join(networkd_dir, "40-skylark-"+spec.Bridge+".network"), Content: bridge_content, Mode: 0644},
+	}
+	if unit := findNetworkdUnit(root, spec.Uplink); unit != "" {
+		// a drop-in can not take addresses away from the unit
+		if hasNetworkdAddress(root, unit) {
+			return nil, fmt.Errorf("%s configures addresses on uplink %s, remove them before adding it to bridge %s",
+				filepath.Join(networkd_dir, unit), spec.Uplink, spec.Bridge)
+		}
+		files = append(files,
+			File{Path: filepath.Join(networkd_dir, unit+".d", "skylark-"+spec.Bridge+".conf"), Content: uplink_content, Mode: 0644})
+	} else {
+		uplink_content = fmt.Sprint("[Match]\n",
+			"Name=", spec.Uplink, "\n",
+			"\n",
+			uplink_content)
+		files = append(files,
+			File{Path: filepath.Join(networkd_dir, "40-skylark-"+spec.Uplink+".network"), Content: uplink_content, Mode: 0644})
+	}
+	if spec.UplinkKind == UplinkVlan {
+		vlan_content := fmt.Sprint("[NetDev]\n",
+			"Name=", spec.Uplink, "\n",
+			"Kind=vlan\n",
+			"\n",
+			"[VLAN]\n",
+			"Id=", spec.VlanID, "\n")
+		files = append(files,
+			File{Path: filepath.Join(networkd_dir, "40-skylark-"+spec.Uplink+".netdev"), Content: vlan_content, Mode: 0644})
+
+		// networkd applies only the first unit matching a link, so the vlan
+		// is attached through a drop-in of the parent's unit when it has one
+		parent_content := fmt.Sprint("[Network]\n",
+			"VLAN=", spec.Uplink, "\n")
+		if unit := findNetworkdUnit(root, spec.VlanParent); unit != "" {
+			files = append(files,
+				File{Path: filepath.Join(networkd_dir, unit+".d", "skylark-"+spec.Uplink+".conf"), Content: parent_content, Mode: 0644})
+		} else {
+			parent_content = fmt.Sprint("[Match]\n",
+				"Name=", spec.VlanParent, "\n",
+				"\n",
+				parent_content)
+			files = append(files,
+				File{Path: filepath.Join(networkd_dir, "40-skylark-"+spec.VlanParent+".network"), Content: parent_content, Mode: 0644})
+		}
+	}
+	return files, nil
+}
+
+// findNetworkdUnit returns the name of the .network unit matching link
+// name, the units skylark wrote itself are skipped
+func findNetworkdUnit(root, name string) string {
+	files, err := ioutil.ReadDir(filepath.Join(root, networkd_dir))
+	if err != nil {
+		return ""
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".network") || strings.HasPrefix(f.Name(), "40-skylark-") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(root, networkd_dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "Name=") {
+				continue
+			}
+			for _, n := range strings.Fields(strings.TrimPrefix(line, "Name=")) {
+				if n == name {
+					return f.Name()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// hasNetworkdAddress reports whether the .network unit assigns static
+// addresses or a gateway
+func hasNetworkdAddress(root, unit string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(root, networkd_dir, unit))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "[Address]" || strings.HasPrefix(line, "Address=") || strings.HasPrefix(line, "Gateway=") {
+			return true
+		}
+	}
+	return false
+}
+
+// networkd reads its units again on the next restart, reloading would
+// reconfigure the live links
+func (r *networkdRenderer) Reload() error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package bridge
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const nm_connections = "/etc/NetworkManager/system-connections"
+
+// networkManagerRenderer writes NetworkManager keyfile connections
+type networkManagerRenderer struct{}
+
+func (r *networkManagerRenderer) Name() string {
+	return "networkmanager"
+}
+
+func (r *networkManagerRenderer) Detect(root string) bool {
+	return pathExists(filepath.Join(root, "/run/NetworkManager"))
+}
+
+func (r *networkManagerRenderer) Render(root string, spec *BridgeSpec) ([]File, error) {
+	ip, prefix, _ := splitAddress(spec.Address)
+	bridge_content := fmt.Sprint("[connection]\n",
+		"id=", spec.Bridge, "\n",
+		"type=bridge\n",
+		"interface-name=", spec.Bridge, "\n",
+		"autoconnect=true\n",
+		"\n",
+		"[bridge]\n",
+		"stp=false\n",
+		"forward-delay=0\n",
+		"\n",
+		"[ethernet]\n",
+		"mtu=", spec.MTU, "\n",
+		"\n",
+		"[ipv4]\n",
+		"method=manual\n",
+		"address1=", ip, "/", prefix, ",", spec.Gateway, "\n",
+		"\n",
+		"[ipv6]\n",
+		"method=ignore\n")
+
+	kind := spec.UplinkKind
+	if kind == "" {
+		kind = UplinkEthernet
+	}
+	uplink_content := fmt.Sprint("[connection]\n",
+		"id=", spec.Bridge, "-", spec.Uplink, "\n",
+		"type=", kind, "\n",
+		"interface-name=", spec.Uplink, "\n",
+		"master=", spec.Bridge, "\n",
+		"slave-type=bridge\n",
+		"autoconnect=true\n")
+	switch spec.UplinkKind {
+	case UplinkVlan:
+		uplink_content += fmt.Sprint("\n",
+			"[vlan]\n",
+			"parent=", spec.VlanParent, "\n",
+			"id=", spec.VlanID, "\n")
+	case UplinkBond:
+		uplink_content += fmt.Sprint("\n",
+			"[bond]\n",
+			"mode=", spec.BondMode, "\n")
+	}
+
+	// NetworkManager ignores keyfiles readable by other users
+	return []File{
+		{Path: filepath.Join(nm_connections, spec.Bridge+".nmconnection"), Content: bridge_content, Mode: 0600},
+		{Path: filepath.Join(nm_connections, spec.Bridge+"-"+spec.Uplink+".nmconnection"), Content: uplink_content, Mode: 0600},
+	}, nil
+}
+
+func (r *networkManagerRenderer) Reload() error {
+	return runCommand("nmcli", "connection", "reload")
+}
@@ -0,0 +1,263 @@
+package bridge
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+)
+
+// step is one change create-network makes to the store, the host or docker.
+// undo reverts it when it or a later step fails, so it has to cope with a do
+// that stopped halfway.
+type step struct {
+	kind        string
+	description string
+	detail      string
+	do          func() error
+	undo        func() error
+}
+
+// Plan is the ordered list of steps create-network takes
+type Plan struct {
+	steps []*step
+}
+
+func (p *Plan) add(s *step) {
+	p.steps = append(p.steps, s)
+}
+
+// Print writes the planned changes without applying them
+func (p *Plan) Print(w io.Writer) {
+	for _, s := range p.steps {
+		fmt.Fprintf(w, "[%s] %s\n", s.kind, s.description)
+		if s.detail == "" {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(s.detail, "\n"), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
+
+// Apply runs the steps in order. If one fails it is undone first, then the
+// steps already done in reverse order, and the error of the failed step is
+// returned.
+func (p *Plan) Apply() error {
+	var done []*step
+	for _, s := range p.steps {
+		log.Infof("%s: %s", s.kind, s.description)
+		done = append(done, s)
+		if err := s.do(); err != nil {
+			log.Errorf("%s failed: %v, rolling back", s.description, err)
+			for i := len(done) - 1; i >= 0; i-- {
+				if done[i].undo == nil {
+					continue
+				}
+				if uerr := done[i].undo(); uerr != nil {
+					log.Errorf("Failed to undo %s: %v", done[i].description, uerr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// planNetwork lists the steps attaching this host to network config with ip
+func planNetwork(ip string, uplink *Uplink, config *Config, renderer Renderer, root string) (*Plan, error) {
+	plan := &Plan{}
+	if config.Driver != DriverBridge {
+		// the containers sit directly on the uplink, the host keeps its
+		// own addressing and docker adds a missing vlan parent itself
+		addDockerStep(plan, "", uplink.Name, config)
+		return plan, nil
+	}
+	spec := newBridgeSpec(ip, uplink, config)
+	files, err := renderer.Render(root, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	host := localHost(config.Name, ip)
+	host.Uplink = uplink.Name
+	host.Bridge = config.Bridge
+	// allocateHost puts the ip back in the pool itself when it fails
+	var allocated bool
+	plan.add(&step{
+		kind:        "store",
+		description: fmt.Sprintf("move %s to %s", networkKey(config.Name, "pool", ip), networkKey(config.Name, "assigned", ip)),
+		detail:      fmt.Sprintf("hostname %s, machine-id %s", host.Hostname, host.MachineID),
+		do: func() error {
+			if err := allocateHost(host); err != nil {
+				return err
+			}
+			allocated = true
+			return nil
+		},
+		undo: func() error {
+			if !allocated {
+				return nil
+			}
+			return releaseHost(config.Name, ip)
+		},
+	})
+
+	if !uplink.Exists {
+		plan.add(&step{
+			kind:        "vlan",
+			description: fmt.Sprintf("create vlan %s with id %d on %s", uplink.Name, uplink.VlanID, uplink.Parent),
+			do:          func() error { return ensureVlan(uplink) },
+			undo:        func() error { return deleteVlan(uplink) },
+		})
+	}
+
+	var snapshot *linkSnapshot
+	plan.add(&step{
+		kind:        "bridge",
+		description: fmt.Sprintf("create bridge %s with %s and enslave %s", spec.Bridge, spec.Address, spec.Uplink),
+		detail:      fmt.Sprintf("mtu %d, default route via %s", spec.MTU, spec.Gateway),
+		do: func() error {
+			var err error
+			if snapshot, err = takeLinkSnapshot(spec); err != nil {
+				return err
+			}
+			return setupBridge(spec)
+		},
+		undo: func() error { return snapshot.restore() },
+	})
+
+	addDockerStep(plan, ip, uplink.Name, config)
+
+	for _, f := range files {
+		f := f
+		var backup *fileBackup
+		plan.add(&step{
+			kind:        "file",
+			description: fmt.Sprintf("write %s", filepath.Join(root, f.Path)),
+			detail:      f.Content,
+			do: func() error {
+				var err error
+				if backup, err = takeFileBackup(filepath.Join(root, f.Path)); err != nil {
+					return err
+				}
+				return writeFiles(root, []File{f})
+			},
+			undo: func() error { return backup.restore() },
+		})
+	}
+
+	plan.add(&step{
+		kind:        "renderer",
+		description: fmt.Sprintf("reload %s", renderer.Name()),
+		do:          renderer.Reload,
+	})
+	return plan, nil
+}
+
+// addDockerStep creates the docker network, the id is recorded in the host
+// record when the host holds ip. A network recreated with other options is
+// put back on undo.
+func addDockerStep(plan *Plan, ip, parent string, config *Config) {
+	options := networkCreateOptions(ip, parent, config)
+	var created bool
+	var replaced *types.NetworkResource
+	plan.add(&step{
+		kind:        "docker",
+		description: fmt.Sprintf("create network %s with driver %s", config.DockerNetwork, options.Driver),
+		detail:      describeNetwork(options),
+		do: func() error {
+			var id string
+			var err error
+			id, created, replaced, err = createDockerNetwork(config.DockerNetwork, options)
+			if err != nil {
+				return err
+			}
+			if ip == "" {
+				return nil
+			}
+			return setNetworkID(config.Name, ip, id)
+		},
+		undo: func() error {
+			if created {
+				if err := removeDockerNetwork(config); err != nil {
+					return err
+				}
+			}
+			if replaced != nil {
+				return restoreDockerNetwork(replaced)
+			}
+			return nil
+		},
+	})
+}
+
+func describeNetwork(options types.NetworkCreate) string {
+	var lines []string
+	for _, c := range options.IPAM.Config {
+		lines = append(lines, fmt.Sprintf("ipam %s subnet %s gateway %s", options.IPAM.Driver, c.Subnet, c.Gateway))
+		var names []string
+		for name := range c.AuxAddress {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("aux-address %s=%s", name, c.AuxAddress[name]))
+		}
+	}
+	var keys []string
+	for k := range options.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("opt %s=%s", k, options.Options[k]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fileBackup holds the content a file had before create-network wrote it
+type fileBackup struct {
+	path    string
+	existed bool
+	content []byte
+	mode    os.FileMode
+}
+
+func takeFileBackup(path string) (*fileBackup, error) {
+	backup := &fileBackup{path: path}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return backup, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if backup.content, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	backup.existed = true
+	backup.mode = info.Mode()
+	return backup, nil
+}
+
+func (b *fileBackup) restore() error {
+	if b == nil {
+		return nil
+	}
+	if !b.existed {
+		err := os.Remove(b.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	log.Infof("Restoring %s", b.path)
+	return ioutil.WriteFile(b.path, b.content, b.mode)
+}
@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeStep records its do and undo calls in log
+func fakeStep(name string, log *[]string, fail error, undo_err error) *step {
+	return &step{
+		kind:        "fake",
+		description: name,
+		do: func() error {
+			*log = append(*log, "do "+name)
+			return fail
+		},
+		undo: func() error {
+			*log = append(*log, "undo "+name)
+			return undo_err
+		},
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	var log []string
+	plan := &Plan{}
+	plan.add(fakeStep("a", &log, nil, nil))
+	plan.add(fakeStep("b", &log, nil, nil))
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"do a", "do b"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+}
+
+func TestPlanRollback(t *testing.T) {
+	failed := errors.New("failed")
+	var log []string
+	plan := &Plan{}
+	plan.add(fakeStep("a", &log, nil, nil))
+	// an undo failing does not stop the rollback
+	plan.add(fakeStep("b", &log, nil, errors.New("undo failed")))
+	plan.add(&step{kind: "fake", description: "no undo", do: func() error {
+		log = append(log, "do no undo")
+		return nil
+	}})
+	plan.add(fakeStep("c", &log, failed, nil))
+	plan.add(fakeStep("d", &log, nil, nil))
+	if err := plan.Apply(); err != failed {
+		t.Fatalf("got error %v, want %v", err, failed)
+	}
+	// the failed step cleans up after itself first
+	want := []string{"do a", "do b", "do no undo", "do c", "undo c", "undo b", "undo a"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+}
+
+// failingReload renders like its Renderer but fails to reload
+type failingReload struct {
+	Renderer
+}
+
+func (r *failingReload) Reload() error {
+	return errors.New("reload failed")
+}
+
+func TestPlanRollbackFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "skylark-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	uplink := filepath.Join(root, network_scripts, "ifcfg-bond0.52")
+	os.MkdirAll(filepath.Dir(uplink), 0755)
+	old := "VLAN=yes\nDEVICE=bond0.52\nPHYSDEV=bond0\nBOOTPROTO=static\nIPADDR=10.190.52.99\n"
+	if err = ioutil.WriteFile(uplink, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bridge := filepath.Join(root, network_scripts, "ifcfg-br0")
+
+	renderer, err := GetRenderer("ifcfg", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Name: "vlan52", Subnet: "10.190.52.0/24", Gateway: "10.190.52.1"}
+	setDefaults(config)
+	plan, err := planNetwork("10.190.52.34", &Uplink{Name: "bond0.52", Kind: UplinkVlan, Parent: "bond0", VlanID: 52, Exists: true},
+		config, &failingReload{renderer}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the store, the links and docker are faked, the files are written
+	// under root
+	var log []string
+	var kinds []string
+	for _, s := range plan.steps {
+		kinds = append(kinds, s.kind)
+		if s.kind == "file" || s.kind == "renderer" {
+			continue
+		}
+		*s = *fakeStep(s.kind, &log, nil, nil)
+	}
+	if want := []string{"store", "bridge", "docker", "file", "file", "renderer"}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("got steps %v, want %v", kinds, want)
+	}
+	if err = plan.Apply(); err == nil {
+		t.Fatal("expected the plan to fail")
+	}
+	if want := []string{"do store", "do bridge", "do docker", "undo docker", "undo bridge", "undo store"}; !reflect.DeepEqual(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+
+	content, err := ioutil.ReadFile(uplink)
+	if err != nil || string(content) != old {
+		t.Errorf("got %q, %v, want the old content back", content, err)
+	}
+	if info, err := os.Stat(uplink); err != nil || info.Mode() != 0600 {
+		t.Errorf("got %v, %v, want mode 0600", info, err)
+	}
+	if _, err = os.Stat(bridge); !os.IsNotExist(err) {
+		t.Errorf("got %v, want %s removed", err, bridge)
+	}
+}
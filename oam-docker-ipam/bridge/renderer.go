@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// File is a network configuration file produced by a renderer, Path is
+// absolute on the target host and gets joined with the config root on write
+type File struct {
+	Path    string
+	Content string
+	Mode    os.FileMode
+}
+
+// Renderer persists a BridgeSpec in the format of one network configuration
+// backend so the bridge comes back after a reboot
+type Renderer interface {
+	Name() string
+	// Detect reports whether the backend manages the host found under root
+	Detect(root string) bool
+	// Render returns the files to write, existing files are read under root
+	Render(root string, spec *BridgeSpec) ([]File, error)
+	// Reload makes the backend pick up the new files without touching
+	// the running interfaces
+	Reload() error
+}
+
+// renderers in detection order
+var renderers = []Renderer{
+	&netplanRenderer{},
+	&networkManagerRenderer{},
+	&networkdRenderer{},
+	&ifcfgRenderer{},
+}
+
+// RendererNames lists the renderers accepted by GetRenderer
+func RendererNames() []string {
+	var names []string
+	for _, r := range renderers {
+		names = append(names, r.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetRenderer returns the renderer called name, or detects the one managing
+// the host under root when name is "auto" or empty
+func GetRenderer(name, root string) (Renderer, error) {
+	if name == "" || name == "auto" {
+		for _, r := range renderers {
+			if r.Detect(root) {
+				log.Infof("Detected network renderer %s", r.Name())
+				return r, nil
+			}
+		}
+		return nil, fmt.Errorf("no network renderer detected, use one of %s", strings.Join(RendererNames(), ", "))
+	}
+	for _, r := range renderers {
+		if r.Name() == name {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network renderer %s, use one of %s", name, strings.Join(RendererNames(), ", "))
+}
+
+func writeFiles(root string, files []File) error {
+	for _, f := range files {
+		path := filepath.Join(root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(f.Content), f.Mode); err != nil {
+			return err
+		}
+		log.Infof("Wrote %s", path)
+	}
+	return nil
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v %s", name, strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+// splitAddress returns the IP, prefix length and dotted netmask of a CIDR
+func splitAddress(address string) (string, int, string) {
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return address, 0, ""
+	}
+	prefix, _ := ipnet.Mask.Size()
+	return ip.String(), prefix, net.IP(ipnet.Mask).String()
+}
@@ -0,0 +1,170 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testSpec = &BridgeSpec{
+	Bridge:     "br0",
+	Uplink:     "bond0.52",
+	UplinkKind: UplinkVlan,
+	VlanParent: "bond0",
+	VlanID:     52,
+	Address:    "10.190.52.34/24",
+	Gateway:    "10.190.52.1",
+	MTU:        1500,
+}
+
+func renderTo(t *testing.T, name string, setup func(root string)) (string, map[string]string) {
+	root, err := ioutil.TempDir("", "skylark-renderer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(root)
+	}
+	r, err := GetRenderer(name, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := r.Render(root, testSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFiles(root, files); err != nil {
+		t.Fatal(err)
+	}
+	written := map[string]string{}
+	for _, f := range files {
+		content, err := ioutil.ReadFile(filepath.Join(root, f.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written[f.Path] = string(content)
+	}
+	return root, written
+}
+
+func expectContains(t *testing.T, content string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(content, line) {
+			t.Errorf("expected %q in:\n%s", line, content)
+		}
+	}
+}
+
+func TestIfcfgRenderer(t *testing.T) {
+	uplink := "VLAN=yes\nDEVICE=bond0.52\nPHYSDEV=bond0\nONBOOT=yes\nBOOTPROTO=static\nIPADDR=10.190.52.99\nNETMASK=255.255.255.0\n"
+	root, written := renderTo(t, "ifcfg", func(root string) {
+		os.MkdirAll(filepath.Join(root, network_scripts), 0755)
+		ioutil.WriteFile(filepath.Join(root, network_scripts, "ifcfg-bond0.52"), []byte(uplink), 0644)
+	})
+	defer os.RemoveAll(root)
+
+	expectContains(t, written[filepath.Join(network_scripts, "ifcfg-br0")],
+		"DEVICE=br0\n", "TYPE=Bridge\n", "IPADDR=10.190.52.34\n", "NETMASK=255.255.255.0\n", "GATEWAY=10.190.52.1\n")
+	uplink_content := written[filepath.Join(network_scripts, "ifcfg-bond0.52")]
+	expectContains(t, uplink_content, "VLAN=yes\n", "PHYSDEV=bond0\n", "BOOTPROTO=none\n", "BRIDGE=br0\n")
+	if strings.Contains(uplink_content, "IPADDR") || strings.Contains(uplink_content, "BOOTPROTO=static") {
+		t.Errorf("uplink kept its addressing:\n%s", uplink_content)
+	}
+}
+
+func TestNetworkManagerRenderer(t *testing.T) {
+	root, written := renderTo(t, "networkmanager", nil)
+	defer os.RemoveAll(root)
+
+	expectContains(t, written[filepath.Join(nm_connections, "br0.nmconnection")],
+		"type=bridge\n", "interface-name=br0\n", "address1=10.190.52.34/24,10.190.52.1\n")
+	expectContains(t, written[filepath.Join(nm_connections, "br0-bond0.52.nmconnection")],
+		"type=vlan\n", "interface-name=bond0.52\n", "master=br0\n", "slave-type=bridge\n", "parent=bond0\n", "id=52\n")
+	info, err := os.Stat(filepath.Join(root, nm_connections, "br0.nmconnection"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("keyfile must only be readable by root: %v %v", info, err)
+	}
+}
+
+func TestNetworkdRenderer(t *testing.T) {
+	root, written := renderTo(t, "networkd", func(root string) {
+		os.MkdirAll(filepath.Join(root, networkd_dir), 0755)
+		ioutil.WriteFile(filepath.Join(root, networkd_dir, "10-bond0.network"), []byte("[Match]\nName=bond0\n"), 0644)
+	})
+	defer os.RemoveAll(root)
+
+	expectContains(t, written[filepath.Join(networkd_dir, "40-skylark-br0.netdev")], "Name=br0\n", "Kind=bridge\n")
+	expectContains(t, written[filepath.Join(networkd_dir, "40-skylark-br0.network")],
+		"Address=10.190.52.34/24\n", "Gateway=10.190.52.1\n")
+	expectContains(t, written[filepath.Join(networkd_dir, "40-skylark-bond0.52.network")], "Name=bond0.52\n", "Bridge=br0\n")
+	expectContains(t, written[filepath.Join(networkd_dir, "40-skylark-bond0.52.netdev")], "Kind=vlan\n", "Id=52\n")
+	expectContains(t, written[filepath.Join(networkd_dir, "10-bond0.network.d", "skylark-bond0.52.conf")], "VLAN=bond0.52\n")
+}
+
+func TestNetworkdRendererUplinkUnit(t *testing.T) {
+	root, written := renderTo(t, "networkd", func(root string) {
+		os.MkdirAll(filepath.Join(root, networkd_dir), 0755)
+		ioutil.WriteFile(filepath.Join(root, networkd_dir, "20-vlan.network"), []byte("[Match]\nName=bond0.52\n\n[Network]\nDHCP=yes\n"), 0644)
+	})
+	defer os.RemoveAll(root)
+
+	if _, ok := written[filepath.Join(networkd_dir, "40-skylark-bond0.52.network")]; ok {
+		t.Error("the existing unit of the uplink would win the match")
+	}
+	expectContains(t, written[filepath.Join(networkd_dir, "20-vlan.network.d", "skylark-br0.conf")], "Bridge=br0\n", "DHCP=no\n")
+
+	// addresses of the unit can not be taken away by the drop-in
+	ioutil.WriteFile(filepath.Join(root, networkd_dir, "20-vlan.network"), []byte("[Match]\nName=bond0.52\n\n[Network]\nAddress=10.190.52.99/24\n"), 0644)
+	if _, err := (&networkdRenderer{}).Render(root, testSpec); err == nil {
+		t.Error("expected an error for an uplink with addresses")
+	}
+}
+
+func TestNetplanRenderer(t *testing.T) {
+	root, written := renderTo(t, "netplan", func(root string) {
+		os.MkdirAll(filepath.Join(root, netplan_dir), 0755)
+		ioutil.WriteFile(filepath.Join(root, netplan_dir, "50-cloud-init.yaml"),
+			[]byte("network:\n  vlans:\n    bond0.52:\n      dhcp4: true\n      nameservers:\n        addresses: [10.190.0.2]\n"), 0644)
+	})
+	defer os.RemoveAll(root)
+
+	expectContains(t, written[filepath.Join(netplan_dir, "60-skylark-br0.yaml")],
+		"  vlans:\n", "      id: 52\n", "      link: bond0\n", "    br0:\n", "interfaces: [bond0.52]\n", "addresses: [10.190.52.34/24]\n", "gateway4: 10.190.52.1\n")
+
+	// netplan appends the addresses of the other files
+	for _, uplink := range []string{
+		"network:\n  vlans:\n    bond0.52:\n      addresses: [10.190.52.99/24]\n",
+		"network:\n  vlans:\n    \"bond0.52\":\n      dhcp4: false\n      addresses:\n        - 10.190.52.99/24\n",
+		"network:\n  vlans:\n    bond0.52:\n      gateway4: 10.190.52.1\n",
+	} {
+		ioutil.WriteFile(filepath.Join(root, netplan_dir, "50-cloud-init.yaml"), []byte(uplink), 0644)
+		if _, err := (&netplanRenderer{}).Render(root, testSpec); err == nil {
+			t.Errorf("expected an error for an uplink with addresses:\n%s", uplink)
+		}
+	}
+}
+
+func TestDetectRenderer(t *testing.T) {
+	root, err := ioutil.TempDir("", "skylark-renderer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err = GetRenderer("auto", root); err == nil {
+		t.Error("expected no renderer for an empty root")
+	}
+	os.MkdirAll(filepath.Join(root, network_scripts), 0755)
+	if r, _ := GetRenderer("auto", root); r == nil || r.Name() != "ifcfg" {
+		t.Errorf("expected ifcfg, got %v", r)
+	}
+	os.MkdirAll(filepath.Join(root, "/run/NetworkManager"), 0755)
+	if r, _ := GetRenderer("auto", root); r == nil || r.Name() != "networkmanager" {
+		t.Errorf("expected networkmanager, got %v", r)
+	}
+	if _, err = GetRenderer("wicked", root); err == nil {
+		t.Error("expected an error for an unknown renderer")
+	}
+}
@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// kinds of uplink devices, renderers describe each one differently
+const (
+	UplinkEthernet = "ethernet"
+	UplinkBond     = "bond"
+	UplinkVlan     = "vlan"
+)
+
+// Uplink is the device create-network enslaves to the bridge
+type Uplink struct {
+	Name   string
+	Kind   string
+	Parent string // the parent device of a vlan uplink
+	VlanID int
+	// Exists is false for a vlan sub-interface create-network has to add
+	Exists bool
+}
+
+// detectUplink returns the device carrying the IPv4 default route. When the
+// default route already goes through a bridge, the device enslaved to it is
+// returned so create-network can be run again.
+func detectUplink() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := link.(*netlink.Bridge); !ok {
+			return link.Attrs().Name, nil
+		}
+		return bridgePort(link)
+	}
+	return "", errors.New("no IPv4 default route found, set the uplink with --uplink")
+}
+
+// bridgePort returns the first non veth device enslaved to br
+func bridgePort(br netlink.Link) (string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex != br.Attrs().Index {
+			continue
+		}
+		if _, ok := link.(*netlink.Veth); ok {
+			continue
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", fmt.Errorf("default route goes through bridge %s without uplink, set the uplink with --uplink", br.Attrs().Name)
+}
+
+func linkKind(link netlink.Link) string {
+	switch link.(type) {
+	case *netlink.Bond:
+		return UplinkBond
+	case *netlink.Vlan:
+		return UplinkVlan
+	}
+	return UplinkEthernet
+}
+
+func linkKindByName(name string) string {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return ""
+	}
+	return linkKind(link)
+}
+
+// resolveUplink works out the uplink from the create-network flags. parent
+// is the bond or device given explicitly, detected from the default route
+// when empty. With a vlan id the uplink is the <parent>.<vlan> sub-interface.
+func resolveUplink(parent string, vlan int) (*Uplink, error) {
+	var err error
+	if parent == "" {
+		if parent, err = detectUplink(); err != nil {
+			return nil, err
+		}
+		log.Infof("Detected uplink %s", parent)
+	}
+	parent_link, err := netlink.LinkByName(parent)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup uplink %q: %v", parent, err)
+	}
+	if vlan == 0 {
+		uplink := &Uplink{Name: parent, Kind: linkKind(parent_link), Exists: true}
+		if v, ok := parent_link.(*netlink.Vlan); ok {
+			uplink.VlanID = v.VlanId
+			if p, err := netlink.LinkByIndex(v.ParentIndex); err == nil {
+				uplink.Parent = p.Attrs().Name
+			}
+		}
+		return uplink, nil
+	}
+	if vlan < 1 || vlan > 4094 {
+		return nil, fmt.Errorf("invalid vlan id %d", vlan)
+	}
+	if _, ok := parent_link.(*netlink.Vlan); ok {
+		return nil, fmt.Errorf("uplink %s is already a vlan device", parent)
+	}
+	uplink := &Uplink{Name: fmt.Sprintf("%s.%d", parent, vlan), Kind: UplinkVlan, Parent: parent, VlanID: vlan}
+	if link, err := netlink.LinkByName(uplink.Name); err == nil {
+		v, ok := link.(*netlink.Vlan)
+		if !ok || v.VlanId != vlan || v.ParentIndex != parent_link.Attrs().Index {
+			return nil, fmt.Errorf("%s exists but is not vlan %d on %s", uplink.Name, vlan, parent)
+		}
+		uplink.Exists = true
+	}
+	return uplink, nil
+}
+
+// ensureVlan adds the vlan sub-interface of uplink and brings it up
+func ensureVlan(uplink *Uplink) error {
+	parent, err := netlink.LinkByName(uplink.Parent)
+	if err != nil {
+		return fmt.Errorf("could not lookup %q: %v", uplink.Parent, err)
+	}
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: uplink.Name, ParentIndex: parent.Attrs().Index},
+		VlanId:    uplink.VlanID,
+	}
+	if err = netlink.LinkAdd(vlan); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("could not add vlan %q: %v", uplink.Name, err)
+	}
+	link, err := netlink.LinkByName(uplink.Name)
+	if err != nil {
+		return err
+	}
+	if err = netlink.LinkSetUp(parent); err != nil {
+		return err
+	}
+	log.Infof("Created vlan %s on %s", uplink.Name, uplink.Parent)
+	return netlink.LinkSetUp(link)
+}
+
+func deleteVlan(uplink *Uplink) error {
+	link, err := netlink.LinkByName(uplink.Name)
+	if err != nil {
+		return nil
+	}
+	log.Infof("Deleting vlan %s", uplink.Name)
+	return netlink.LinkDel(link)
+}
@@ -2,14 +2,20 @@ package command
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 
 	"oam-docker-ipam/bridge"
+	"oam-docker-ipam/controller"
 	"oam-docker-ipam/db"
 	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+	"oam-docker-ipam/netpolicy"
 	"oam-docker-ipam/util"
 )
 
@@ -28,8 +34,12 @@ func initialize_log() {
 
 func NewServerCommand() cli.Command {
 	return cli.Command{
-		Name:   "server",
-		Usage:  "start the Docker IPAM plugin",
+		Name:  "server",
+		Usage: "start the Docker IPAM plugin",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "dad-interface", Usage: "probe candidate IPs with arp on this interface (e.g. br0) before handing them out"},
+			cli.IntFlag{Name: "dad-timeout", Value: 1000, Usage: "milliseconds to wait for arp replies to a probe"},
+		},
 		Action: startServerAction,
 	}
 }
@@ -38,9 +48,89 @@ func startServerAction(c *cli.Context) {
 	debug = c.GlobalBool("debug")
 	db.SetDBAddr(c.GlobalString("cluster-store"))
 	initialize_log()
+	ipamdriver.SetDuplicateAddressDetection(c.String("dad-interface"), time.Duration(c.Int("dad-timeout"))*time.Millisecond)
+	go bridge.ReportHosts()
 	ipamdriver.StartServer()
 }
 
+func NewControllerCommand() cli.Command {
+	return cli.Command{
+		Name:  "controller",
+		Usage: "sync the IPPool resources and release the IPs of kubernetes pods that no longer exist, run one per cluster",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "api-server", Usage: "the kubernetes API server url, in-cluster when empty"},
+			cli.StringFlag{Name: "token-file", Usage: "the bearer token file of the API server"},
+			cli.StringFlag{Name: "ca-file", Usage: "the CA certificate file of the API server"},
+			cli.BoolFlag{Name: "insecure", Usage: "do not verify the certificate of the API server"},
+			cli.IntFlag{Name: "resync", Value: int(controller.DefaultResync / time.Second), Usage: "seconds between full collections"},
+			cli.IntFlag{Name: "min-age", Value: int(controller.DefaultMinAge / time.Second), Usage: "seconds an IP is left alone after it was allocated"},
+			cli.IntFlag{Name: "pool-resync", Value: int(controller.DefaultPoolResync / time.Second), Usage: "seconds between IPPool syncs"},
+		},
+		Action: controllerAction,
+	}
+}
+
+func controllerAction(c *cli.Context) {
+	debug = c.GlobalBool("debug")
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	initialize_log()
+	client, err := k8s.NewClient(&k8s.Config{
+		APIServer: c.String("api-server"),
+		TokenFile: c.String("token-file"),
+		CAFile:    c.String("ca-file"),
+		Insecure:  c.Bool("insecure"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	gc := controller.NewGC(client, controller.NewStore())
+	gc.Resync = time.Duration(c.Int("resync")) * time.Second
+	gc.MinAge = time.Duration(c.Int("min-age")) * time.Second
+	ps := controller.NewPoolSync(client, controller.NewPoolStore())
+	ps.Resync = time.Duration(c.Int("pool-resync")) * time.Second
+	stop := make(chan struct{})
+	go ps.Run(stop)
+	gc.Run(stop)
+}
+
+func NewPolicyAgentCommand() cli.Command {
+	return cli.Command{
+		Name:  "policy-agent",
+		Usage: "enforce the kubernetes network policies on the pods of this node, run one per node",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "api-server", Usage: "the kubernetes API server url, in-cluster when empty"},
+			cli.StringFlag{Name: "token-file", Usage: "the bearer token file of the API server"},
+			cli.StringFlag{Name: "ca-file", Usage: "the CA certificate file of the API server"},
+			cli.BoolFlag{Name: "insecure", Usage: "do not verify the certificate of the API server"},
+			cli.StringFlag{Name: "node", Usage: "the hostname the IPs of the pods of this node are assigned under, the hostname when empty"},
+			cli.IntFlag{Name: "resync", Value: int(netpolicy.DefaultResync / time.Second), Usage: "seconds between full syncs"},
+		},
+		Action: policyAgentAction,
+	}
+}
+
+func policyAgentAction(c *cli.Context) {
+	debug = c.GlobalBool("debug")
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	initialize_log()
+	client, err := k8s.NewClient(&k8s.Config{
+		APIServer: c.String("api-server"),
+		TokenFile: c.String("token-file"),
+		CAFile:    c.String("ca-file"),
+		Insecure:  c.Bool("insecure"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	node := c.String("node")
+	if node == "" {
+		node = ipamdriver.GetHostName()
+	}
+	agent := netpolicy.NewAgent(client, netpolicy.NewStore(), netpolicy.NewIPTables(), node)
+	agent.Resync = time.Duration(c.Int("resync")) * time.Second
+	agent.Run(make(chan struct{}))
+}
+
 func NewIPRangeCommand() cli.Command {
 	return cli.Command{
 		Name:  "ip-range",
@@ -48,6 +138,16 @@ func NewIPRangeCommand() cli.Command {
 		Flags: []cli.Flag{
 			cli.StringFlag{Name: "ip-start", Usage: "the first IP for containers in CIDR notation"},
 			cli.StringFlag{Name: "ip-end", Usage: "the last IP for containers in CIDR notation"},
+			cli.StringFlag{Name: "name", Usage: "the pool name pods can ask for with the skylark.io/pool annotation"},
+			cli.StringFlag{Name: "gateway", Usage: "the gateway handed out with the IPs of the pool"},
+			cli.StringSliceFlag{Name: "namespace-selector", Usage: "key=value, the pool serves the pods of namespaces with the label"},
+			cli.StringSliceFlag{Name: "pod-selector", Usage: "key=value, the pool serves the pods with the label"},
+			cli.StringSliceFlag{Name: "node-selector", Usage: "key=value, the pool serves the pods of nodes with the label"},
+			cli.StringSliceFlag{Name: "container-selector", Usage: "key=value, the pool serves the pods of the CNI plugins whose docker infra container has the label"},
+			cli.StringSliceFlag{Name: "route", Usage: "a static route of the pods as dst in CIDR notation, or dst=gw when not through the gateway"},
+			cli.StringSliceFlag{Name: "dns-server", Usage: "a nameserver of the pods"},
+			cli.StringSliceFlag{Name: "dns-search", Usage: "a search domain of the pods"},
+			cli.BoolFlag{Name: "skip-default-route", Usage: "do not give the pods a default route through the pool"},
 		},
 		Action: ipRangeAction,
 	}
@@ -61,7 +161,53 @@ func ipRangeAction(c *cli.Context) {
 		fmt.Println("Invalid args")
 		return
 	}
-	ipamdriver.AllocateIPRange(ip_start, ip_end)
+	config := &ipamdriver.Config{Name: c.String("name"), Gateway: c.String("gateway")}
+	for flag, selector := range map[string]*map[string]string{
+		"namespace-selector": &config.NamespaceSelector,
+		"pod-selector":       &config.PodSelector,
+		"node-selector":      &config.NodeSelector,
+		"container-selector": &config.ContainerSelector,
+	} {
+		labels, err := parseLabels(c.StringSlice(flag))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		*selector = labels
+	}
+	for _, r := range c.StringSlice("route") {
+		pair := strings.SplitN(r, "=", 2)
+		route := ipamdriver.Route{Dst: pair[0]}
+		if len(pair) == 2 {
+			route.Gw = pair[1]
+		}
+		if err := route.Validate(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	if servers, search := c.StringSlice("dns-server"), c.StringSlice("dns-search"); len(servers) != 0 || len(search) != 0 {
+		config.DNS = &ipamdriver.DNS{Nameservers: servers, Search: search}
+	}
+	config.SkipDefaultRoute = c.Bool("skip-default-route")
+	ipamdriver.AllocateIPRange(ip_start, ip_end, config)
+}
+
+// parseLabels parses key=value pairs, nil when there are none
+func parseLabels(pairs []string) (map[string]string, error) {
+	var labels map[string]string
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid label %s", pair)
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
 }
 
 func NewReleaseIPCommand() cli.Command {
@@ -87,12 +233,114 @@ func releaseIPAction(c *cli.Context) {
 	ipamdriver.ReleaseIP(ip_net, ip)
 }
 
+func NewQuarantineCommand() cli.Command {
+	return cli.Command{
+		Name:  "quarantine",
+		Usage: "list the IPs found in use by hosts unknown to skylark",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "ip-net", Usage: "only list the quarantined IPs of this network, e.g. 10.0.2.0"},
+		},
+		Action: quarantineAction,
+	}
+}
+
+func quarantineAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	quarantined, err := ipamdriver.ListQuarantine(c.String("ip-net"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, q := range quarantined {
+		fmt.Printf("%-16s %-18s %-20s %s\n", q.Ip, q.Mac, q.Hostname, q.Time.Format(time.RFC3339))
+	}
+	fmt.Println("Total:", len(quarantined))
+}
+
+func NewReleaseQuarantineCommand() cli.Command {
+	return cli.Command{
+		Name:  "release-quarantine",
+		Usage: "return a quarantined IP to its pool",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "ip", Usage: "the IP to release in CIDR notation"},
+		},
+		Action: releaseQuarantineAction,
+	}
+}
+
+func releaseQuarantineAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip_args := c.String("ip")
+	if ip_args == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	ip_net, _ := util.GetIPNetAndMask(ip_args)
+	ip, _ := util.GetIPAndCIDR(ip_args)
+	if err := ipamdriver.ReleaseQuarantine(ip_net, ip); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func NewRetainedCommand() cli.Command {
+	return cli.Command{
+		Name:  "retained",
+		Usage: "list the IPs kept for StatefulSet pods",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "ip-net", Usage: "only list the retained IPs of this network, e.g. 10.0.2.0"},
+		},
+		Action: retainedAction,
+	}
+}
+
+func retainedAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	retained, err := ipamdriver.ListRetained(c.String("ip-net"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range retained {
+		expires := "in use"
+		if !r.Expires.IsZero() {
+			expires = r.Expires.Format(time.RFC3339)
+		}
+		fmt.Printf("%-16s %-40s %-20s %s\n", r.Ip, r.Pod, r.Hostname, expires)
+	}
+	fmt.Println("Total:", len(retained))
+}
+
+func NewReleaseRetainedCommand() cli.Command {
+	return cli.Command{
+		Name:  "release-retained",
+		Usage: "stop keeping an IP for its StatefulSet pod",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "ip", Usage: "the IP to release in CIDR notation"},
+		},
+		Action: releaseRetainedAction,
+	}
+}
+
+func releaseRetainedAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip_args := c.String("ip")
+	if ip_args == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	ip_net, _ := util.GetIPNetAndMask(ip_args)
+	ip, _ := util.GetIPAndCIDR(ip_args)
+	if err := ipamdriver.ReleaseRetention(ip_net, ip); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func NewReleaseHostCommand() cli.Command {
 	return cli.Command{
 		Name:  "release-host",
 		Usage: "release the specified host",
 		Flags: []cli.Flag{
+			cli.StringFlag{Name: "network", Value: bridge.DefaultNetwork, Usage: "the name of the host network"},
 			cli.StringFlag{Name: "ip", Usage: "the IP to release in CIDR notation"},
+			cli.BoolFlag{Name: "force", Usage: "release the IP even if its host still reports in"},
 		},
 		Action: releaseHostAction,
 	}
@@ -105,7 +353,93 @@ func releaseHostAction(c *cli.Context) {
 		fmt.Println("Invalid args")
 		return
 	}
-	bridge.ReleaseHost(ip)
+	if err := bridge.ReleaseHost(c.String("network"), ip, c.Bool("force")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func NewHostCommand() cli.Command {
+	network_flag := cli.StringFlag{Name: "network", Value: bridge.DefaultNetwork, Usage: "the name of the host network"}
+	ip_flag := cli.StringFlag{Name: "ip", Usage: "the bridge IP of the host"}
+	return cli.Command{
+		Name:  "host",
+		Usage: "inspect the hosts holding bridge IPs of a host network",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list the hosts of the network",
+				Flags:  []cli.Flag{network_flag},
+				Action: hostListAction,
+			},
+			{
+				Name:   "show",
+				Usage:  "show the record of a host",
+				Flags:  []cli.Flag{network_flag, ip_flag},
+				Action: hostShowAction,
+			},
+			{
+				Name:   "drain",
+				Usage:  "stop the host reporting in so its IP can be released",
+				Flags:  []cli.Flag{network_flag, ip_flag},
+				Action: hostDrainAction,
+			},
+		},
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func hostListAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	hosts, err := bridge.ListHosts(c.String("network"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%-16s %-24s %-8s %-10s %-8s %-25s %s\n", "IP", "HOSTNAME", "BRIDGE", "UPLINK", "STATE", "LAST SEEN", "NETWORK ID")
+	for _, host := range hosts {
+		fmt.Printf("%-16s %-24s %-8s %-10s %-8s %-25s %.12s\n", host.IP, host.Hostname, host.Bridge, host.Uplink,
+			host.State(), formatTime(host.LastSeen), host.NetworkID)
+	}
+}
+
+func hostShowAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip := c.String("ip")
+	if ip == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	host, err := bridge.LookupHost(c.String("network"), ip)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("IP:          ", host.IP)
+	fmt.Println("Network:     ", host.Network)
+	fmt.Println("Hostname:    ", host.Hostname)
+	fmt.Println("Machine ID:  ", host.MachineID)
+	fmt.Println("Uplink:      ", host.Uplink)
+	fmt.Println("Bridge:      ", host.Bridge)
+	fmt.Println("Network ID:  ", host.NetworkID)
+	fmt.Println("Allocated at:", formatTime(host.AllocatedAt))
+	fmt.Println("Last seen:   ", formatTime(host.LastSeen))
+	fmt.Println("State:       ", host.State())
+}
+
+func hostDrainAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip := c.String("ip")
+	if ip == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	if err := bridge.DrainHost(c.String("network"), ip); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func NewHostRangeCommand() cli.Command {
@@ -113,9 +447,20 @@ func NewHostRangeCommand() cli.Command {
 		Name:  "host-range",
 		Usage: "set the ip range for hosts",
 		Flags: []cli.Flag{
+			cli.StringFlag{Name: "network", Value: bridge.DefaultNetwork, Usage: "the name of the host network"},
 			cli.StringFlag{Name: "ip-start", Usage: "the first IP for containers in CIDR notation"},
 			cli.StringFlag{Name: "ip-end", Usage: "the last IP for containers in CIDR notation"},
 			cli.StringFlag{Name: "gateway", Usage: "the default gateway for the docker container network"},
+			cli.StringFlag{Name: "bridge", Value: bridge.DefaultBridge, Usage: "the linux bridge the hosts attach to this network"},
+			cli.StringFlag{Name: "docker-network", Usage: "the docker network name, defaults to the network name"},
+			cli.IntFlag{Name: "vlan", Usage: "the vlan id of the network on the host uplinks, 0 when untagged"},
+			cli.StringFlag{Name: "driver", Value: bridge.DriverBridge, Usage: "the docker network driver: bridge, macvlan or ipvlan"},
+			cli.StringFlag{Name: "ipvlan-mode", Usage: "the ipvlan mode when the driver is ipvlan: l2 (default) or l3"},
+			cli.IntFlag{Name: "mtu", Value: bridge.DefaultMTU, Usage: "the MTU of the docker network"},
+			cli.BoolTFlag{Name: "enable-icc", Usage: "allow traffic between containers of the docker network"},
+			cli.BoolFlag{Name: "enable-ip-masquerade", Usage: "masquerade container traffic leaving the docker network"},
+			cli.StringFlag{Name: "host-binding-ipv4", Value: "0.0.0.0", Usage: "the default IP when binding container ports"},
+			cli.StringSliceFlag{Name: "aux-address", Value: &cli.StringSlice{}, Usage: "auxiliary address of the docker network as name=ip, DefaultGatewayIPv4 defaults to the gateway"},
 		},
 		Action: hostRangeAction,
 	}
@@ -131,15 +476,64 @@ func hostRangeAction(c *cli.Context) {
 		fmt.Println("Invalid args")
 		return
 	}
-	bridge.AllocateHostRange(ip_start, ip_end, gateway)
+	aux_addresses := map[string]string{}
+	for _, aux := range c.StringSlice("aux-address") {
+		pair := strings.SplitN(aux, "=", 2)
+		if len(pair) != 2 {
+			fmt.Println("Invalid aux address", aux)
+			return
+		}
+		aux_addresses[pair[0]] = pair[1]
+	}
+	config := &bridge.Config{
+		Name:               c.String("network"),
+		Gateway:            gateway,
+		Bridge:             c.String("bridge"),
+		DockerNetwork:      c.String("docker-network"),
+		Vlan:               c.Int("vlan"),
+		Driver:             c.String("driver"),
+		IpvlanMode:         c.String("ipvlan-mode"),
+		MTU:                c.Int("mtu"),
+		EnableICC:          c.BoolT("enable-icc"),
+		EnableIPMasquerade: c.Bool("enable-ip-masquerade"),
+		HostBindingIPv4:    c.String("host-binding-ipv4"),
+		AuxAddresses:       aux_addresses,
+	}
+	bridge.AllocateHostRange(ip_start, ip_end, config)
+}
+
+func NewHostNetworksCommand() cli.Command {
+	return cli.Command{
+		Name:   "host-networks",
+		Usage:  "list the host networks",
+		Action: hostNetworksAction,
+	}
+}
+
+func hostNetworksAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	configs, err := bridge.ListNetworks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, config := range configs {
+		fmt.Printf("%-16s %-18s %-16s %-8s %-8s %s\n", config.Name, config.Subnet, config.Gateway, config.Driver, config.Bridge, config.DockerNetwork)
+	}
 }
 
 func NewCreateNetworkCommand() cli.Command {
 	return cli.Command{
 		Name:  "create-network",
-		Usage: "create docker network br0",
+		Usage: "create the docker network and bridge of a host network",
 		Flags: []cli.Flag{
+			cli.StringFlag{Name: "network", Value: bridge.DefaultNetwork, Usage: "the name of the host network"},
 			cli.StringFlag{Name: "ip", Usage: "the IP docker bridge use"},
+			cli.StringFlag{Name: "renderer", Value: "auto", Usage: "how to persist the bridge: auto, " + strings.Join(bridge.RendererNames(), ", ")},
+			cli.StringFlag{Name: "config-root", Value: "/", Usage: "write the network configuration files below this directory"},
+			cli.BoolFlag{Name: "dry-run", Usage: "print the planned changes without applying them"},
+			cli.StringFlag{Name: "uplink", Usage: "the device to enslave to the bridge, detected from the default route when empty"},
+			cli.StringFlag{Name: "bond", Usage: "the bond device carrying the vlan, instead of --uplink"},
+			cli.IntFlag{Name: "vlan", Usage: "the vlan id, creates the <uplink>.<vlan> sub-interface if missing. Overrides the network config"},
 		},
 		Action: createNetworkAction,
 	}
@@ -148,5 +542,157 @@ func NewCreateNetworkCommand() cli.Command {
 func createNetworkAction(c *cli.Context) {
 	db.SetDBAddr(c.GlobalString("cluster-store"))
 	ip := c.String("ip")
-	bridge.CreateNetwork(ip)
+	opts := &bridge.CreateOptions{
+		Renderer:   c.String("renderer"),
+		ConfigRoot: c.String("config-root"),
+		DryRun:     c.Bool("dry-run"),
+		Uplink:     c.String("uplink"),
+		Bond:       c.String("bond"),
+		Vlan:       c.Int("vlan"),
+	}
+	if err := bridge.CreateNetwork(c.String("network"), ip, opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func NewFirewallCommand() cli.Command {
+	ip_net_flag := cli.StringFlag{Name: "ip-net", Usage: "the network of the firewall, e.g. 10.0.2.0"}
+	container_flag := cli.StringFlag{Name: "container", Usage: "the full id of the container, the firewall of the whole network when empty"}
+	return cli.Command{
+		Name:  "firewall",
+		Usage: "manage the allow-lists of the containers of a network",
+		Subcommands: []cli.Command{
+			{
+				Name:   "show",
+				Usage:  "show the firewall of the network or of a container",
+				Flags:  []cli.Flag{ip_net_flag, container_flag},
+				Action: firewallShowAction,
+			},
+			{
+				Name:  "set",
+				Usage: "replace the firewall of the network or of a container",
+				Flags: []cli.Flag{ip_net_flag, container_flag,
+					cli.StringSliceFlag{Name: "allow-in", Usage: "proto[/ports][@cidr] the containers accept, e.g. tcp/80,443@10.0.0.0/8, any for every protocol"},
+					cli.StringSliceFlag{Name: "allow-out", Usage: "proto[/ports][@cidr] the containers may send, e.g. udp/53"},
+				},
+				Action: firewallSetAction,
+			},
+			{
+				Name:   "delete",
+				Usage:  "remove the firewall of the network or of a container",
+				Flags:  []cli.Flag{ip_net_flag, container_flag},
+				Action: firewallDeleteAction,
+			},
+		},
+	}
+}
+
+// parseFirewallRule parses proto[/ports][@cidr], the ports comma separated
+func parseFirewallRule(s string) (ipamdriver.FirewallRule, error) {
+	r := ipamdriver.FirewallRule{}
+	spec := s
+	if i := strings.Index(s, "@"); i >= 0 {
+		r.CIDR, spec = s[i+1:], s[:i]
+	}
+	pair := strings.SplitN(spec, "/", 2)
+	if pair[0] != "any" {
+		r.Protocol = pair[0]
+	}
+	if len(pair) == 2 {
+		r.Ports = strings.Split(pair[1], ",")
+	}
+	if err := r.Validate(); err != nil {
+		return r, fmt.Errorf("Invalid rule %s: %v", s, err)
+	}
+	return r, nil
+}
+
+func formatFirewallRule(r ipamdriver.FirewallRule) string {
+	s := r.Protocol
+	if s == "" {
+		s = "any"
+	}
+	if len(r.Ports) != 0 {
+		s += "/" + strings.Join(r.Ports, ",")
+	}
+	if r.CIDR != "" {
+		s += "@" + r.CIDR
+	}
+	return s
+}
+
+func firewallShowAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip_net := c.String("ip-net")
+	if ip_net == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	fw := ipamdriver.GetFirewall(ip_net, c.String("container"))
+	for _, r := range fw.Ingress {
+		fmt.Println("allow-in  ", formatFirewallRule(r))
+	}
+	for _, r := range fw.Egress {
+		fmt.Println("allow-out ", formatFirewallRule(r))
+	}
+}
+
+func firewallSetAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip_net := c.String("ip-net")
+	if ip_net == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	fw := &ipamdriver.Firewall{}
+	for flag, rules := range map[string]*[]ipamdriver.FirewallRule{"allow-in": &fw.Ingress, "allow-out": &fw.Egress} {
+		for _, s := range c.StringSlice(flag) {
+			r, err := parseFirewallRule(s)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			*rules = append(*rules, r)
+		}
+	}
+	network, err := bypassingNetwork(ip_net)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if network != nil && len(fw.Ingress)+len(fw.Egress) != 0 {
+		fmt.Printf("The containers of %s are on the %s network %s, their traffic bypasses the firewall of the host\n", ip_net, network.Driver, network.Name)
+		return
+	}
+	if err := ipamdriver.SetFirewall(ip_net, c.String("container"), fw); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// bypassingNetwork returns the macvlan or ipvlan host network ip_net is on,
+// nil when there is none
+func bypassingNetwork(ip_net string) (*bridge.Config, error) {
+	networks, err := bridge.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(ip_net)
+	for _, network := range networks {
+		_, subnet, err := net.ParseCIDR(network.Subnet)
+		if err == nil && network.Driver != bridge.DriverBridge && subnet.Contains(ip) {
+			return network, nil
+		}
+	}
+	return nil, nil
+}
+
+func firewallDeleteAction(c *cli.Context) {
+	db.SetDBAddr(c.GlobalString("cluster-store"))
+	ip_net := c.String("ip-net")
+	if ip_net == "" {
+		fmt.Println("Invalid args")
+		return
+	}
+	if err := ipamdriver.DeleteFirewall(ip_net, c.String("container")); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,181 @@
+// Package controller runs the cluster wide loops of skylark against the
+// kubernetes API.
+package controller
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+)
+
+const (
+	DefaultResync = 5 * time.Minute
+	DefaultMinAge = 2 * time.Minute
+	// watch_retry is the pause before watching again after an error
+	watch_retry = 5 * time.Second
+)
+
+// Store holds the IPs of the pods
+type Store interface {
+	ListEndpoints() ([]*ipamdriver.Endpoint, error)
+	ReleaseEndpoint(e *ipamdriver.Endpoint) error
+}
+
+type etcdStore struct{}
+
+func (etcdStore) ListEndpoints() ([]*ipamdriver.Endpoint, error) {
+	return ipamdriver.ListEndpoints()
+}
+
+func (etcdStore) ReleaseEndpoint(e *ipamdriver.Endpoint) error {
+	return ipamdriver.ReleaseEndpoint(e)
+}
+
+// NewStore returns the store of the skylark etcd cluster
+func NewStore() Store {
+	return etcdStore{}
+}
+
+// GC releases the IPs of pods that no longer exist, e.g. when the kubelet
+// never called DEL because its node crashed or the pod was force deleted
+type GC struct {
+	client k8s.Interface
+	store  Store
+	// Resync is the interval of full collections, deleted pods are released
+	// as soon as their watch event arrives
+	Resync time.Duration
+	// MinAge spares younger endpoints, the pod list may lag behind ADD
+	MinAge time.Duration
+	now    func() time.Time
+}
+
+func NewGC(client k8s.Interface, store Store) *GC {
+	return &GC{
+		client: client,
+		store:  store,
+		Resync: DefaultResync,
+		MinAge: DefaultMinAge,
+		now:    time.Now,
+	}
+}
+
+// Collect releases the endpoints of all pods that are gone and returns how
+// many it released. Endpoints are listed before the pods, so a pod created
+// meanwhile is listed too.
+func (gc *GC) Collect() (int, error) {
+	endpoints, err := gc.store.ListEndpoints()
+	if err != nil {
+		return 0, err
+	}
+	pods, err := gc.client.ListPods()
+	if err != nil {
+		return 0, err
+	}
+	uids := map[string]string{}
+	for _, pod := range pods.Items {
+		uids[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod.Metadata.UID
+	}
+	released := 0
+	for _, e := range endpoints {
+		if e.Pod == "" {
+			// docker containers and records of older versions
+			continue
+		}
+		if gc.now().Sub(e.Time) < gc.MinAge {
+			continue
+		}
+		if uid, ok := uids[e.Pod]; ok && sameUID(uid, e.PodUID) {
+			continue
+		}
+		if gc.release(e) {
+			released++
+		}
+	}
+	return released, nil
+}
+
+// podDeleted releases the endpoints of a deleted pod. A pod recreated under
+// the same name keeps its endpoints when the UIDs are not known.
+func (gc *GC) podDeleted(pod *k8s.Pod) {
+	name := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	endpoints, err := gc.store.ListEndpoints()
+	if err != nil {
+		log.Errorf("Failed to list endpoints: %v", err)
+		return
+	}
+	for _, e := range endpoints {
+		if e.Pod != name {
+			continue
+		}
+		if e.PodUID == "" || pod.Metadata.UID == "" {
+			if _, err := gc.client.GetPod(pod.Metadata.Namespace, pod.Metadata.Name); err != k8s.ErrNotFound {
+				continue
+			}
+		} else if e.PodUID != pod.Metadata.UID {
+			continue
+		}
+		gc.release(e)
+	}
+}
+
+func (gc *GC) release(e *ipamdriver.Endpoint) bool {
+	if err := gc.store.ReleaseEndpoint(e); err != nil {
+		log.Errorf("Failed to release IP %s of %s: %v", e.Ip, e.Pod, err)
+		return false
+	}
+	log.Infof("Released IP %s of %s, the pod is gone", e.Ip, e.Pod)
+	return true
+}
+
+// sameUID tells whether two pod UIDs may be the same pod
+func sameUID(a, b string) bool {
+	return a == "" || b == "" || a == b
+}
+
+// Run collects every Resync and on pod deletion until stop is closed
+func (gc *GC) Run(stop <-chan struct{}) {
+	go gc.watch(stop)
+	ticker := time.NewTicker(gc.Resync)
+	defer ticker.Stop()
+	for {
+		if released, err := gc.Collect(); err != nil {
+			log.Errorf("Failed to collect pod IPs: %v", err)
+		} else {
+			log.Infof("Collected %d pod IPs", released)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (gc *GC) watch(stop <-chan struct{}) {
+	for {
+		events, err := gc.client.WatchPods("", stop)
+		if err != nil {
+			log.Errorf("Failed to watch pods: %v", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(watch_retry):
+			}
+			continue
+		}
+		// the channel closes when the server ends the watch
+		for event := range events {
+			if event.Type == k8s.Deleted {
+				gc.podDeleted(&event.Object)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+)
+
+type fakeStore struct {
+	mu        sync.Mutex
+	endpoints map[string]*ipamdriver.Endpoint
+}
+
+func (s *fakeStore) ListEndpoints() ([]*ipamdriver.Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var endpoints []*ipamdriver.Endpoint
+	for _, e := range s.endpoints {
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+func (s *fakeStore) ReleaseEndpoint(e *ipamdriver.Endpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.endpoints, e.ContainerID)
+	return nil
+}
+
+func (s *fakeStore) containers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.endpoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+var now = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestGC() (*GC, *k8s.FakeClient, *fakeStore) {
+	client := k8s.NewFakeClient()
+	client.AddPod(&k8s.Pod{Metadata: k8s.ObjectMeta{Name: "web-1", Namespace: "default", UID: "u1"}})
+	client.AddPod(&k8s.Pod{Metadata: k8s.ObjectMeta{Name: "mysql-0", Namespace: "db", UID: "u3"}})
+	old := now.Add(-time.Hour)
+	store := &fakeStore{endpoints: map[string]*ipamdriver.Endpoint{}}
+	for _, e := range []*ipamdriver.Endpoint{
+		{ContainerID: "live", Ip: "10.0.2.101", Pod: "default/web-1", PodUID: "u1", Time: old},
+		{ContainerID: "gone", Ip: "10.0.2.102", Pod: "default/web-2", PodUID: "u2", Time: old},
+		{ContainerID: "young", Ip: "10.0.2.103", Pod: "default/web-3", Time: now.Add(-time.Second)},
+		{ContainerID: "legacy", Ip: "10.0.2.104"},
+		{ContainerID: "recreated", Ip: "10.0.2.105", Pod: "db/mysql-0", PodUID: "u0", Time: old},
+		{ContainerID: "no-uid", Ip: "10.0.2.106", Pod: "db/mysql-0", Time: old},
+	} {
+		store.endpoints[e.ContainerID] = e
+	}
+	gc := NewGC(client, store)
+	gc.now = func() time.Time { return now }
+	return gc, client, store
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCollect(t *testing.T) {
+	gc, _, store := newTestGC()
+	released, err := gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 2 {
+		t.Errorf("released %d endpoints, want 2", released)
+	}
+	want := []string{"legacy", "live", "no-uid", "young"}
+	if got := store.containers(); !equal(got, want) {
+		t.Errorf("got endpoints %v, want %v", got, want)
+	}
+}
+
+func TestReleaseDeletedPod(t *testing.T) {
+	gc, client, store := newTestGC()
+	stop := make(chan struct{})
+	defer close(stop)
+	go gc.watch(stop)
+	if !client.WaitForWatches(1, 2*time.Second) {
+		t.Fatal("the watch did not start")
+	}
+
+	client.DeletePod("default", "web-1")
+	client.DeletePod("db", "mysql-0")
+	want := []string{"gone", "legacy", "recreated", "young"}
+	deadline := time.Now().Add(2 * time.Second)
+	for !equal(store.containers(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got endpoints %v, want %v", store.containers(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,336 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+	"oam-docker-ipam/util"
+)
+
+const DefaultPoolResync = 30 * time.Second
+
+// PoolStore holds the pools
+type PoolStore interface {
+	ListPools() ([]*ipamdriver.Config, error)
+	SyncPool(config *ipamdriver.Config, ips []string) error
+	PoolUsage(ip_net string) (*ipamdriver.Usage, error)
+	DeletePool(ip_net string) error
+}
+
+func (etcdStore) ListPools() ([]*ipamdriver.Config, error) {
+	return ipamdriver.ListPools()
+}
+
+func (etcdStore) SyncPool(config *ipamdriver.Config, ips []string) error {
+	return ipamdriver.SyncPool(config, ips)
+}
+
+func (etcdStore) PoolUsage(ip_net string) (*ipamdriver.Usage, error) {
+	return ipamdriver.PoolUsage(ip_net)
+}
+
+func (etcdStore) DeletePool(ip_net string) error {
+	return ipamdriver.DeletePool(ip_net)
+}
+
+// NewPoolStore returns the pools of the skylark etcd cluster
+func NewPoolStore() PoolStore {
+	return etcdStore{}
+}
+
+// PoolSync writes the IPPool resources to the store and reports their usage
+// in their status. Pools of deleted resources, or left by a resource for
+// another cidr, are drained and removed once none of their addresses is
+// assigned.
+type PoolSync struct {
+	client k8s.Interface
+	store  PoolStore
+	Resync time.Duration
+	now    func() time.Time
+}
+
+func NewPoolSync(client k8s.Interface, store PoolStore) *PoolSync {
+	return &PoolSync{
+		client: client,
+		store:  store,
+		Resync: DefaultPoolResync,
+		now:    time.Now,
+	}
+}
+
+// poolConfig returns the store config and the addresses of pool
+func poolConfig(pool *k8s.IPPool) (*ipamdriver.Config, []string, error) {
+	spec := &pool.Spec
+	_, subnet, err := net.ParseCIDR(spec.CIDR)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid cidr %q", spec.CIDR)
+	}
+	ones, _ := subnet.Mask.Size()
+	if ones > 30 {
+		return nil, nil, fmt.Errorf("cidr %s has no room for hosts", spec.CIDR)
+	}
+	start, end := nextIP(subnet.IP), lastHostIP(subnet)
+	if spec.RangeStart != "" {
+		if start = net.ParseIP(spec.RangeStart).To4(); start == nil || !subnet.Contains(start) {
+			return nil, nil, fmt.Errorf("rangeStart %q is not in %s", spec.RangeStart, spec.CIDR)
+		}
+	}
+	if spec.RangeEnd != "" {
+		if end = net.ParseIP(spec.RangeEnd).To4(); end == nil || !subnet.Contains(end) {
+			return nil, nil, fmt.Errorf("rangeEnd %q is not in %s", spec.RangeEnd, spec.CIDR)
+		}
+	}
+	if compareIP(start, end) > 0 {
+		return nil, nil, errors.New("rangeStart is after rangeEnd")
+	}
+	if spec.Gateway != "" {
+		if gw := net.ParseIP(spec.Gateway); gw == nil || !subnet.Contains(gw) {
+			return nil, nil, fmt.Errorf("gateway %q is not in %s", spec.Gateway, spec.CIDR)
+		}
+	}
+
+	config := &ipamdriver.Config{
+		Ipnet:            subnet.IP.String(),
+		Mask:             fmt.Sprintf("%d", ones),
+		Name:             pool.Metadata.Name,
+		Gateway:          spec.Gateway,
+		Source:           ipamdriver.SourceIPPool,
+		SkipDefaultRoute: spec.SkipDefaultRoute,
+	}
+	for _, r := range spec.Routes {
+		route := ipamdriver.Route{Dst: r.Dst, Gw: r.Gateway}
+		if err := route.Validate(); err != nil {
+			return nil, nil, err
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	if dns := spec.DNS; dns != nil {
+		config.DNS = &ipamdriver.DNS{Nameservers: dns.Nameservers, Domain: dns.Domain, Search: dns.Search, Options: dns.Options}
+	}
+	for name, selector := range map[string]struct {
+		spec   *k8s.LabelSelector
+		config *map[string]string
+	}{
+		"namespaceSelector": {spec.NamespaceSelector, &config.NamespaceSelector},
+		"podSelector":       {spec.PodSelector, &config.PodSelector},
+		"nodeSelector":      {spec.NodeSelector, &config.NodeSelector},
+		"containerSelector": {spec.ContainerSelector, &config.ContainerSelector},
+	} {
+		if selector.spec == nil {
+			continue
+		}
+		// the store only keeps labels
+		if len(selector.spec.MatchExpressions) != 0 {
+			return nil, nil, fmt.Errorf("%s: matchExpressions are not supported by pools", name)
+		}
+		*selector.config = selector.spec.MatchLabels
+	}
+	if spec.Bandwidth != nil {
+		if config.IngressBandwidth, err = k8s.ParseBandwidth(spec.Bandwidth.Ingress); err != nil {
+			return nil, nil, fmt.Errorf("invalid ingress bandwidth: %v", err)
+		}
+		if config.EgressBandwidth, err = k8s.ParseBandwidth(spec.Bandwidth.Egress); err != nil {
+			return nil, nil, fmt.Errorf("invalid egress bandwidth: %v", err)
+		}
+	}
+
+	var ips []string
+	for _, ip := range util.GetIPRange(fmt.Sprintf("%s/%d", start, ones), fmt.Sprintf("%s/%d", end, ones)) {
+		if ip != spec.Gateway {
+			ips = append(ips, ip)
+		}
+	}
+	return config, ips, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, net.IPv4len)
+	copy(next, ip.To4())
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// lastHostIP returns the address before the broadcast address of subnet
+func lastHostIP(subnet *net.IPNet) net.IP {
+	last := make(net.IP, net.IPv4len)
+	ip := subnet.IP.To4()
+	for i := range last {
+		last[i] = ip[i] | ^subnet.Mask[i]
+	}
+	last[3]--
+	return last
+}
+
+func compareIP(a, b net.IP) int {
+	a, b = a.To4(), b.To4()
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Sync syncs all IPPools once. When the resources can not be listed no pool
+// is removed.
+func (ps *PoolSync) Sync() error {
+	pools, err := ps.client.ListIPPools()
+	if err == k8s.ErrNotFound {
+		log.Debugf("The IPPool resource is not installed")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// of IPPools with overlapping cidrs the oldest is synced
+	ordered := make([]*k8s.IPPool, len(pools.Items))
+	for i := range pools.Items {
+		ordered[i] = &pools.Items[i]
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := &ordered[i].Metadata, &ordered[j].Metadata
+		if a.CreationTimestamp != b.CreationTimestamp {
+			return a.CreationTimestamp < b.CreationTimestamp
+		}
+		return a.Name < b.Name
+	})
+	// the network of each resource
+	synced := map[string]string{}
+	// the pool of a resource whose spec turned invalid is kept
+	invalid := map[string]bool{}
+	configs, err := ps.store.ListPools()
+	if err != nil {
+		return err
+	}
+	var claimed []*ipamdriver.Config
+	for _, pool := range ordered {
+		ip_net, status := ps.syncPool(pool, &claimed, configs)
+		if ip_net != "" {
+			synced[pool.Metadata.Name] = ip_net
+		} else {
+			invalid[pool.Metadata.Name] = true
+		}
+		if status != pool.Status {
+			pool.Status = status
+			if _, err := ps.client.UpdateIPPoolStatus(pool); err != nil {
+				log.Errorf("Failed to update the status of IPPool %s: %v", pool.Metadata.Name, err)
+			}
+		}
+	}
+
+	for _, config := range configs {
+		if config.Source != ipamdriver.SourceIPPool || synced[config.Name] == config.Ipnet || invalid[config.Name] {
+			continue
+		}
+		if err := ps.store.DeletePool(config.Ipnet); err != nil {
+			log.Warnf("Draining pool %s of IPPool %s: %v", config.Ipnet, config.Name, err)
+			continue
+		}
+		log.Infof("Deleted pool %s of IPPool %s", config.Ipnet, config.Name)
+	}
+	return nil
+}
+
+// overlapping returns the config of claimed whose subnet overlaps the one of
+// config, nil when none does
+func overlapping(config *ipamdriver.Config, claimed []*ipamdriver.Config) *ipamdriver.Config {
+	_, subnet, err := net.ParseCIDR(config.Ipnet + "/" + config.Mask)
+	if err != nil {
+		return nil
+	}
+	for _, other := range claimed {
+		_, other_subnet, err := net.ParseCIDR(other.Ipnet + "/" + other.Mask)
+		if err != nil {
+			continue
+		}
+		if subnet.Contains(other_subnet.IP) || other_subnet.Contains(subnet.IP) {
+			return other
+		}
+	}
+	return nil
+}
+
+// otherPools returns the pools of configs not synced from the IPPool name:
+// the pools created with ip-range and the pools of other IPPools, also of
+// deleted ones that still drain
+func otherPools(configs []*ipamdriver.Config, name string) []*ipamdriver.Config {
+	var others []*ipamdriver.Config
+	for _, config := range configs {
+		if config.Source == ipamdriver.SourceIPPool && config.Name == name {
+			continue
+		}
+		others = append(others, config)
+	}
+	return others
+}
+
+// syncPool returns the network of pool, empty when the spec is invalid or
+// overlaps a pool of claimed or another pool of the store, and its new status
+func (ps *PoolSync) syncPool(pool *k8s.IPPool, claimed *[]*ipamdriver.Config, stored []*ipamdriver.Config) (string, k8s.IPPoolStatus) {
+	status := k8s.IPPoolStatus{LastUpdateTime: pool.Status.LastUpdateTime}
+	config, ips, err := poolConfig(pool)
+	if err == nil {
+		if other := overlapping(config, *claimed); other != nil {
+			err = fmt.Errorf("cidr %s overlaps %s/%s of IPPool %s", pool.Spec.CIDR, other.Ipnet, other.Mask, other.Name)
+		} else if other := overlapping(config, otherPools(stored, pool.Metadata.Name)); other != nil {
+			err = fmt.Errorf("cidr %s overlaps pool %s/%s", pool.Spec.CIDR, other.Ipnet, other.Mask)
+			if other.Source == ipamdriver.SourceIPPool {
+				err = fmt.Errorf("%v of IPPool %s", err, other.Name)
+			}
+		}
+	}
+	if err != nil {
+		status.Message = err.Error()
+		return "", status
+	}
+	*claimed = append(*claimed, config)
+	status.Total = len(ips)
+	if err = ps.store.SyncPool(config, ips); err != nil {
+		status.Message = err.Error()
+		return config.Ipnet, status
+	}
+	usage, err := ps.store.PoolUsage(config.Ipnet)
+	if err != nil {
+		status.Message = err.Error()
+		return config.Ipnet, status
+	}
+	status.Synced = true
+	status.Allocated = usage.Assigned
+	status.Free = usage.Free
+	if pool.Status.Synced != status.Synced || pool.Status.Allocated != status.Allocated ||
+		pool.Status.Free != status.Free || pool.Status.Total != status.Total {
+		status.LastUpdateTime = ps.now().UTC().Format(time.RFC3339)
+	}
+	return config.Ipnet, status
+}
+
+// Run syncs every Resync until stop is closed
+func (ps *PoolSync) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ps.Resync)
+	defer ticker.Stop()
+	for {
+		if err := ps.Sync(); err != nil {
+			log.Errorf("Failed to sync IPPools: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+)
+
+type fakePoolStore struct {
+	pools    map[string]*ipamdriver.Config
+	ips      map[string][]string
+	assigned map[string]int
+}
+
+func (s *fakePoolStore) ListPools() ([]*ipamdriver.Config, error) {
+	var configs []*ipamdriver.Config
+	for _, config := range s.pools {
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (s *fakePoolStore) SyncPool(config *ipamdriver.Config, ips []string) error {
+	if existing, ok := s.pools[config.Ipnet]; ok && (existing.Source != config.Source || existing.Name != config.Name) {
+		return fmt.Errorf("network %s belongs to %s", config.Ipnet, existing.Name)
+	}
+	s.pools[config.Ipnet] = config
+	s.ips[config.Ipnet] = ips
+	return nil
+}
+
+func (s *fakePoolStore) PoolUsage(ip_net string) (*ipamdriver.Usage, error) {
+	assigned := s.assigned[ip_net]
+	return &ipamdriver.Usage{Assigned: assigned, Free: len(s.ips[ip_net]) - assigned}, nil
+}
+
+func (s *fakePoolStore) DeletePool(ip_net string) error {
+	if s.assigned[ip_net] != 0 {
+		s.pools[ip_net].Draining = true
+		return errors.New("assigned")
+	}
+	delete(s.pools, ip_net)
+	return nil
+}
+
+func TestPoolConfig(t *testing.T) {
+	pool := &k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "storage"},
+		Spec: k8s.IPPoolSpec{
+			CIDR:              "10.0.3.0/29",
+			Gateway:           "10.0.3.1",
+			NamespaceSelector: &k8s.LabelSelector{MatchLabels: map[string]string{"team": "db"}},
+			PodSelector:       &k8s.LabelSelector{MatchLabels: map[string]string{"app": "mysql"}},
+			Bandwidth:         &k8s.Bandwidth{Egress: "10M"},
+			Routes:            []k8s.Route{{Dst: "10.9.0.0/16"}, {Dst: "10.8.0.0/16", Gateway: "10.0.3.6"}},
+			DNS:               &k8s.DNS{Nameservers: []string{"10.0.0.2"}, Search: []string{"db.svc"}},
+			SkipDefaultRoute:  true,
+		},
+	}
+	config, ips, err := poolConfig(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ipamdriver.Config{
+		Ipnet:             "10.0.3.0",
+		Mask:              "29",
+		Name:              "storage",
+		Gateway:           "10.0.3.1",
+		Source:            ipamdriver.SourceIPPool,
+		NamespaceSelector: map[string]string{"team": "db"},
+		PodSelector:       map[string]string{"app": "mysql"},
+		EgressBandwidth:   10e6,
+		Routes:            []ipamdriver.Route{{Dst: "10.9.0.0/16"}, {Dst: "10.8.0.0/16", Gw: "10.0.3.6"}},
+		DNS:               &ipamdriver.DNS{Nameservers: []string{"10.0.0.2"}, Search: []string{"db.svc"}},
+		SkipDefaultRoute:  true,
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("got config %+v, want %+v", config, want)
+	}
+	wantIPs := []string{"10.0.3.2", "10.0.3.3", "10.0.3.4", "10.0.3.5", "10.0.3.6"}
+	if !reflect.DeepEqual(ips, wantIPs) {
+		t.Errorf("got ips %v, want %v", ips, wantIPs)
+	}
+
+	for _, spec := range []k8s.IPPoolSpec{
+		{CIDR: "10.0.3.0"},
+		{CIDR: "10.0.3.0/31"},
+		{CIDR: "10.0.3.0/24", RangeStart: "10.0.4.1"},
+		{CIDR: "10.0.3.0/24", RangeStart: "10.0.3.100", RangeEnd: "10.0.3.10"},
+		{CIDR: "10.0.3.0/24", Gateway: "10.0.2.1"},
+		{CIDR: "10.0.3.0/24", Bandwidth: &k8s.Bandwidth{Ingress: "fast"}},
+		{CIDR: "10.0.3.0/24", Routes: []k8s.Route{{Dst: "10.9.0.0"}}},
+		{CIDR: "10.0.3.0/24", PodSelector: &k8s.LabelSelector{MatchExpressions: []k8s.LabelSelectorRequirement{{Key: "app", Operator: "Exists"}}}},
+	} {
+		if _, _, err := poolConfig(&k8s.IPPool{Spec: spec}); err == nil {
+			t.Errorf("%+v: expected an error", spec)
+		}
+	}
+}
+
+func TestPoolSync(t *testing.T) {
+	client := k8s.NewFakeClient()
+	client.AddIPPool(&k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "web", CreationTimestamp: "2017-06-01T00:00:00Z"},
+		Spec:     k8s.IPPoolSpec{CIDR: "10.0.2.0/24", RangeStart: "10.0.2.10", RangeEnd: "10.0.2.19", Gateway: "10.0.2.15"},
+	})
+	client.AddIPPool(&k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "broken"},
+		Spec:     k8s.IPPoolSpec{CIDR: "10.0.5.0/33"},
+	})
+	// overlaps web, which is older
+	client.AddIPPool(&k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "a-web-half", CreationTimestamp: "2017-06-02T00:00:00Z"},
+		Spec:     k8s.IPPoolSpec{CIDR: "10.0.2.128/25"},
+	})
+	// the network of the ip-range pool and of busy are taken
+	client.AddIPPool(&k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "takeover"},
+		Spec:     k8s.IPPoolSpec{CIDR: "10.0.8.0/24"},
+	})
+	client.AddIPPool(&k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "busy-again"},
+		Spec:     k8s.IPPoolSpec{CIDR: "10.0.7.0/24"},
+	})
+	// inside the ip-range pool 10.0.9.0/24
+	client.AddIPPool(&k8s.IPPool{
+		Metadata: k8s.ObjectMeta{Name: "inside-range"},
+		Spec:     k8s.IPPoolSpec{CIDR: "10.0.9.64/26"},
+	})
+	store := &fakePoolStore{
+		pools: map[string]*ipamdriver.Config{
+			// the spec of broken was valid before
+			"10.0.5.0": {Ipnet: "10.0.5.0", Mask: "24", Name: "broken", Source: ipamdriver.SourceIPPool},
+			// deleted IPPools
+			"10.0.6.0": {Ipnet: "10.0.6.0", Mask: "24", Name: "gone", Source: ipamdriver.SourceIPPool},
+			"10.0.7.0": {Ipnet: "10.0.7.0", Mask: "24", Name: "busy", Source: ipamdriver.SourceIPPool},
+			// created with ip-range
+			"10.0.8.0": {Ipnet: "10.0.8.0", Mask: "24"},
+			"10.0.9.0": {Ipnet: "10.0.9.0", Mask: "24"},
+		},
+		ips:      map[string][]string{},
+		assigned: map[string]int{"10.0.2.0": 3, "10.0.7.0": 1},
+	}
+	ps := NewPoolSync(client, store)
+	ps.now = func() time.Time { return now }
+	if err := ps.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.ips["10.0.2.0"]) != 9 {
+		t.Errorf("got ips %v, want 10.0.2.10-19 without the gateway", store.ips["10.0.2.0"])
+	}
+	var left []string
+	for _, ip_net := range []string{"10.0.2.0", "10.0.5.0", "10.0.6.0", "10.0.7.0", "10.0.8.0", "10.0.9.64"} {
+		if _, ok := store.pools[ip_net]; ok {
+			left = append(left, ip_net)
+		}
+	}
+	if want := []string{"10.0.2.0", "10.0.5.0", "10.0.7.0", "10.0.8.0"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("got pools %v, want %v", left, want)
+	}
+
+	web, _ := client.GetIPPool("web")
+	want := k8s.IPPoolStatus{Synced: true, Total: 9, Allocated: 3, Free: 6, LastUpdateTime: "2017-06-01T12:00:00Z"}
+	if web.Status != want {
+		t.Errorf("got status %+v, want %+v", web.Status, want)
+	}
+	for _, name := range []string{"broken", "a-web-half", "takeover", "busy-again", "inside-range"} {
+		pool, _ := client.GetIPPool(name)
+		if pool.Status.Synced || pool.Status.Message == "" {
+			t.Errorf("got status %+v of %s, want an error", pool.Status, name)
+		}
+	}
+	if config := store.pools["10.0.8.0"]; config.Source != "" || config.Name != "" {
+		t.Errorf("the ip-range pool was taken over: %+v", config)
+	}
+	if busy := store.pools["10.0.7.0"]; busy.Name != "busy" || !busy.Draining {
+		t.Errorf("got %+v, want the pool of the deleted IPPool busy draining", busy)
+	}
+
+	// an unchanged pool keeps its update time
+	ps.now = func() time.Time { return now.Add(time.Hour) }
+	if err := ps.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if web, _ = client.GetIPPool("web"); web.Status != want {
+		t.Errorf("got status %+v, want %+v", web.Status, want)
+	}
+}
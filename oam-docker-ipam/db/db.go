@@ -43,15 +43,25 @@ func GetKeys(dir string) (client.Nodes, error) {
 }
 
 func IsKeyExist(key string) bool {
+	exist, err := KeyExists(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return exist
+}
+
+// KeyExists reports whether key is in the store. Unlike IsKeyExist it
+// returns the errors of the store, for the paths the CNI plugins run.
+func KeyExists(key string) (bool, error) {
 	cli := newClient()
 	kapi := client.NewKeysAPI(cli)
 	_, err := kapi.Get(context.Background(), key, nil)
-	if client.IsKeyNotFound(err) == true {
-		return false
+	if client.IsKeyNotFound(err) {
+		return false, nil
 	} else if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	return true
+	return true, nil
 }
 
 func SetKey(key, value string) error {
@@ -67,6 +77,38 @@ func SetKey(key, value string) error {
 	return err
 }
 
+// GetKeyIndex returns the value of key and the index to compare it against
+// in CompareAndSwapKey
+func GetKeyIndex(key string) (string, uint64, error) {
+	cli := newClient()
+	kapi := client.NewKeysAPI(cli)
+	resp, err := kapi.Get(context.Background(), key, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	return resp.Node.Value, resp.Node.ModifiedIndex, nil
+}
+
+// CompareAndSwapKey sets key only if it was not modified since index, it
+// fails with an error IsCompareFailed reports otherwise
+func CompareAndSwapKey(key, value string, index uint64) error {
+	cli := newClient()
+	kapi := client.NewKeysAPI(cli)
+	resp, err := kapi.Set(context.Background(), key, value, &client.SetOptions{PrevIndex: index})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Set key %s with value %s", resp.Node.Key, resp.Node.Value)
+	return nil
+}
+
+// IsCompareFailed tells whether a compare and swap failed because the key
+// changed
+func IsCompareFailed(err error) bool {
+	e, ok := err.(client.Error)
+	return ok && e.Code == client.ErrorCodeTestFailed
+}
+
 func SetKeyTTL(key, value string, ttl int) error {
 	cli := newClient()
 	kapi := client.NewKeysAPI(cli)
@@ -75,7 +117,7 @@ func SetKeyTTL(key, value string, ttl int) error {
 		log.Error(err)
 		return err
 	} else {
-		log.Debugf("Set key %s with value %s", resp.Node.Key, resp.Node.Value, resp.Node.TTL)
+		log.Debugf("Set key %s with value %s ttl %d", resp.Node.Key, resp.Node.Value, resp.Node.TTL)
 	}
 	return err
 }
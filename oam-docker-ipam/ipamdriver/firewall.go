@@ -0,0 +1,558 @@
+package ipamdriver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/docker/engine-api/client"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"oam-docker-ipam/db"
+)
+
+// firewallChain is the filter chain jumped to from FORWARD, it jumps to the
+// chains of the host veths with allow-lists
+const firewallChain = "SKYLARK-FIREWALL"
+
+// firewall_resync is how often the server syncs the firewall without a
+// change in the store, it catches containers started after their address
+// was assigned
+const firewall_resync = 30 * time.Second
+
+var firewall_sync = make(chan struct{}, 1)
+
+// FirewallRule allows the traffic of a container from (ingress) or to
+// (egress) CIDR, any address when empty. Protocol is tcp, udp, sctp or
+// icmp, any when empty. Ports are ports or ranges like 8000:8100 of a tcp,
+// udp or sctp rule.
+type FirewallRule struct {
+	CIDR     string   `json:",omitempty"`
+	Protocol string   `json:",omitempty"`
+	Ports    []string `json:",omitempty"`
+}
+
+func (r FirewallRule) Validate() error {
+	if r.CIDR != "" {
+		if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+			return fmt.Errorf("invalid CIDR %q", r.CIDR)
+		}
+	}
+	switch r.Protocol {
+	case "", "icmp":
+		if len(r.Ports) != 0 {
+			return fmt.Errorf("ports need a tcp, udp or sctp rule")
+		}
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("unsupported protocol %q", r.Protocol)
+	}
+	// the multiport match takes 15 ports, a range counts as two
+	slots := 0
+	for _, port := range r.Ports {
+		bounds := strings.SplitN(port, ":", 2)
+		for _, p := range bounds {
+			if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("invalid port %q", port)
+			}
+		}
+		slots += len(bounds)
+	}
+	if slots > 15 {
+		return fmt.Errorf("a rule allows at most 15 ports, a range counts as two")
+	}
+	return nil
+}
+
+// Firewall holds the allow-lists of a network or of a container. Traffic of
+// a container in a direction with rules is dropped unless a rule of its
+// network or its own allows it, a direction without rules is not filtered.
+type Firewall struct {
+	Ingress []FirewallRule `json:",omitempty"`
+	Egress  []FirewallRule `json:",omitempty"`
+}
+
+func (fw *Firewall) Validate() error {
+	for _, r := range append(fw.Ingress, fw.Egress...) {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fw *Firewall) empty() bool {
+	return len(fw.Ingress) == 0 && len(fw.Egress) == 0
+}
+
+// firewallKey is the key of the firewall of the network ip_net, or of the
+// container id on it
+func firewallKey(ip_net, id string) string {
+	if id == "" {
+		return filepath.Join(network_key_prefix, ip_net, "firewall", "network")
+	}
+	return filepath.Join(network_key_prefix, ip_net, "firewall", "containers", id)
+}
+
+func parseFirewall(key, value string) *Firewall {
+	fw := &Firewall{}
+	if err := json.Unmarshal([]byte(value), fw); err != nil {
+		log.Warnf("Invalid firewall %s: %v", key, err)
+	}
+	return fw
+}
+
+// GetFirewall returns the firewall of the network ip_net, or of the
+// container id on it, an empty one when none is set
+func GetFirewall(ip_net, id string) *Firewall {
+	key := firewallKey(ip_net, id)
+	value, err := db.GetKey(key)
+	if err != nil {
+		return &Firewall{}
+	}
+	return parseFirewall(key, value)
+}
+
+// SetFirewall replaces the firewall of the network ip_net, or of the
+// container id on it. An empty firewall removes it.
+func SetFirewall(ip_net, id string, fw *Firewall) error {
+	if fw.empty() {
+		return DeleteFirewall(ip_net, id)
+	}
+	if err := fw.Validate(); err != nil {
+		return err
+	}
+	if _, err := GetConfig(ip_net); err != nil {
+		return fmt.Errorf("no network %s", ip_net)
+	}
+	fw_bytes, _ := json.Marshal(fw)
+	err := db.SetKey(firewallKey(ip_net, id), string(fw_bytes))
+	if err == nil {
+		log.Infof("Set firewall %s", firewallKey(ip_net, id))
+	}
+	return err
+}
+
+func DeleteFirewall(ip_net, id string) error {
+	key := firewallKey(ip_net, id)
+	if !db.IsKeyExist(key) {
+		return nil
+	}
+	err := db.DeleteKey(key)
+	if err == nil {
+		log.Infof("Delete firewall %s", key)
+	}
+	return err
+}
+
+// networkFirewalls returns the firewalls of the network ip_net and of its
+// containers
+func networkFirewalls(ip_net string) (*Firewall, map[string]*Firewall) {
+	containers := map[string]*Firewall{}
+	dir := filepath.Join(network_key_prefix, ip_net, "firewall", "containers")
+	if db.IsKeyExist(dir) {
+		nodes, err := db.GetKeys(dir)
+		if err != nil {
+			log.Errorf("Failed to list the container firewalls of %s: %v", ip_net, err)
+		}
+		for _, node := range nodes {
+			containers[filepath.Base(node.Key)] = parseFirewall(node.Key, node.Value)
+		}
+	}
+	return GetFirewall(ip_net, ""), containers
+}
+
+// firewallTarget is a container address of this host and the pool it is
+// from, and the host veth and network type of a pod when skylarkcni
+// recorded them
+type firewallTarget struct {
+	ContainerID string
+	Ip          string
+	Ipnet       string
+	Veth        string
+	Type        string
+}
+
+// localTargets lists the addresses of the docker containers of this host,
+// and of the pods skylarkcni attached, in the pools of configs
+func localTargets(configs []*Config) []firewallTarget {
+	var targets []firewallTarget
+	poolOf := func(ip string) string {
+		for _, config := range configs {
+			if config.contains(ip) {
+				return config.Ipnet
+			}
+		}
+		return ""
+	}
+	containers, _ := ListContainers(docker_socket)
+	for _, container := range containers {
+		if container.NetworkSettings == nil {
+			continue
+		}
+		for _, n := range container.NetworkSettings.Networks {
+			if ip_net := poolOf(n.IPAddress); ip_net != "" {
+				targets = append(targets, firewallTarget{container.ID, n.IPAddress, ip_net, "", ""})
+			}
+		}
+	}
+	endpoints, err := ListEndpoints()
+	if err != nil {
+		log.Errorf("Failed to list the endpoints: %v", err)
+	}
+	for _, e := range endpoints {
+		if e.Hostname != hostname || poolOf(e.Ip) == "" {
+			continue
+		}
+		targets = append(targets, firewallTarget{e.InfraContainerID(), e.Ip, poolOf(e.Ip), e.Veth, e.Type})
+	}
+	return targets
+}
+
+func containerPid(id string) (int, error) {
+	c, err := client.NewClient(docker_socket, "", nil, map[string]string{"User-Agent": "engine-api-cli-1.0"})
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2000*time.Millisecond)
+	defer cancel()
+	container, err := c.ContainerInspect(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if container.State == nil || container.State.Pid == 0 {
+		return 0, fmt.Errorf("container %s is not running", id)
+	}
+	return container.State.Pid, nil
+}
+
+// NoVethError is returned for the addresses on macvlan and ipvlan
+// interfaces. Their traffic bypasses the bridge of the host, the firewall
+// and the network policies can not filter it.
+type NoVethError struct {
+	Type string
+}
+
+func (e *NoVethError) Error() string {
+	return fmt.Sprintf("%s interfaces have no host veth, their traffic bypasses the bridge", e.Type)
+}
+
+// hostVeth returns the host end of the veth holding ip in the netns of pid
+func hostVeth(pid int, ip string) (string, error) {
+	peer := 0
+	err := ns.WithNetNSPath(fmt.Sprintf("/proc/%d/ns/net", pid), func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				if addr.IP.String() != ip {
+					continue
+				}
+				switch link.Type() {
+				case "veth":
+					peer = link.Attrs().ParentIndex
+					return nil
+				case "macvlan", "ipvlan":
+					return &NoVethError{link.Type()}
+				}
+			}
+		}
+		return fmt.Errorf("no veth holds %s", ip)
+	})
+	if err != nil {
+		return "", err
+	}
+	link, err := netlink.LinkByIndex(peer)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the peer of %s: %v", ip, err)
+	}
+	return link.Attrs().Name, nil
+}
+
+// EndpointVeth returns the host end of the veth of the endpoint. It is looked
+// up through docker when skylarkcni did not record it, the infra container
+// has to be a running docker container then. The error is a *NoVethError
+// for macvlan and ipvlan endpoints.
+func EndpointVeth(e *Endpoint) (string, error) {
+	if e.Veth != "" {
+		return e.Veth, nil
+	}
+	if e.Type == "macvlan" || e.Type == "ipvlan" {
+		return "", &NoVethError{e.Type}
+	}
+	pid, err := containerPid(e.InfraContainerID())
+	if err != nil {
+		return "", err
+	}
+	return hostVeth(pid, e.Ip)
+}
+
+// firewallChains returns the filter chains of the traffic of the host veth,
+// keyed by name, and the jumps to them from firewallChain. Allowed traffic
+// returns to FORWARD rather than being accepted, so the chains of the other
+// end and the network policies still see it.
+func firewallChains(veth string, fw *Firewall) (map[string][][]string, [][]string) {
+	chains := map[string][][]string{}
+	var jumps [][]string
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(veth)))[:16]
+	for _, d := range []struct {
+		rules  []FirewallRule
+		prefix string
+		// what the veth sends is the egress of the container
+		physdev string
+		peer    string
+	}{
+		{fw.Ingress, "SKY-FWI-", "--physdev-out", "-s"},
+		{fw.Egress, "SKY-FWE-", "--physdev-in", "-d"},
+	} {
+		if len(d.rules) == 0 {
+			continue
+		}
+		chain := d.prefix + hash
+		jumps = append(jumps, []string{"-m", "physdev", d.physdev, veth, "--physdev-is-bridged", "-j", chain})
+		rules := [][]string{{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"}}
+		for _, r := range d.rules {
+			var rule []string
+			if r.CIDR != "" {
+				rule = append(rule, d.peer, r.CIDR)
+			}
+			if r.Protocol != "" {
+				rule = append(rule, "-p", r.Protocol)
+			}
+			if len(r.Ports) != 0 {
+				rule = append(rule, "-m", "multiport", "--dports", strings.Join(r.Ports, ","))
+			}
+			rules = append(rules, append(rule, "-j", "RETURN"))
+		}
+		chains[chain] = append(rules, []string{"-j", "DROP"})
+	}
+	return chains, jumps
+}
+
+// firewallBlock returns the rules of firewallChain dropping the new
+// connections of the container address ip in the directions fw filters, for
+// containers whose host veth is unknown
+func firewallBlock(id, ip string, fw *Firewall) [][]string {
+	var rules [][]string
+	for _, d := range []struct {
+		rules []FirewallRule
+		flag  string
+	}{
+		{fw.Ingress, "-d"},
+		{fw.Egress, "-s"},
+	} {
+		if len(d.rules) != 0 {
+			rules = append(rules, []string{d.flag, ip, "-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED",
+				"-m", "comment", "--comment", id, "-j", "DROP"})
+		}
+	}
+	return rules
+}
+
+// SyncFirewall makes the filter chains of this host match the firewalls of
+// the networks and containers in the store. It is a no-op on hosts that
+// never had a container with a firewall.
+func SyncFirewall() error {
+	configs, err := ListPools()
+	if err != nil {
+		return err
+	}
+	network_fws := map[string]*Firewall{}
+	container_fws := map[string]map[string]*Firewall{}
+	for _, config := range configs {
+		network_fws[config.Ipnet], container_fws[config.Ipnet] = networkFirewalls(config.Ipnet)
+	}
+
+	chains := map[string][][]string{}
+	jumps := map[string][][]string{}
+	for _, t := range localTargets(configs) {
+		fw := &Firewall{}
+		for _, f := range []*Firewall{network_fws[t.Ipnet], container_fws[t.Ipnet][t.ContainerID]} {
+			if f != nil {
+				fw.Ingress = append(fw.Ingress, f.Ingress...)
+				fw.Egress = append(fw.Egress, f.Egress...)
+			}
+		}
+		if fw.empty() {
+			continue
+		}
+		veth, err := EndpointVeth(&Endpoint{ContainerID: t.ContainerID, Ip: t.Ip, Veth: t.Veth, Type: t.Type})
+		if _, ok := err.(*NoVethError); ok {
+			log.Errorf("The firewall of %s on %s is not enforced: %v", t.ContainerID, t.Ip, err)
+			continue
+		}
+		if err != nil {
+			// the container stays filtered, by its address
+			log.Warnf("Blocking %s, its host veth is unknown: %v", t.Ip, err)
+			jumps[t.Ip] = firewallBlock(t.ContainerID, t.Ip, fw)
+			continue
+		}
+		veth_chains, veth_jumps := firewallChains(veth, fw)
+		for chain, rules := range veth_chains {
+			chains[chain] = rules
+		}
+		jumps[veth] = veth_jumps
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		if len(jumps) == 0 {
+			return nil
+		}
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	current, err := ipt.List("filter", firewallChain)
+	set_up := err == nil
+	if !set_up && len(jumps) == 0 {
+		// never set up
+		return nil
+	}
+	forward := false
+	if len(jumps) != 0 {
+		EnableBridgeNetfilter()
+		if set_up {
+			if forward, err = ipt.Exists("filter", "FORWARD", "-j", firewallChain); err != nil {
+				return err
+			}
+		}
+	}
+	// the chains are replaced at once, they never let through what the
+	// old or new rules drop
+	if err = IptablesRestore("filter", firewallRestore(chains, jumps, len(jumps) != 0 && !forward)); err != nil {
+		return err
+	}
+
+	// the chains of containers that are gone or lost their firewall
+	for _, rule := range current {
+		fields := strings.Fields(rule)
+		chain := fields[len(fields)-1]
+		if _, ok := chains[chain]; ok || !strings.HasPrefix(chain, "SKY-FW") {
+			continue
+		}
+		if err = ipt.ClearChain("filter", chain); err == nil {
+			err = ipt.DeleteChain("filter", chain)
+		}
+		if err != nil {
+			log.Warnf("Failed to delete chain %s: %v", chain, err)
+		}
+	}
+	if len(jumps) == 0 {
+		exists, err := ipt.Exists("filter", "FORWARD", "-j", firewallChain)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err = ipt.Delete("filter", "FORWARD", "-j", firewallChain); err != nil {
+				return err
+			}
+		}
+		return ipt.DeleteChain("filter", firewallChain)
+	}
+	log.Debugf("Firewall synced for %d containers", len(jumps))
+	return nil
+}
+
+// firewallRestore returns the iptables-restore input replacing firewallChain
+// and the chains of the host veths, forward adds the jump to firewallChain
+// from FORWARD. jumps are the rules of firewallChain by host veth, or by
+// address for the containers blocked without one.
+func firewallRestore(chains map[string][][]string, jumps map[string][][]string, forward bool) string {
+	names := make([]string, 0, len(chains))
+	for chain := range chains {
+		names = append(names, chain)
+	}
+	sort.Strings(names)
+	veths := make([]string, 0, len(jumps))
+	for veth := range jumps {
+		veths = append(veths, veth)
+	}
+	sort.Strings(veths)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, ":%s - [0:0]\n", firewallChain)
+	for _, chain := range names {
+		fmt.Fprintf(&b, ":%s - [0:0]\n", chain)
+	}
+	for _, chain := range names {
+		for _, rule := range chains[chain] {
+			fmt.Fprintf(&b, "-A %s %s\n", chain, strings.Join(rule, " "))
+		}
+	}
+	for _, veth := range veths {
+		for _, jump := range jumps[veth] {
+			fmt.Fprintf(&b, "-A %s %s\n", firewallChain, strings.Join(jump, " "))
+		}
+	}
+	if forward {
+		fmt.Fprintf(&b, "-I FORWARD 1 -j %s\n", firewallChain)
+	}
+	return b.String()
+}
+
+// IptablesRestore applies rules, in the format of iptables-save, to table in
+// one transaction. The chains rules declares are created or flushed and
+// refilled at once, the others are left alone.
+func IptablesRestore(table, rules string) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("*%s\n%sCOMMIT\n", table, rules))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("iptables-restore failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// EnableBridgeNetfilter makes the traffic between the containers on the
+// bridge pass iptables
+func EnableBridgeNetfilter() {
+	err := ioutil.WriteFile("/proc/sys/net/bridge/bridge-nf-call-iptables", []byte("1"), 0644)
+	if err != nil {
+		log.Warnf("Failed to enable bridge-nf-call-iptables, is br_netfilter loaded? %v", err)
+	}
+}
+
+// triggerFirewallSync asks runFirewall for a sync
+func triggerFirewallSync() {
+	select {
+	case firewall_sync <- struct{}{}:
+	default:
+	}
+}
+
+// runFirewall syncs the firewall on changes in the store and every
+// firewall_resync
+func runFirewall() {
+	ticker := time.NewTicker(firewall_resync)
+	defer ticker.Stop()
+	for {
+		if err := SyncFirewall(); err != nil {
+			log.Errorf("Failed to sync the firewall: %v", err)
+		}
+		select {
+		case <-firewall_sync:
+			// the address is assigned before docker moves the veth
+			time.Sleep(time.Second)
+		case <-ticker.C:
+		}
+	}
+}
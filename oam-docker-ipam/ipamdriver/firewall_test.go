@@ -0,0 +1,163 @@
+package ipamdriver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFirewallRuleValidate(t *testing.T) {
+	ports := func(n int, port string) []string {
+		var p []string
+		for i := 0; i < n; i++ {
+			p = append(p, port)
+		}
+		return p
+	}
+	tests := []struct {
+		rule  FirewallRule
+		valid bool
+	}{
+		{FirewallRule{}, true},
+		{FirewallRule{CIDR: "10.0.0.0/8", Protocol: "icmp"}, true},
+		{FirewallRule{Protocol: "tcp", Ports: []string{"80", "8000:8100"}}, true},
+		{FirewallRule{Protocol: "sctp", Ports: ports(15, "80")}, true},
+		// a range takes two of the 15 slots of multiport
+		{FirewallRule{Protocol: "udp", Ports: append(ports(13, "53"), "8000:8100")}, true},
+		{FirewallRule{Protocol: "udp", Ports: append(ports(14, "53"), "8000:8100")}, false},
+		{FirewallRule{Protocol: "tcp", Ports: ports(8, "1:2")}, false},
+		{FirewallRule{Protocol: "tcp", Ports: ports(16, "80")}, false},
+		{FirewallRule{CIDR: "10.0.0.0"}, false},
+		{FirewallRule{Protocol: "gre"}, false},
+		{FirewallRule{Ports: []string{"80"}}, false},
+		{FirewallRule{Protocol: "icmp", Ports: []string{"80"}}, false},
+		{FirewallRule{Protocol: "tcp", Ports: []string{"0"}}, false},
+		{FirewallRule{Protocol: "tcp", Ports: []string{"65536"}}, false},
+		{FirewallRule{Protocol: "tcp", Ports: []string{"80:http"}}, false},
+	}
+	for _, test := range tests {
+		if err := test.rule.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.rule, err, test.valid)
+		}
+	}
+}
+
+func TestFirewallChains(t *testing.T) {
+	established := []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"}
+	drop := []string{"-j", "DROP"}
+	tests := []struct {
+		fw     Firewall
+		chains map[string][][]string
+		jumps  [][]string
+	}{
+		{Firewall{}, map[string][][]string{}, nil},
+		{
+			Firewall{Ingress: []FirewallRule{{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []string{"80", "8000:8100"}}, {Protocol: "icmp"}}},
+			map[string][][]string{"SKY-FWI-325ecd4f76a0fafc": {
+				established,
+				{"-s", "10.0.0.0/8", "-p", "tcp", "-m", "multiport", "--dports", "80,8000:8100", "-j", "RETURN"},
+				{"-p", "icmp", "-j", "RETURN"},
+				drop,
+			}},
+			[][]string{{"-m", "physdev", "--physdev-out", "veth1a2b3c", "--physdev-is-bridged", "-j", "SKY-FWI-325ecd4f76a0fafc"}},
+		},
+		{
+			Firewall{Egress: []FirewallRule{{CIDR: "10.0.2.0/24"}}, Ingress: []FirewallRule{{}}},
+			map[string][][]string{
+				"SKY-FWI-325ecd4f76a0fafc": {established, {"-j", "RETURN"}, drop},
+				"SKY-FWE-325ecd4f76a0fafc": {established, {"-d", "10.0.2.0/24", "-j", "RETURN"}, drop},
+			},
+			[][]string{
+				{"-m", "physdev", "--physdev-out", "veth1a2b3c", "--physdev-is-bridged", "-j", "SKY-FWI-325ecd4f76a0fafc"},
+				{"-m", "physdev", "--physdev-in", "veth1a2b3c", "--physdev-is-bridged", "-j", "SKY-FWE-325ecd4f76a0fafc"},
+			},
+		},
+	}
+	for _, test := range tests {
+		chains, jumps := firewallChains("veth1a2b3c", &test.fw)
+		if !reflect.DeepEqual(chains, test.chains) {
+			t.Errorf("%+v: got chains %v, want %v", test.fw, chains, test.chains)
+		}
+		if !reflect.DeepEqual(jumps, test.jumps) {
+			t.Errorf("%+v: got jumps %v, want %v", test.fw, jumps, test.jumps)
+		}
+	}
+
+	// chain names are at most 28 characters and differ per veth
+	chains, _ := firewallChains("veth1a2b3c", &Firewall{Egress: []FirewallRule{{}}})
+	other, _ := firewallChains("veth4d5e6f", &Firewall{Egress: []FirewallRule{{}}})
+	for chain := range chains {
+		if len(chain) > 28 {
+			t.Errorf("chain %s is too long", chain)
+		}
+		if _, ok := other[chain]; ok {
+			t.Errorf("chain %s is used by two veths", chain)
+		}
+	}
+}
+
+func TestFirewallRestore(t *testing.T) {
+	chains := map[string][][]string{}
+	jumps := map[string][][]string{}
+	for _, veth := range []string{"vethb", "vetha"} {
+		veth_chains, veth_jumps := firewallChains(veth, &Firewall{Ingress: []FirewallRule{{Protocol: "icmp"}}})
+		for chain, rules := range veth_chains {
+			chains[chain] = rules
+		}
+		jumps[veth] = veth_jumps
+	}
+	got := firewallRestore(chains, jumps, true)
+	want := strings.Join([]string{
+		":SKYLARK-FIREWALL - [0:0]",
+		":SKY-FWI-406ffe5c55a180c4 - [0:0]",
+		":SKY-FWI-5f2968d6a875de35 - [0:0]",
+		"-A SKY-FWI-406ffe5c55a180c4 -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+		"-A SKY-FWI-406ffe5c55a180c4 -p icmp -j RETURN",
+		"-A SKY-FWI-406ffe5c55a180c4 -j DROP",
+		"-A SKY-FWI-5f2968d6a875de35 -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+		"-A SKY-FWI-5f2968d6a875de35 -p icmp -j RETURN",
+		"-A SKY-FWI-5f2968d6a875de35 -j DROP",
+		"-A SKYLARK-FIREWALL -m physdev --physdev-out vetha --physdev-is-bridged -j SKY-FWI-406ffe5c55a180c4",
+		"-A SKYLARK-FIREWALL -m physdev --physdev-out vethb --physdev-is-bridged -j SKY-FWI-5f2968d6a875de35",
+		"-I FORWARD 1 -j SKYLARK-FIREWALL",
+		"",
+	}, "\n")
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// without firewalls the chain is emptied and no jump added
+	if got := firewallRestore(map[string][][]string{}, map[string][][]string{}, false); got != ":SKYLARK-FIREWALL - [0:0]\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestEndpointVeth(t *testing.T) {
+	// the veth skylarkcni recorded needs no docker
+	veth, err := EndpointVeth(&Endpoint{ContainerID: "c-web", Ip: "10.0.2.10", Veth: "veth1a2b3c"})
+	if err != nil || veth != "veth1a2b3c" {
+		t.Errorf("got %q %v, want the recorded veth", veth, err)
+	}
+	// macvlan and ipvlan pods have none
+	for _, typ := range []string{"macvlan", "ipvlan"} {
+		_, err := EndpointVeth(&Endpoint{ContainerID: "c-web", Ip: "10.0.2.10", Type: typ})
+		if e, ok := err.(*NoVethError); !ok || e.Type != typ {
+			t.Errorf("%s: got %v, want a NoVethError", typ, err)
+		}
+	}
+}
+
+func TestFirewallBlock(t *testing.T) {
+	fw := &Firewall{Ingress: []FirewallRule{{Protocol: "icmp"}}, Egress: []FirewallRule{{Protocol: "udp", Ports: []string{"53"}}}}
+	want := [][]string{
+		{"-d", "10.0.2.10", "-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED", "-m", "comment", "--comment", "c-web", "-j", "DROP"},
+		{"-s", "10.0.2.10", "-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED", "-m", "comment", "--comment", "c-web", "-j", "DROP"},
+	}
+	if got := firewallBlock("c-web", "10.0.2.10", fw); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// only the directions with rules are blocked
+	if got := firewallBlock("c-web", "10.0.2.10", &Firewall{Egress: fw.Egress}); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("got %v, want %v", got, want[1:])
+	}
+}
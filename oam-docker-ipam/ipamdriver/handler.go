@@ -3,6 +3,8 @@ package ipamdriver
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	//"github.com/docker/go-plugins-helpers/ipam"
@@ -56,25 +58,85 @@ func (iph *MyIPAMHandler) RequestAddress(request *ipam.RequestAddressRequest) (r
 		return nil, err
 	}
 	log.Infof("RequestAddress %s", request_json)
+	// a repeated request of an endpoint gets back the address it has
+	if value := request.Options["InfraContainerid"]; value != "" {
+		if e := assignedEndpoint(EndpointID(value, request.Options["Interface"])); e != nil {
+			log.Infof("Endpoint %s already has IP %s", e.ContainerID, e.Ip)
+			config, err := GetConfig(e.Ipnet)
+			return &ipam.RequestAddressResponse{Address: fmt.Sprintf("%s/%s", e.Ip, config.Mask), Data: config.responseData()}, err
+		}
+	}
 	ip_net := request.PoolID
 	ip := request.Address
+	if name := request.Options["Pool"]; name != "" {
+		pool, err := LookupPool(name)
+		if err != nil {
+			return nil, err
+		}
+		ip_net = pool.Ipnet
+	} else if ip == "" && request.Options["InfraContainerid"] != "" && request.Options["RequestAddressType"] != netlabel.Gateway {
+		// a pool selecting the labels of the pod or container wins over
+		// the pool of the request. Only the CNI plugins send the infra
+		// container, libnetwork can only use an address of the subnet of
+		// its PoolID.
+		pool, err := SelectPool(request.Options)
+		if err != nil {
+			return nil, err
+		}
+		if pool != nil {
+			log.Infof("Pool %s %s selected for %s", pool.Ipnet, pool.Name, request.Options["InfraContainerid"])
+			ip_net = pool.Ipnet
+		}
+	}
 	config, _ := GetConfig(ip_net)
 
 	if value, ok := request.Options["RequestAddressType"]; ok && value == netlabel.Gateway || len(request.Options) == 0 {
 		log.Infof("Skip allocate gateway ip %s", ip)
 		return &ipam.RequestAddressResponse{fmt.Sprintf("%s/%s", ip, config.Mask), nil}, nil
 	}
+	// a StatefulSet pod gets back the IP retained for it
+	pod := request.Options["Pod"]
+	if ip == "" && pod != "" {
+		if ip = retainedIP(ip_net, pod); ip != "" {
+			log.Infof("Reissue retained IP %s to %s", ip, pod)
+		}
+	} else if ip != "" {
+		if owner := retainedFor(ip_net, ip); owner != "" && owner != pod {
+			return nil, fmt.Errorf("IP %s is retained for %s", ip, owner)
+		}
+	}
 	ip, err = AllocateIP(ip_net, ip)
-	if err != nil {
+	if err == nil {
 		if value, ok := request.Options["InfraContainerid"]; ok {
 			//save the infracontainerid and ip mapping
-			err = SaveEndpointToStore(value, ip_net, ip)
+			endpoint := &Endpoint{
+				ContainerID: EndpointID(value, request.Options["Interface"]),
+				Ip:          ip,
+				Ipnet:       ip_net,
+				Hostname:    hostname,
+				Interface:   request.Options["Interface"],
+				Pod:         pod,
+				PodUID:      request.Options["PodUID"],
+				Type:        request.Options["Type"],
+				Time:        time.Now(),
+			}
+			err = SaveEndpointToStore(endpoint)
 			if err != nil {
-				log.Errorf("error saving endpoint to store %s", value)
+				// DEL finds no endpoint, the ip would stay assigned
+				log.Errorf("error saving endpoint to store %s, releasing IP %s: %v", value, ip, err)
+				if e := ReleaseIP(ip_net, ip); e != nil {
+					log.Errorf("error releasing IP %s: %v", ip, e)
+				}
+				return nil, err
 			}
 		}
 	}
-	return &ipam.RequestAddressResponse{fmt.Sprintf("%s/%s", ip, config.Mask), nil}, err
+	if period, _ := strconv.Atoi(request.Options["Retain"]); err == nil && pod != "" && period > 0 {
+		if err := retainIP(ip_net, ip, pod, period); err != nil {
+			log.Errorf("error retaining IP %s for %s: %v", ip, pod, err)
+		}
+	}
+	return &ipam.RequestAddressResponse{fmt.Sprintf("%s/%s", ip, config.Mask), config.responseData()}, err
 }
 
 func (iph *MyIPAMHandler) ReleaseAddress(request *ipam.ReleaseAddressRequest) (err error) {
@@ -84,7 +146,22 @@ func (iph *MyIPAMHandler) ReleaseAddress(request *ipam.ReleaseAddressRequest) (e
 		return err
 	}
 	log.Infof("ReleaseAddress %s", request_json)
-	err = ReleaseIP(request.PoolID, request.Address)
+	if request.Address == "" {
+		log.Infof("Skip Release of an empty address")
+		return nil
+	}
+	ip_net := request.PoolID
+	// the address may come from another pool than the one of the netconf
+	// when the pod asked for a pool by name
+	if config, err := GetConfig(ip_net); err != nil || !config.contains(request.Address) {
+		if pool, err := poolOfIP(request.Address); err == nil {
+			ip_net = pool
+		}
+	}
+	if request.ContainerID != "" {
+		return ReleaseEndpointIP(ip_net, request.Address, EndpointID(request.ContainerID, request.Interface))
+	}
+	err = ReleaseIP(ip_net, request.Address)
 	return err
 }
 
@@ -97,10 +174,20 @@ func (iph *MyIPAMHandler) GetAddress(request *ipam.GetAddressRequest) (response
 	log.Infof("GetAddress %s", request_json)
         containerid := request.ContainerID
 
-	ip, found := GetEndpointFromStore(containerid)
-	if found == false {
-		log.Errorf("error get endpoint from store %s", containerid)
+	ip, err := GetEndpointFromStore(containerid, request.Interface)
+	if err != nil {
+		log.Errorf("error get endpoint from store %s: %v", containerid, err)
+		return nil, err
 	}
 
-	return &ipam.GetAddressResponse{fmt.Sprintf("%s", ip)}, err
-}
\ No newline at end of file
+	return &ipam.GetAddressResponse{fmt.Sprintf("%s", ip)}, nil
+}
+
+func (iph *MyIPAMHandler) SetEndpointVeth(request *ipam.SetEndpointVethRequest) error {
+	request_json, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	log.Infof("SetEndpointVeth %s", request_json)
+	return SetEndpointVeth(EndpointID(request.ContainerID, request.Interface), request.Veth)
+}
@@ -0,0 +1,198 @@
+package ipamdriver
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	etcdclient "github.com/coreos/etcd/client"
+
+	"oam-docker-ipam/db"
+)
+
+// SourceIPPool marks the pools synced from IPPool resources
+const SourceIPPool = "ippool"
+
+// Usage counts the addresses of a pool
+type Usage struct {
+	Free        int
+	Assigned    int
+	Quarantined int
+	Retained    int
+}
+
+// nodeNames returns the last path element of the keys below dir
+func nodeNames(dir string) (map[string]bool, error) {
+	names := map[string]bool{}
+	if !db.IsKeyExist(dir) {
+		return names, nil
+	}
+	nodes, err := db.GetKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		names[filepath.Base(node.Key)] = true
+	}
+	return names, nil
+}
+
+// assignedIPs returns the assigned addresses of ip_net on all hosts
+func assignedIPs(ip_net string) (map[string]bool, error) {
+	hosts, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "assigned"))
+	if err != nil {
+		return nil, err
+	}
+	assigned := map[string]bool{}
+	for host := range hosts {
+		ips, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "assigned", host))
+		if err != nil {
+			return nil, err
+		}
+		for ip := range ips {
+			assigned[ip] = true
+		}
+	}
+	return assigned, nil
+}
+
+// poolOwner describes who manages the pool of config
+func poolOwner(config *Config) string {
+	if config.Source == SourceIPPool {
+		return "IPPool " + config.Name
+	}
+	return "ip-range"
+}
+
+// SyncPool makes the pool of config hand out the addresses ips. Missing
+// addresses are added unless assigned or quarantined, free addresses no longer
+// listed are removed. Assigned addresses are left alone. Only a new network
+// or the pool of the same IPPool is synced, the pools made with ip-range or
+// by other IPPools are refused.
+func SyncPool(config *Config, ips []string) error {
+	ip_net := config.Ipnet
+	lock := db.GetEtcdMutexLock(filepath.Join(network_key_prefix, ip_net, "wait"), 20)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("pool %s is locked: %v", ip_net, err)
+	}
+	defer lock.Release()
+
+	existing, err := GetConfig(ip_net)
+	switch {
+	case err == nil:
+		if existing.Source != config.Source || existing.Name != config.Name {
+			return fmt.Errorf("network %s belongs to %s", ip_net, poolOwner(existing))
+		}
+	case !etcdclient.IsKeyNotFound(err):
+		return err
+	case db.IsKeyExist(filepath.Join(network_key_prefix, ip_net, "pool")),
+		db.IsKeyExist(filepath.Join(network_key_prefix, ip_net, "assigned")):
+		return fmt.Errorf("network %s has addresses without a pool config", ip_net)
+	}
+
+	if err := initializeConfig(config); err != nil {
+		return err
+	}
+	pool, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "pool"))
+	if err != nil {
+		return err
+	}
+	assigned, err := assignedIPs(ip_net)
+	if err != nil {
+		return err
+	}
+	quarantined, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "quarantine"))
+	if err != nil {
+		return err
+	}
+	wanted := map[string]bool{}
+	added := 0
+	for _, ip := range ips {
+		wanted[ip] = true
+		if pool[ip] || assigned[ip] || quarantined[ip] {
+			continue
+		}
+		if err := db.SetKey(filepath.Join(network_key_prefix, ip_net, "pool", ip), ""); err != nil {
+			return err
+		}
+		added++
+	}
+	removed := 0
+	for ip := range pool {
+		if wanted[ip] {
+			continue
+		}
+		if err := db.DeleteKey(filepath.Join(network_key_prefix, ip_net, "pool", ip)); err != nil {
+			return err
+		}
+		removed++
+	}
+	if added != 0 || removed != 0 {
+		log.Infof("Synced pool %s: %d IPs added, %d removed", ip_net, added, removed)
+	}
+	return nil
+}
+
+func PoolUsage(ip_net string) (*Usage, error) {
+	pool, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "pool"))
+	if err != nil {
+		return nil, err
+	}
+	assigned, err := assignedIPs(ip_net)
+	if err != nil {
+		return nil, err
+	}
+	quarantined, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "quarantine"))
+	if err != nil {
+		return nil, err
+	}
+	retained, err := nodeNames(filepath.Join(network_key_prefix, ip_net, "retained"))
+	if err != nil {
+		return nil, err
+	}
+	return &Usage{Free: len(pool), Assigned: len(assigned), Quarantined: len(quarantined), Retained: len(retained)}, nil
+}
+
+// DeletePool removes a pool none of whose addresses is assigned. A pool with
+// assigned addresses is drained instead, it hands out no more addresses and
+// can be deleted once they are released.
+func DeletePool(ip_net string) error {
+	assigned, err := assignedIPs(ip_net)
+	if err != nil {
+		return err
+	}
+	if len(assigned) != 0 {
+		if err = drainPool(ip_net); err != nil {
+			return err
+		}
+		return errors.New(fmt.Sprintf("pool %s still has %d assigned IPs", ip_net, len(assigned)))
+	}
+	return DeleteNetWork(ip_net)
+}
+
+// drainPool marks the pool draining and removes its free addresses
+func drainPool(ip_net string) error {
+	lock := db.GetEtcdMutexLock(filepath.Join(network_key_prefix, ip_net, "wait"), 20)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("pool %s is locked: %v", ip_net, err)
+	}
+	defer lock.Release()
+
+	config, err := GetConfig(ip_net)
+	if err != nil {
+		return err
+	}
+	if !config.Draining {
+		config.Draining = true
+		if err = initializeConfig(config); err != nil {
+			return err
+		}
+		log.Infof("Draining pool %s of %s", ip_net, poolOwner(config))
+	}
+	pool := filepath.Join(network_key_prefix, ip_net, "pool")
+	if !db.IsKeyExist(pool) {
+		return nil
+	}
+	return db.DeleteKey(pool)
+}
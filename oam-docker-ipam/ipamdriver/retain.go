@@ -0,0 +1,137 @@
+package ipamdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"oam-docker-ipam/db"
+)
+
+// Retention reserves the IP of a StatefulSet pod for the pod, so the
+// recreated pod gets the same address on whatever host it lands. While the
+// pod runs the retention has no deadline, once the IP is released it is kept
+// out of allocation for Period seconds.
+type Retention struct {
+	Ip       string
+	Pod      string // namespace/name
+	Period   int
+	Hostname string
+	Expires  time.Time `json:",omitempty"`
+}
+
+func retainedKey(ip_net, ip string) string {
+	return filepath.Join(network_key_prefix, ip_net, "retained", ip)
+}
+
+func getRetention(ip_net, ip string) (*Retention, bool) {
+	value, err := db.GetKey(retainedKey(ip_net, ip))
+	if err != nil {
+		return nil, false
+	}
+	r := &Retention{}
+	if err = json.Unmarshal([]byte(value), r); err != nil {
+		log.Warnf("Invalid retention of IP %s: %v", ip, err)
+		return nil, false
+	}
+	return r, true
+}
+
+// retainIP reserves ip for pod until period seconds after its release
+func retainIP(ip_net, ip, pod string, period int) error {
+	r := &Retention{Ip: ip, Pod: pod, Period: period, Hostname: hostname}
+	r_bytes, _ := json.Marshal(r)
+	err := db.SetKey(retainedKey(ip_net, ip), string(r_bytes))
+	if err == nil {
+		log.Infof("Retain IP %s for %s", ip, pod)
+	}
+	return err
+}
+
+// expireRetention starts the countdown of the retention of a released ip
+func expireRetention(ip_net, ip string) {
+	r, ok := getRetention(ip_net, ip)
+	if !ok {
+		return
+	}
+	r.Expires = time.Now().Add(time.Duration(r.Period) * time.Second)
+	r_bytes, _ := json.Marshal(r)
+	if err := db.SetKeyTTL(retainedKey(ip_net, ip), string(r_bytes), r.Period); err != nil {
+		log.Errorf("Failed to expire the retention of IP %s: %v", ip, err)
+		return
+	}
+	log.Infof("Retain IP %s for %s until %s", ip, r.Pod, r.Expires.Format(time.RFC3339))
+}
+
+// retainedFor returns the pod ip is retained for, or "" when it is free
+func retainedFor(ip_net, ip string) string {
+	if r, ok := getRetention(ip_net, ip); ok {
+		return r.Pod
+	}
+	return ""
+}
+
+// retainedIP returns the IP of ip_net retained for pod, or ""
+func retainedIP(ip_net, pod string) string {
+	retained, err := ListRetained(ip_net)
+	if err != nil {
+		return ""
+	}
+	for _, r := range retained {
+		if r.Pod == pod {
+			return r.Ip
+		}
+	}
+	return ""
+}
+
+// ListRetained returns the retained addresses of ip_net, or of all networks
+// when ip_net is empty
+func ListRetained(ip_net string) ([]*Retention, error) {
+	var subnets []string
+	if ip_net != "" {
+		subnets = append(subnets, ip_net)
+	} else {
+		nets, err := db.GetKeys(network_key_prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nets {
+			subnets = append(subnets, filepath.Base(n.Key))
+		}
+	}
+	var retained []*Retention
+	for _, subnet := range subnets {
+		key := filepath.Join(network_key_prefix, subnet, "retained")
+		if !db.IsKeyExist(key) {
+			continue
+		}
+		nodes, err := db.GetKeys(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			r := &Retention{}
+			if err := json.Unmarshal([]byte(node.Value), r); err != nil {
+				r.Ip = filepath.Base(node.Key)
+			}
+			retained = append(retained, r)
+		}
+	}
+	return retained, nil
+}
+
+// ReleaseRetention drops the reservation of ip before it expires
+func ReleaseRetention(ip_net, ip string) error {
+	if !db.IsKeyExist(retainedKey(ip_net, ip)) {
+		return fmt.Errorf("IP %s is not retained", ip)
+	}
+	err := db.DeleteKey(retainedKey(ip_net, ip))
+	if err == nil {
+		log.Infof("Release retained IP %s", ip)
+	}
+	return err
+}
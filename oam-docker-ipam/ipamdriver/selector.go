@@ -0,0 +1,142 @@
+package ipamdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// Request options carrying the labels pools are selected by, each a JSON
+// object
+const (
+	OptionNamespaceLabels = "NamespaceLabels"
+	OptionPodLabels       = "PodLabels"
+	OptionNodeLabels      = "NodeLabels"
+)
+
+const docker_socket = "unix:///var/run/docker.sock"
+
+// Labels are the label sets of a request
+type Labels struct {
+	Namespace map[string]string
+	Pod       map[string]string
+	Node      map[string]string
+	Container map[string]string
+}
+
+func matchLabels(selector, labels map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectors counts the labels the selectors of config ask for
+func (config *Config) selectors() int {
+	return len(config.NamespaceSelector) + len(config.PodSelector) + len(config.NodeSelector) + len(config.ContainerSelector)
+}
+
+func (config *Config) selects(labels *Labels) bool {
+	return matchLabels(config.NamespaceSelector, labels.Namespace) &&
+		matchLabels(config.PodSelector, labels.Pod) &&
+		matchLabels(config.NodeSelector, labels.Node) &&
+		matchLabels(config.ContainerSelector, labels.Container)
+}
+
+// requestLabels reads the labels of the options. The labels of the docker
+// container id are only read when a pool selects by them.
+func requestLabels(options map[string]string, id string, configs []*Config) (*Labels, error) {
+	labels := &Labels{}
+	for key, dst := range map[string]*map[string]string{
+		OptionNamespaceLabels: &labels.Namespace,
+		OptionPodLabels:       &labels.Pod,
+		OptionNodeLabels:      &labels.Node,
+	} {
+		if value := options[key]; value != "" {
+			if err := json.Unmarshal([]byte(value), dst); err != nil {
+				return nil, fmt.Errorf("invalid %s option: %v", key, err)
+			}
+		}
+	}
+	if id == "" {
+		return labels, nil
+	}
+	for _, config := range configs {
+		if len(config.ContainerSelector) != 0 {
+			container_labels, err := containerLabels(id)
+			if err != nil {
+				// not a docker container
+				log.Warnf("Failed to read the labels of container %s: %v", id, err)
+			}
+			labels.Container = container_labels
+			break
+		}
+	}
+	return labels, nil
+}
+
+func containerLabels(id string) (map[string]string, error) {
+	c, err := client.NewClient(docker_socket, "", nil, map[string]string{"User-Agent": "engine-api-cli-1.0"})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2000*time.Millisecond)
+	defer cancel()
+	container, err := c.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if container.Config == nil {
+		return nil, nil
+	}
+	return container.Config.Labels, nil
+}
+
+// selectPool returns the pool of configs whose selectors match labels, nil
+// when none does. Pools without selectors and draining pools are never
+// selected. The pool asking for the most labels wins, ties go to the lowest
+// network.
+func selectPool(configs []*Config, labels *Labels) *Config {
+	var matches []*Config
+	for _, config := range configs {
+		if config.selectors() != 0 && !config.Draining && config.selects(labels) {
+			matches = append(matches, config)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if n, m := matches[i].selectors(), matches[j].selectors(); n != m {
+			return n > m
+		}
+		return matches[i].Ipnet < matches[j].Ipnet
+	})
+	if len(matches) > 1 && matches[0].selectors() == matches[1].selectors() {
+		log.Warnf("Pools %s and %s both select %+v, using %s", matches[0].Ipnet, matches[1].Ipnet, labels, matches[0].Ipnet)
+	}
+	return matches[0]
+}
+
+// SelectPool picks the pool of a request of the CNI plugins by the labels of
+// its options and of its infra container, nil when no pool selects it.
+// libnetwork sends neither, the docker containers it attaches get the pool
+// of their network.
+func SelectPool(options map[string]string) (*Config, error) {
+	configs, err := ListPools()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := requestLabels(options, options["InfraContainerid"], configs)
+	if err != nil {
+		return nil, err
+	}
+	return selectPool(configs, labels), nil
+}
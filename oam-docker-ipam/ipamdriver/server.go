@@ -22,6 +22,7 @@ import (
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 
+	"oam-docker-ipam/arp"
 	"oam-docker-ipam/db"
 	"oam-docker-ipam/util"
 )
@@ -34,9 +35,107 @@ const (
 var hostname string
 var byteResps = make(chan [2][]byte, 1)
 
+// duplicate address detection is disabled while dad_interface is empty
+var dad_interface string
+var dad_timeout time.Duration
+
 type Config struct {
 	Ipnet string
 	Mask  string
+	// Name lets pods ask for the pool by name, Gateway is handed out with its
+	// addresses when set
+	Name    string `json:",omitempty"`
+	Gateway string `json:",omitempty"`
+	// Source is "ippool" for pools synced from an IPPool resource
+	Source string `json:",omitempty"`
+	// NamespaceSelector, PodSelector, NodeSelector and ContainerSelector
+	// are the labels of the namespaces, pods, nodes and docker infra
+	// containers the pool serves, see SelectPool. They only apply to the
+	// requests of the CNI plugins.
+	NamespaceSelector map[string]string `json:",omitempty"`
+	PodSelector       map[string]string `json:",omitempty"`
+	NodeSelector      map[string]string `json:",omitempty"`
+	ContainerSelector map[string]string `json:",omitempty"`
+	// IngressBandwidth and EgressBandwidth are the default limits of the
+	// pods of the pool in bits per second
+	IngressBandwidth uint64 `json:",omitempty"`
+	EgressBandwidth  uint64 `json:",omitempty"`
+	// Routes are added through the pod interface and DNS is handed to the
+	// pods. SkipDefaultRoute leaves the default route to another interface.
+	Routes           []Route `json:",omitempty"`
+	DNS              *DNS    `json:",omitempty"`
+	SkipDefaultRoute bool    `json:",omitempty"`
+	// Draining pools hand out no addresses, the released ones do not
+	// return to the pool, see DeletePool
+	Draining bool `json:",omitempty"`
+}
+
+// Route is a static route of the pods, through the gateway of the pool when
+// Gw is empty
+type Route struct {
+	Dst string
+	Gw  string `json:",omitempty"`
+}
+
+func (r Route) Validate() error {
+	if _, _, err := net.ParseCIDR(r.Dst); err != nil {
+		return fmt.Errorf("invalid route destination %q", r.Dst)
+	}
+	if r.Gw != "" && net.ParseIP(r.Gw).To4() == nil {
+		return fmt.Errorf("invalid route gateway %q", r.Gw)
+	}
+	return nil
+}
+
+type DNS struct {
+	Nameservers []string `json:",omitempty"`
+	Domain      string   `json:",omitempty"`
+	Search      []string `json:",omitempty"`
+	Options     []string `json:",omitempty"`
+}
+
+// responseData is what RequestAddress tells the pods of the pool besides
+// their address, routes and DNS are JSON encoded and the default bandwidth
+// is in bits per second
+func (config *Config) responseData() map[string]string {
+	data := map[string]string{}
+	if config.Gateway != "" {
+		data["Gateway"] = config.Gateway
+	}
+	if len(config.Routes) != 0 {
+		routes, _ := json.Marshal(config.Routes)
+		data["Routes"] = string(routes)
+	}
+	if config.DNS != nil {
+		dns, _ := json.Marshal(config.DNS)
+		data["DNS"] = string(dns)
+	}
+	if config.SkipDefaultRoute {
+		data["SkipDefaultRoute"] = "true"
+	}
+	if config.IngressBandwidth != 0 {
+		data["IngressBandwidth"] = strconv.FormatUint(config.IngressBandwidth, 10)
+	}
+	if config.EgressBandwidth != 0 {
+		data["EgressBandwidth"] = strconv.FormatUint(config.EgressBandwidth, 10)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// Quarantine records an address found in use by a station unknown to skylark
+type Quarantine struct {
+	Ip       string
+	Mac      string
+	Hostname string
+	Time     time.Time
+}
+
+func SetDuplicateAddressDetection(iface string, timeout time.Duration) {
+	dad_interface = iface
+	dad_timeout = timeout
 }
 
 func StartServer() {
@@ -46,7 +145,8 @@ func StartServer() {
 	go IpResourceCleanUP()
 
 	go handleChannelEvent(byteResps)
-	//Create etcd watcher and event handler for rate limit change
+	go runFirewall()
+	//Create etcd watcher and event handler for rate limit and firewall change
 	watcher, err := db.WatchKey(network_key_prefix)
 	if err != nil {
 		log.Errorf("error to create etcd watcher")
@@ -59,43 +159,123 @@ func StartServer() {
 	h.ServeUnix("root", "skylark")
 }
 
-func AllocateIPRange(ip_start, ip_end string) []string {
+// AllocateIPRange adds the range to the pool of config, its Ipnet and Mask
+// are set from ip_start
+func AllocateIPRange(ip_start, ip_end string, config *Config) []string {
 	ips := util.GetIPRange(ip_start, ip_end)
 	ip_net, mask := util.GetIPNetAndMask(ip_start)
 	for _, ip := range ips {
-		if checkIPAssigned(ip_net, ip) {
+		assigned, err := checkIPAssigned(ip_net, ip)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if assigned {
 			log.Warnf("IP %s has been allocated", ip)
 			continue
 		}
 		db.SetKey(filepath.Join(network_key_prefix, ip_net, "pool", ip), "")
 	}
-	initializeConfig(ip_net, mask)
+	config.Ipnet, config.Mask = ip_net, mask
+	initializeConfig(config)
 	fmt.Println("Allocate Containers IP Done! Total:", len(ips))
 	return ips
 }
 
 func ReleaseIP(ip_net, ip string) error {
-	value, _ := db.GetKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip))
+	return releaseIP(ip_net, hostname, ip)
+}
+
+func releaseIP(ip_net, host, ip string) error {
+	value, _ := db.GetKey(filepath.Join(network_key_prefix, ip_net, "assigned", host, ip))
 	if value != "" {
 		DeleteEndpointFromStore(value)
 	}
 
-	err := db.DeleteKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip))
+	err := db.DeleteKey(filepath.Join(network_key_prefix, ip_net, "assigned", host, ip))
 	if err != nil {
 		log.Infof("Skip Release IP %s", ip)
 		return nil
 	}
+	if config, err := GetConfig(ip_net); err == nil && config.Draining {
+		log.Infof("Release IP %s of draining pool %s", ip, ip_net)
+		expireRetention(ip_net, ip)
+		return nil
+	}
 	err = db.SetKey(filepath.Join(network_key_prefix, ip_net, "pool", ip), "")
 	if err == nil {
 		log.Infof("Release IP %s", ip)
+		expireRetention(ip_net, ip)
 	}
 	return nil
 }
 
+// AllocateIP assigns ip, or a free address of the pool when ip is empty, to
+// this host
 func AllocateIP(ip_net, ip string) (string, error) {
+	a := &allocator{
+		reserve: func(ip string) (string, error) {
+			var reserved string
+			err := lockNetwork(ip_net, func() error {
+				var err error
+				reserved, err = reserveIP(ip_net, ip)
+				return err
+			})
+			return reserved, err
+		},
+		probe: probeIP,
+		quarantine: func(ip, mac string) error {
+			return quarantineIP(ip_net, ip, mac)
+		},
+	}
+	ip, err := a.allocate(ip)
+	if err != nil {
+		return ip, err
+	}
+	log.Infof("Allocated IP %s", ip)
+
+	//query container env, save flow limit setting into the kv store if available
+	go updateFlowLimit(ip_net, ip)
+	return ip, nil
+}
+
+// allocator takes a candidate out of the pool with reserve and probes it
+// afterwards, so the lock of the network is not held during the probe.
+// Candidates another station answers for are quarantined and skipped.
+type allocator struct {
+	reserve    func(ip string) (string, error)
+	probe      func(ip string) (net.HardwareAddr, error)
+	quarantine func(ip, mac string) error
+}
+
+func (a *allocator) allocate(ip string) (string, error) {
+	for {
+		reserved, err := a.reserve(ip)
+		if err != nil {
+			return reserved, err
+		}
+		mac, err := a.probe(reserved)
+		if err != nil {
+			// probe failures do not block allocation
+			log.Errorf("Failed to probe IP %s: %v", reserved, err)
+			return reserved, nil
+		}
+		if mac == nil {
+			return reserved, nil
+		}
+		if err = a.quarantine(reserved, mac.String()); err != nil {
+			return reserved, fmt.Errorf("failed to quarantine IP %s: %v", reserved, err)
+		}
+		if ip != "" {
+			return ip, fmt.Errorf("IP %s is in use on the network", ip)
+		}
+	}
+}
+
+// lockNetwork runs f holding the etcd lock of ip_net
+func lockNetwork(ip_net string, f func() error) error {
         // create a lock
 	lock := db.GetEtcdMutexLock(filepath.Join(network_key_prefix, ip_net, "wait"), 20)
-        log.Debugf("Lock instance:%s", lock)
+        log.Debugf("Lock instance:%v", lock)
 
         err := lock.Lock()
 
@@ -108,10 +288,9 @@ func AllocateIP(ip_net, ip string) (string, error) {
 			log.Debugf("Locked by others, %d retry ...", cnt)
 			e := lock.Lock()
 			if e == nil {
-				ip, err := getIP(ip_net, ip)
+				err := f()
 				lock.Release()
-				return ip, err
-				break
+				return err
 			}
 			if cnt > 30 {
 				log.Debugf("Abort ...")
@@ -119,15 +298,17 @@ func AllocateIP(ip_net, ip string) (string, error) {
 			}
 		}
 	} else {
-		// if lock successfully, go ahead to acquire the ip
-		ip, err := getIP(ip_net, ip)
+		// if lock successfully, go ahead
+		err := f()
 		lock.Release()
-		return ip, err
+		return err
 	}
-        return "", errors.New("Can not allocate ip")
+        return errors.New("Can not allocate ip")
 }
 
-func getIP(ip_net, ip string) (string, error) {
+// reserveIP moves ip, or the first free address of the pool when ip is
+// empty, from the pool to the addresses assigned to this host
+func reserveIP(ip_net, ip string) (string, error) {
 	ip_pool, err := db.GetKeys(filepath.Join(network_key_prefix, ip_net, "pool"))
 	if err != nil {
 		return ip, err
@@ -136,41 +317,138 @@ func getIP(ip_net, ip string) (string, error) {
 		return ip, errors.New("Pool is empty")
 	}
 	if ip == "" {
-		find_ip := strings.Split(ip_pool[0].Key, "/")
-		ip = find_ip[len(find_ip) - 1]
-	}
-	exist := checkIPAssigned(ip_net, ip)
-	if exist == true {
-		return ip, errors.New(fmt.Sprintf("IP %s has been allocated", ip))
+		ip, err = findFreeIP(ip_net, ip_pool)
+		if err != nil {
+			return ip, err
+		}
+	} else {
+		exist, err := checkIPAssigned(ip_net, ip)
+		if err != nil {
+			return ip, err
+		}
+		if exist == true {
+			return ip, errors.New(fmt.Sprintf("IP %s has been allocated", ip))
+		}
 	}
 	err = db.DeleteKey(filepath.Join(network_key_prefix, ip_net, "pool", ip))
 	if err != nil {
 		return ip, err
 	}
-	db.SetKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip), "")
-	log.Infof("Allocated IP %s", ip)
+	return ip, db.SetKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip), "")
+}
 
-	//query container env, save flow limit setting into the kv store if available
-	go updateFlowLimit(ip_net, ip)
-	return ip, err
+// findFreeIP walks the pool in order and returns the first address that is
+// neither assigned nor retained
+func findFreeIP(ip_net string, ip_pool etcdclient.Nodes) (string, error) {
+	for _, node := range ip_pool {
+		find_ip := strings.Split(node.Key, "/")
+		ip := find_ip[len(find_ip)-1]
+		assigned, err := checkIPAssigned(ip_net, ip)
+		if err != nil {
+			return "", err
+		}
+		if assigned {
+			continue
+		}
+		if retainedFor(ip_net, ip) != "" {
+			continue
+		}
+		return ip, nil
+	}
+	return "", errors.New("No free IP in pool")
+}
+
+// probeIP returns the MAC of the station answering for ip on the dad
+// interface, nil when none does or detection is disabled
+func probeIP(ip string) (net.HardwareAddr, error) {
+	if dad_interface == "" {
+		return nil, nil
+	}
+	return arp.Probe(dad_interface, net.ParseIP(ip), dad_timeout)
 }
 
-func checkIPAssigned(ip_net, ip string) bool {
-	if exist := db.IsKeyExist(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip)); exist {
-		return true
+// quarantineIP records that mac uses the reserved ip and takes ip back from
+// this host
+func quarantineIP(ip_net, ip, mac string) error {
+	q := &Quarantine{Ip: ip, Mac: mac, Hostname: hostname, Time: time.Now()}
+	q_bytes, _ := json.Marshal(q)
+	err := db.SetKey(filepath.Join(network_key_prefix, ip_net, "quarantine", ip), string(q_bytes))
+	if err != nil {
+		return err
 	}
-	return false
+	err = db.DeleteKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip))
+	if err != nil {
+		return err
+	}
+	log.Warnf("Quarantined IP %s, it is used by %s", ip, mac)
+	return nil
 }
 
-func initializeConfig(ip_net, mask string) error {
-	config := &Config{Ipnet: ip_net, Mask: mask}
+// ListQuarantine returns the quarantined addresses of ip_net, or of all
+// networks when ip_net is empty
+func ListQuarantine(ip_net string) ([]*Quarantine, error) {
+	var subnets []string
+	if ip_net != "" {
+		subnets = append(subnets, ip_net)
+	} else {
+		nets, err := db.GetKeys(network_key_prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nets {
+			subnets = append(subnets, filepath.Base(n.Key))
+		}
+	}
+	var quarantined []*Quarantine
+	for _, subnet := range subnets {
+		key := filepath.Join(network_key_prefix, subnet, "quarantine")
+		if !db.IsKeyExist(key) {
+			continue
+		}
+		nodes, err := db.GetKeys(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			q := &Quarantine{}
+			if err := json.Unmarshal([]byte(node.Value), q); err != nil {
+				q.Ip = filepath.Base(node.Key)
+			}
+			quarantined = append(quarantined, q)
+		}
+	}
+	return quarantined, nil
+}
+
+// ReleaseQuarantine puts a quarantined address back into its pool
+func ReleaseQuarantine(ip_net, ip string) error {
+	err := db.DeleteKey(filepath.Join(network_key_prefix, ip_net, "quarantine", ip))
+	if err != nil {
+		return err
+	}
+	if config, err := GetConfig(ip_net); err == nil && config.Draining {
+		log.Infof("Release quarantined IP %s of draining pool %s", ip, ip_net)
+		return nil
+	}
+	err = db.SetKey(filepath.Join(network_key_prefix, ip_net, "pool", ip), "")
+	if err == nil {
+		log.Infof("Release quarantined IP %s", ip)
+	}
+	return err
+}
+
+func checkIPAssigned(ip_net, ip string) (bool, error) {
+	return db.KeyExists(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip))
+}
+
+func initializeConfig(config *Config) error {
 	config_bytes, err := json.Marshal(config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = db.SetKey(filepath.Join(network_key_prefix, ip_net, "config"), string(config_bytes))
+	err = db.SetKey(filepath.Join(network_key_prefix, config.Ipnet, "config"), string(config_bytes))
 	if err == nil {
-		log.Infof("Initialized Config %s for network %s", string(config_bytes), ip_net)
+		log.Infof("Initialized Config %s for network %s", string(config_bytes), config.Ipnet)
 	}
 	return err
 }
@@ -193,6 +471,64 @@ func GetConfig(ip_net string) (*Config, error) {
 	return conf, err
 }
 
+func ListPools() ([]*Config, error) {
+	nodes, err := db.GetKeys(network_key_prefix)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*Config
+	for _, node := range nodes {
+		if !node.Dir {
+			continue
+		}
+		config, err := GetConfig(filepath.Base(node.Key))
+		if err != nil {
+			continue
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// LookupPool finds the pool named name
+func LookupPool(name string) (*Config, error) {
+	configs, err := ListPools()
+	if err != nil {
+		return nil, err
+	}
+	for _, config := range configs {
+		if config.Name == name {
+			return config, nil
+		}
+	}
+	return nil, fmt.Errorf("no pool named %s", name)
+}
+
+func (config *Config) contains(ip string) bool {
+	_, ip_net, err := net.ParseCIDR(config.Ipnet + "/" + config.Mask)
+	return err == nil && ip_net.Contains(net.ParseIP(ip))
+}
+
+// poolOfIP returns the network of the pool whose subnet holds ip
+func poolOfIP(ip string) (string, error) {
+	configs, err := ListPools()
+	if err != nil {
+		return "", err
+	}
+	for _, config := range configs {
+		if config.contains(ip) {
+			return config.Ipnet, nil
+		}
+	}
+	return "", fmt.Errorf("no pool holds %s", ip)
+}
+
+// InitializeHostname sets the hostname addresses are assigned under when the
+// package is used without StartServer
+func InitializeHostname() {
+	hostname = GetHostName()
+}
+
 func GetHostName() string {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -271,7 +607,7 @@ func ListContainers(socketurl string) ([]types.Container, error) {
 	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
 	c,err = client.NewClient(socketurl, "", nil, defaultHeaders)
 	if err != nil {
-		log.Fatalf("Create Docker Client error", err)
+		log.Fatalf("Create Docker Client error: %v", err)
 		return nil, err
 	}
 
@@ -293,7 +629,7 @@ func InspectContainer(socketurl string, id string) (types.ContainerJSON, error)
 	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
 	c,err = client.NewClient(socketurl, "", nil, defaultHeaders)
 	if err != nil {
-		log.Fatalf("Create Docker Client error", err)
+		log.Fatalf("Create Docker Client error: %v", err)
 		return types.ContainerJSON{}, err
 	}
 
@@ -302,7 +638,7 @@ func InspectContainer(socketurl string, id string) (types.ContainerJSON, error)
 	defer cancel()
 	containerJson, err := c.ContainerInspect(ctx, id)
 	if err != nil {
-		log.Fatal("Inspect Container error: %s", id)
+		log.Fatalf("Inspect Container error: %s", id)
 		return types.ContainerJSON{}, err
 	}
 	return containerJson, err
@@ -367,13 +703,20 @@ func receiveEtcdEvents(watcher etcdclient.Watcher, rsps chan [2][]byte) {
 		if err != nil {
 			log.Errorf("Error %v during watch", err)
 			time.Sleep(time.Second)
+			continue
 		}
 
+		if strings.Contains(etcdRsp.Node.Key, "/firewall/") {
+			triggerFirewallSync()
+			continue
+		}
 		hostname,_ := os.Hostname()
 		if strings.Contains(etcdRsp.Node.Key, hostname) == false {
 			log.Debug("Key not for current host ...")
 			continue
 		}
+		// a container of this host came or went
+		triggerFirewallSync()
 
 		//rsp[0] is current key, rsp[1] is current value
 		rsp := [2][]byte{nil, nil}
@@ -526,17 +869,118 @@ func get_host_veth_num(pid int, device string) string {
 	return ifnum
 }
 
-func SaveEndpointToStore(infracontainerid string, ip_net string, ip string) error{
+// Endpoint records the IP of a pod interface under EndpointID. Records
+// written before they carried the pod only have Ip set.
+type Endpoint struct {
+	ContainerID string `json:"-"`
+	Ip          string
+	Ipnet       string
+	Hostname    string
+	Interface   string `json:",omitempty"`
+	Pod         string `json:",omitempty"` // namespace/name
+	PodUID      string `json:",omitempty"`
+	Veth        string `json:",omitempty"` // host end of the veth of a bridge pod
+	Type        string `json:",omitempty"` // cni network type: bridge, macvlan or ipvlan
+	Time        time.Time
+}
+
+// EndpointID is the key of the endpoint of interface ifname of the infra
+// container. eth0 keeps the bare container id of the records written before
+// pods had several interfaces.
+func EndpointID(infracontainerid, ifname string) string {
+	if ifname == "" || ifname == "eth0" {
+		return infracontainerid
+	}
+	return infracontainerid + "-" + ifname
+}
+
+// InfraContainerID is the container of the endpoint, its EndpointID without
+// the interface
+func (e *Endpoint) InfraContainerID() string {
+	if e.Interface == "" || e.Interface == "eth0" {
+		return e.ContainerID
+	}
+	return strings.TrimSuffix(e.ContainerID, "-"+e.Interface)
+}
+
+func SaveEndpointToStore(e *Endpoint) error {
 	//update container id to ip key
-	db.SetKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip), infracontainerid)
-	log.Infof("Complete set value for %s", ip)
+	err := db.SetKey(filepath.Join(network_key_prefix, e.Ipnet, "assigned", e.Hostname, e.Ip), e.ContainerID)
+	if err != nil {
+		log.Errorf("error assigning %s to endpoint %s", e.Ip, e.ContainerID)
+		return err
+	}
+	log.Infof("Complete set value for %s", e.Ip)
 
 	//save pod endpoint info
-	err := db.SetKey(filepath.Join(pod_key_prefix, infracontainerid), ip)
+	e_bytes, _ := json.Marshal(e)
+	err = db.SetKey(filepath.Join(pod_key_prefix, e.ContainerID), string(e_bytes))
+	if err != nil {
+		log.Errorf("error saving endpoint %s", e.ContainerID)
+		return err
+	}
+	return nil
+}
+
+// SetEndpointVeth records veth as the host end of the veth of endpoint id
+func SetEndpointVeth(id, veth string) error {
+	key := filepath.Join(pod_key_prefix, id)
+	value, err := db.GetKey(key)
+	if err != nil {
+		return fmt.Errorf("no endpoint %s: %v", id, err)
+	}
+	e := parseEndpoint(id, value)
+	e.Veth = veth
+	e_bytes, _ := json.Marshal(e)
+	if err = db.SetKey(key, string(e_bytes)); err != nil {
+		return err
+	}
+	// the endpoint may have been blocked by its address until now
+	triggerFirewallSync()
+	return nil
+}
+
+// assignedEndpoint returns the endpoint recorded under id when its IP is
+// still assigned to it on this host
+func assignedEndpoint(id string) *Endpoint {
+	value, err := db.GetKey(filepath.Join(pod_key_prefix, id))
+	if err != nil {
+		return nil
+	}
+	e := parseEndpoint(id, value)
+	if e.Ipnet == "" || e.Hostname != hostname {
+		return nil
+	}
+	owner, err := db.GetKey(filepath.Join(network_key_prefix, e.Ipnet, "assigned", e.Hostname, e.Ip))
+	if err != nil || owner != id {
+		return nil
+	}
+	return e
+}
+
+// ReleaseEndpointIP releases ip of endpoint id on this host. An ip no longer
+// assigned, or assigned to another endpoint, is left alone so repeated
+// releases are harmless. The record of the endpoint goes either way.
+func ReleaseEndpointIP(ip_net, ip, id string) error {
+	owner, err := db.GetKey(filepath.Join(network_key_prefix, ip_net, "assigned", hostname, ip))
+	if err != nil && !etcdclient.IsKeyNotFound(err) {
+		return err
+	}
+	if err == nil && (owner == "" || owner == id) {
+		return ReleaseIP(ip_net, ip)
+	}
+	if err == nil {
+		log.Warnf("Skip Release IP %s, it is assigned to %s and not %s", ip, owner, id)
+	} else {
+		log.Infof("Skip Release IP %s, it is not assigned", ip)
+	}
+	exist, err := db.KeyExists(filepath.Join(pod_key_prefix, id))
 	if err != nil {
-		log.Errorf("error saving endpoint %s", infracontainerid)
 		return err
 	}
+	if exist {
+		return DeleteEndpointFromStore(id)
+	}
 	return nil
 }
 
@@ -549,11 +993,65 @@ func DeleteEndpointFromStore(infracontainerid string) error{
 	return nil
 }
 
-func GetEndpointFromStore(infracontainerid string) (string, bool) {
-	ip, err := db.GetKey(filepath.Join(pod_key_prefix, infracontainerid))
+func parseEndpoint(infracontainerid, value string) *Endpoint {
+	e := &Endpoint{}
+	if err := json.Unmarshal([]byte(value), e); err != nil {
+		e = &Endpoint{Ip: value}
+	}
+	e.ContainerID = infracontainerid
+	return e
+}
+
+// GetEndpointFromStore returns the IP of interface ifname of the infra
+// container, empty when none is recorded. A record without interface
+// predates multi-interface pods and stands for any interface.
+func GetEndpointFromStore(infracontainerid, ifname string) (string, error) {
+	id := EndpointID(infracontainerid, ifname)
+	value, err := db.GetKey(filepath.Join(pod_key_prefix, id))
+	if etcdclient.IsKeyNotFound(err) && id != infracontainerid {
+		value, err = db.GetKey(filepath.Join(pod_key_prefix, infracontainerid))
+		if e := parseEndpoint(infracontainerid, value); err == nil && e.Interface != "" {
+			log.Infof("endpoint not found %s, %s is of interface %s", id, infracontainerid, e.Interface)
+			return "", nil
+		}
+	}
+	if etcdclient.IsKeyNotFound(err) {
+		log.Infof("endpoint not found %s", id)
+		return "", nil
+	}
 	if err != nil {
-		log.Infof("endpoint not found %s", infracontainerid)
-		return "", false
+		return "", err
+	}
+	return parseEndpoint(id, value).Ip, nil
+}
+
+func ListEndpoints() ([]*Endpoint, error) {
+	if !db.IsKeyExist(pod_key_prefix) {
+		return nil, nil
+	}
+	nodes, err := db.GetKeys(pod_key_prefix)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	for _, node := range nodes {
+		endpoints = append(endpoints, parseEndpoint(filepath.Base(node.Key), node.Value))
+	}
+	return endpoints, nil
+}
+
+// ReleaseEndpoint releases the IP of a pod that is gone on whatever host it
+// was assigned, and drops the record. The IP stays assigned when it went to
+// another container meanwhile.
+func ReleaseEndpoint(e *Endpoint) error {
+	if e.Ipnet == "" || e.Hostname == "" {
+		return fmt.Errorf("endpoint %s does not record its network", e.ContainerID)
+	}
+	value, err := db.GetKey(filepath.Join(network_key_prefix, e.Ipnet, "assigned", e.Hostname, e.Ip))
+	if err == nil && value == e.ContainerID {
+		if err = releaseIP(e.Ipnet, e.Hostname, e.Ip); err != nil {
+			return err
+		}
 	}
-	return ip, true
+	return DeleteEndpointFromStore(e.ContainerID)
 }
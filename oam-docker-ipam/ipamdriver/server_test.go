@@ -0,0 +1,97 @@
+package ipamdriver
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeAllocator serves a pool from memory, the addresses of used answer
+// probes
+type fakeAllocator struct {
+	pool        []string
+	used        map[string]string
+	locked      bool
+	probed      []string
+	quarantined map[string]string
+}
+
+func (f *fakeAllocator) allocator() *allocator {
+	return &allocator{
+		reserve: func(ip string) (string, error) {
+			f.locked = true
+			defer func() { f.locked = false }()
+			for i, p := range f.pool {
+				if ip == "" || p == ip {
+					f.pool = append(f.pool[:i], f.pool[i+1:]...)
+					return p, nil
+				}
+			}
+			return ip, errors.New("No free IP in pool")
+		},
+		probe: func(ip string) (net.HardwareAddr, error) {
+			if f.locked {
+				return nil, errors.New("probed holding the lock")
+			}
+			f.probed = append(f.probed, ip)
+			if mac, ok := f.used[ip]; ok {
+				return net.ParseMAC(mac)
+			}
+			return nil, nil
+		},
+		quarantine: func(ip, mac string) error {
+			f.quarantined[ip] = mac
+			return nil
+		},
+	}
+}
+
+func TestAllocateSkipsAddressesInUse(t *testing.T) {
+	f := &fakeAllocator{
+		pool:        []string{"10.0.2.10", "10.0.2.11", "10.0.2.12"},
+		used:        map[string]string{"10.0.2.10": "02:42:0a:00:02:0a", "10.0.2.11": "02:42:0a:00:02:0b"},
+		quarantined: map[string]string{},
+	}
+	ip, err := f.allocator().allocate("")
+	if err != nil || ip != "10.0.2.12" {
+		t.Fatalf("got %q %v, want 10.0.2.12", ip, err)
+	}
+	if want := []string{"10.0.2.10", "10.0.2.11", "10.0.2.12"}; !reflect.DeepEqual(f.probed, want) {
+		t.Errorf("got probes %v, want %v", f.probed, want)
+	}
+	if want := map[string]string{"10.0.2.10": "02:42:0a:00:02:0a", "10.0.2.11": "02:42:0a:00:02:0b"}; !reflect.DeepEqual(f.quarantined, want) {
+		t.Errorf("got quarantined %v, want %v", f.quarantined, want)
+	}
+	if len(f.pool) != 0 {
+		t.Errorf("got pool %v, want it empty", f.pool)
+	}
+
+	// the pool is used up by stations unknown to skylark
+	f.pool = []string{"10.0.2.13"}
+	f.used["10.0.2.13"] = "02:42:0a:00:02:0d"
+	if ip, err := f.allocator().allocate(""); err == nil {
+		t.Errorf("got %s, want an error", ip)
+	}
+	if _, ok := f.quarantined["10.0.2.13"]; !ok {
+		t.Error("10.0.2.13 was not quarantined")
+	}
+}
+
+func TestAllocateRequestedAddressInUse(t *testing.T) {
+	f := &fakeAllocator{
+		pool:        []string{"10.0.2.10", "10.0.2.11"},
+		used:        map[string]string{"10.0.2.11": "02:42:0a:00:02:0b"},
+		quarantined: map[string]string{},
+	}
+	if ip, err := f.allocator().allocate("10.0.2.11"); err == nil {
+		t.Errorf("got %s, want an error", ip)
+	}
+	if _, ok := f.quarantined["10.0.2.11"]; !ok || len(f.probed) != 1 {
+		t.Errorf("got probes %v and quarantined %v, want 10.0.2.11 quarantined", f.probed, f.quarantined)
+	}
+	// the other addresses are left alone
+	if ip, err := f.allocator().allocate("10.0.2.10"); err != nil || ip != "10.0.2.10" {
+		t.Errorf("got %q %v, want 10.0.2.10", ip, err)
+	}
+}
@@ -0,0 +1,171 @@
+package k8s
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+const (
+	// AnnotationIP requests a static IP for the pod
+	AnnotationIP = "skylark.io/ip"
+	// AnnotationPool names the skylark pool to allocate from, it may be set
+	// on the namespace too
+	AnnotationPool = "skylark.io/pool"
+	// AnnotationIngressBandwidth and AnnotationEgressBandwidth limit the
+	// traffic of the pod in bits per second, e.g. 10M. They may be set on
+	// the namespace too.
+	AnnotationIngressBandwidth = "skylark.io/ingress-bandwidth"
+	AnnotationEgressBandwidth  = "skylark.io/egress-bandwidth"
+	// the standard bandwidth annotations of pods, the skylark.io ones of the
+	// pod win over them
+	AnnotationK8sIngressBandwidth = "kubernetes.io/ingress-bandwidth"
+	AnnotationK8sEgressBandwidth  = "kubernetes.io/egress-bandwidth"
+)
+
+// PodNetwork is what the annotations ask of the network of a pod
+type PodNetwork struct {
+	IP   string
+	Pool string
+	// IngressBandwidth and EgressBandwidth are in bits per second, 0 is
+	// unlimited
+	IngressBandwidth uint64
+	EgressBandwidth  uint64
+	// StatefulSet is set for pods of a StatefulSet, their IP is kept for them
+	// across restarts
+	StatefulSet bool
+	// the labels pools select the pod by
+	NamespaceLabels map[string]string
+	PodLabels       map[string]string
+	NodeLabels      map[string]string
+}
+
+// GetPodNetwork reads the annotations of the pod and its namespace, those of
+// the pod win, and the labels of the pod, its namespace and its node. A
+// missing namespace or node is not an error.
+func (c *Client) GetPodNetwork(namespace, name string) (*PodNetwork, error) {
+	pod, err := c.GetPod(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{}
+	var ns_labels, node_labels map[string]string
+	ns, err := c.GetNamespace(namespace)
+	switch {
+	case err == nil:
+		ns_labels = ns.Metadata.Labels
+		for _, key := range []string{AnnotationPool, AnnotationIngressBandwidth, AnnotationEgressBandwidth} {
+			if value, ok := ns.Metadata.Annotations[key]; ok {
+				annotations[key] = value
+			}
+		}
+	case err != ErrNotFound:
+		return nil, err
+	}
+	for key, value := range pod.Metadata.Annotations {
+		annotations[key] = value
+	}
+	for k8s_key, key := range map[string]string{
+		AnnotationK8sIngressBandwidth: AnnotationIngressBandwidth,
+		AnnotationK8sEgressBandwidth:  AnnotationEgressBandwidth,
+	} {
+		value, ok := pod.Metadata.Annotations[k8s_key]
+		if _, set := pod.Metadata.Annotations[key]; ok && !set {
+			annotations[key] = value
+		}
+	}
+	pn, err := parsePodNetwork(annotations)
+	if err != nil {
+		return nil, err
+	}
+	if pod.Spec.NodeName != "" {
+		node, err := c.GetNode(pod.Spec.NodeName)
+		switch {
+		case err == nil:
+			node_labels = node.Metadata.Labels
+		case err != ErrNotFound:
+			return nil, err
+		}
+	}
+	pn.StatefulSet = pod.Metadata.ControlledBy("StatefulSet") != nil
+	pn.NamespaceLabels = ns_labels
+	pn.PodLabels = pod.Metadata.Labels
+	pn.NodeLabels = node_labels
+	return pn, nil
+}
+
+func parsePodNetwork(annotations map[string]string) (*PodNetwork, error) {
+	pn := &PodNetwork{
+		IP:   strings.TrimSpace(annotations[AnnotationIP]),
+		Pool: strings.TrimSpace(annotations[AnnotationPool]),
+	}
+	if pn.IP != "" && net.ParseIP(pn.IP).To4() == nil {
+		return nil, fmt.Errorf("invalid %s annotation %q", AnnotationIP, pn.IP)
+	}
+	var err error
+	if pn.IngressBandwidth, err = ParseBandwidth(annotations[AnnotationIngressBandwidth]); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", AnnotationIngressBandwidth, err)
+	}
+	if pn.EgressBandwidth, err = ParseBandwidth(annotations[AnnotationEgressBandwidth]); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", AnnotationEgressBandwidth, err)
+	}
+	return pn, nil
+}
+
+var bandwidth_suffixes = []struct {
+	suffix string
+	factor uint64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40}, {"Pi", 1 << 50}, {"Ei", 1 << 60},
+	{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"P", 1e15}, {"E", 1e18},
+}
+
+// ParseBandwidth parses a bandwidth in bits per second written as a
+// kubernetes quantity, e.g. 500k, 1.5M or 1Gi. The empty string is 0, a
+// fraction of a bit is rounded up.
+func ParseBandwidth(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	number, factor := s, uint64(1)
+	for _, b := range bandwidth_suffixes {
+		if strings.HasSuffix(s, b.suffix) {
+			number, factor = strings.TrimSuffix(s, b.suffix), b.factor
+			break
+		}
+	}
+	if !isDecimal(number) {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	value, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	value.Mul(value, new(big.Rat).SetInt(new(big.Int).SetUint64(factor)))
+	bits := new(big.Int).Quo(value.Num(), value.Denom())
+	if !value.IsInt() {
+		bits.Add(bits, big.NewInt(1))
+	}
+	if !bits.IsUint64() {
+		return 0, fmt.Errorf("bandwidth %q is too large", s)
+	}
+	return bits.Uint64(), nil
+}
+
+// isDecimal tells whether s is digits with at most one decimal point
+func isDecimal(s string) bool {
+	digits, point := 0, false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.' && !point:
+			point = true
+		default:
+			return false
+		}
+	}
+	return digits != 0
+}
@@ -0,0 +1,378 @@
+// Package k8s is a minimal client of the kubernetes API, it reads the pods and
+// namespaces skylark needs without pulling in client-go.
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	service_account_dir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	request_timeout     = 10 * time.Second
+	// watch_timeout asks the server to end watches after that many seconds,
+	// so dead connections do not go unnoticed
+	watch_timeout = 300
+)
+
+// ErrNotFound is returned when the object does not exist
+var ErrNotFound = errors.New("not found")
+
+// Config tells how to reach the API server. Empty fields default to the
+// in-cluster service account.
+type Config struct {
+	APIServer string `json:"apiServer"`
+	TokenFile string `json:"tokenFile"`
+	CAFile    string `json:"caFile"`
+	// Insecure skips the verification of the API server certificate
+	Insecure bool `json:"insecure"`
+}
+
+type OwnerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	Controller bool   `json:"controller,omitempty"`
+}
+
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	// CreationTimestamp is RFC 3339 in UTC, so it sorts as a string
+	CreationTimestamp string            `json:"creationTimestamp,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	OwnerReferences   []OwnerReference  `json:"ownerReferences,omitempty"`
+}
+
+// ControlledBy returns the controller of the object of kind, or nil
+func (m *ObjectMeta) ControlledBy(kind string) *OwnerReference {
+	for i := range m.OwnerReferences {
+		if m.OwnerReferences[i].Controller && m.OwnerReferences[i].Kind == kind {
+			return &m.OwnerReferences[i]
+		}
+	}
+	return nil
+}
+
+type PodSpec struct {
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+type PodStatus struct {
+	Phase string `json:"phase,omitempty"`
+	PodIP string `json:"podIP,omitempty"`
+}
+
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+	Status   PodStatus  `json:"status"`
+}
+
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type PodList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []Pod    `json:"items"`
+}
+
+type Namespace struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+type NamespaceList struct {
+	Metadata ListMeta    `json:"metadata"`
+	Items    []Namespace `json:"items"`
+}
+
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+// Watch event types
+const (
+	Added    = "ADDED"
+	Modified = "MODIFIED"
+	Deleted  = "DELETED"
+)
+
+type PodEvent struct {
+	Type   string `json:"type"`
+	Object Pod    `json:"object"`
+}
+
+type NamespaceEvent struct {
+	Type   string    `json:"type"`
+	Object Namespace `json:"object"`
+}
+
+// Interface is what skylark reads from the API server, FakeClient stands in
+// for Client in tests
+type Interface interface {
+	GetPod(namespace, name string) (*Pod, error)
+	GetNamespace(name string) (*Namespace, error)
+	GetNode(name string) (*Node, error)
+	// ListPods lists the pods of all namespaces
+	ListPods() (*PodList, error)
+	// WatchPods streams the pod changes after resourceVersion until stop is
+	// closed or the server ends the watch, then the channel is closed
+	WatchPods(resourceVersion string, stop <-chan struct{}) (<-chan PodEvent, error)
+	ListNamespaces() (*NamespaceList, error)
+	WatchNamespaces(resourceVersion string, stop <-chan struct{}) (<-chan NamespaceEvent, error)
+	// ListNetworkPolicies lists the network policies of all namespaces
+	ListNetworkPolicies() (*NetworkPolicyList, error)
+	WatchNetworkPolicies(resourceVersion string, stop <-chan struct{}) (<-chan NetworkPolicyEvent, error)
+	ListIPPools() (*IPPoolList, error)
+	UpdateIPPoolStatus(pool *IPPool) (*IPPool, error)
+}
+
+// Client talks to one API server
+type Client struct {
+	host   string
+	token  string
+	client *http.Client
+	// watches run longer than the request timeout
+	watch_client *http.Client
+}
+
+// NewClient creates a client from config, nil means in-cluster
+func NewClient(config *Config) (*Client, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	host := config.APIServer
+	if host == "" {
+		service_host, service_port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if service_host == "" || service_port == "" {
+			return nil, errors.New("no apiServer configured and not running in a cluster")
+		}
+		host = "https://" + net.JoinHostPort(service_host, service_port)
+	}
+	c := &Client{host: strings.TrimRight(host, "/")}
+
+	token_file := config.TokenFile
+	if token_file == "" && config.APIServer == "" {
+		token_file = service_account_dir + "/token"
+	}
+	if token_file != "" {
+		token, err := ioutil.ReadFile(token_file)
+		if err != nil {
+			return nil, err
+		}
+		c.token = strings.TrimSpace(string(token))
+	}
+
+	tls_config := &tls.Config{InsecureSkipVerify: config.Insecure}
+	ca_file := config.CAFile
+	if ca_file == "" && config.APIServer == "" {
+		ca_file = service_account_dir + "/ca.crt"
+	}
+	if ca_file != "" && !config.Insecure {
+		ca, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", ca_file)
+		}
+		tls_config.RootCAs = pool
+	}
+	transport := &http.Transport{TLSClientConfig: tls_config}
+	c.client = &http.Client{Transport: transport, Timeout: request_timeout}
+	c.watch_client = &http.Client{Transport: transport}
+	return c, nil
+}
+
+func (c *Client) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends in as the body when not nil and decodes the response into out
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		in_bytes, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(in_bytes)
+	}
+	req, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	rsp_body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusCreated:
+		return fmt.Errorf("%s %s: %s %s", method, path, rsp.Status, strings.TrimSpace(string(rsp_body)))
+	}
+	return json.Unmarshal(rsp_body, out)
+}
+
+func (c *Client) get(path string, v interface{}) error {
+	return c.do("GET", path, nil, v)
+}
+
+func (c *Client) GetPod(namespace, name string) (*Pod, error) {
+	pod := &Pod{}
+	if err := c.get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+func (c *Client) GetNamespace(name string) (*Namespace, error) {
+	ns := &Namespace{}
+	if err := c.get(fmt.Sprintf("/api/v1/namespaces/%s", name), ns); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (c *Client) GetNode(name string) (*Node, error) {
+	node := &Node{}
+	if err := c.get(fmt.Sprintf("/api/v1/nodes/%s", name), node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (c *Client) ListPods() (*PodList, error) {
+	pods := &PodList{}
+	if err := c.get("/api/v1/pods", pods); err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+func (c *Client) ListNamespaces() (*NamespaceList, error) {
+	namespaces := &NamespaceList{}
+	if err := c.get("/api/v1/namespaces", namespaces); err != nil {
+		return nil, err
+	}
+	return namespaces, nil
+}
+
+// errWatchStopped ends the decoding of a watch whose stop channel closed
+var errWatchStopped = errors.New("watch stopped")
+
+// watch decodes the changes of the list at path after resourceVersion with
+// decode until it fails, stop is closed or the server ends the watch, then
+// done is called
+func (c *Client) watch(path, resourceVersion string, stop <-chan struct{}, decode func(*json.Decoder) error, done func()) error {
+	url := fmt.Sprintf("%s?watch=true&timeoutSeconds=%d", path, watch_timeout)
+	if resourceVersion != "" {
+		url += "&resourceVersion=" + resourceVersion
+	}
+	req, err := c.request("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	cancel := make(chan struct{})
+	req.Cancel = cancel
+	rsp, err := c.watch_client.Do(req)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return fmt.Errorf("watch %s: %s %s", path, rsp.Status, strings.TrimSpace(string(body)))
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			close(cancel)
+		case <-finished:
+		}
+	}()
+	go func() {
+		defer done()
+		defer close(finished)
+		defer rsp.Body.Close()
+		decoder := json.NewDecoder(rsp.Body)
+		for decode(decoder) == nil {
+		}
+	}()
+	return nil
+}
+
+func (c *Client) WatchPods(resourceVersion string, stop <-chan struct{}) (<-chan PodEvent, error) {
+	events := make(chan PodEvent)
+	err := c.watch("/api/v1/pods", resourceVersion, stop, func(decoder *json.Decoder) error {
+		var event PodEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		select {
+		case events <- event:
+			return nil
+		case <-stop:
+			return errWatchStopped
+		}
+	}, func() { close(events) })
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (c *Client) WatchNamespaces(resourceVersion string, stop <-chan struct{}) (<-chan NamespaceEvent, error) {
+	events := make(chan NamespaceEvent)
+	err := c.watch("/api/v1/namespaces", resourceVersion, stop, func(decoder *json.Decoder) error {
+		var event NamespaceEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		select {
+		case events <- event:
+			return nil
+		case <-stop:
+			return errWatchStopped
+		}
+	}, func() { close(events) })
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,195 @@
+package k8s
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*FakeServer, *Client) {
+	s := NewFakeServer()
+	s.AddNamespace(&Namespace{Metadata: ObjectMeta{
+		Name:   "db",
+		Labels: map[string]string{"team": "storage"},
+		Annotations: map[string]string{
+			AnnotationPool:             "storage",
+			AnnotationEgressBandwidth:  "20M",
+			AnnotationIngressBandwidth: "1Gi",
+			AnnotationIP:               "10.0.2.9",
+		},
+	}})
+	s.AddPod(&Pod{Metadata: ObjectMeta{
+		Name:        "mysql-0",
+		Namespace:   "db",
+		Labels:      map[string]string{"app": "mysql"},
+		Annotations: map[string]string{AnnotationIP: "10.0.3.20", AnnotationEgressBandwidth: "500k"},
+		OwnerReferences: []OwnerReference{
+			{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "mysql", Controller: true},
+		},
+	}, Spec: PodSpec{NodeName: "node-1"}})
+	s.AddNode(&Node{Metadata: ObjectMeta{Name: "node-1", Labels: map[string]string{"zone": "a"}}})
+	s.AddPod(&Pod{Metadata: ObjectMeta{Name: "web", Namespace: "default"}})
+	c, err := NewClient(s.Config())
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func TestGetPodNetwork(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	pn, err := c.GetPodNetwork("db", "mysql-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PodNetwork{
+		IP:               "10.0.3.20",
+		Pool:             "storage",
+		IngressBandwidth: 1 << 30,
+		EgressBandwidth:  500e3,
+		StatefulSet:      true,
+		NamespaceLabels:  map[string]string{"team": "storage"},
+		PodLabels:        map[string]string{"app": "mysql"},
+		NodeLabels:       map[string]string{"zone": "a"},
+	}
+	if !reflect.DeepEqual(*pn, want) {
+		t.Errorf("got %+v, want %+v", *pn, want)
+	}
+
+	// the kubernetes.io annotations of the pod win over the namespace, its
+	// skylark.io ones over them
+	s.AddPod(&Pod{Metadata: ObjectMeta{
+		Name:        "backup",
+		Namespace:   "db",
+		Annotations: map[string]string{AnnotationK8sIngressBandwidth: "100M", AnnotationK8sEgressBandwidth: "1M", AnnotationEgressBandwidth: "2M"},
+	}})
+	pn, err = c.GetPodNetwork("db", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pn.IngressBandwidth != 100e6 || pn.EgressBandwidth != 2e6 {
+		t.Errorf("got bandwidth %d/%d, want 100M/2M", pn.IngressBandwidth, pn.EgressBandwidth)
+	}
+
+	// the namespace of the pod does not exist
+	pn, err = c.GetPodNetwork("default", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*pn, PodNetwork{}) {
+		t.Errorf("got %+v, want no annotations", *pn)
+	}
+
+	if _, err = c.GetPodNetwork("db", "mysql-1"); err != ErrNotFound {
+		t.Errorf("got %v for a missing pod, want ErrNotFound", err)
+	}
+}
+
+func TestInvalidAnnotations(t *testing.T) {
+	for _, annotations := range []map[string]string{
+		{AnnotationIP: "10.0.3"},
+		{AnnotationIP: "fe80::1"},
+		{AnnotationIngressBandwidth: "fast"},
+		{AnnotationEgressBandwidth: "-1M"},
+	} {
+		if _, err := parsePodNetwork(annotations); err == nil {
+			t.Errorf("%v: expected an error", annotations)
+		}
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"":     0,
+		"100":  100,
+		"500k": 500e3,
+		"10M":  10e6,
+		"2G":   2e9,
+		"1Mi":  1 << 20,
+		"1.5M": 1500e3,
+		"0.1G": 100e6,
+		".5k":  500,
+		"2.5":  3,
+		"1.5E": 1500e15,
+		"15Ei": 15 << 60,
+		// the largest bandwidth there is
+		"18446744073709551615": 18446744073709551615,
+	} {
+		got, err := ParseBandwidth(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %d, want %d", s, got, want)
+		}
+	}
+
+	for _, s := range []string{
+		"fast", "M", "-1M", "+1M", "1e3", "1/2", "1.2.3", "10 M", "10m",
+		// overflows
+		"16Ei", "18446744073709551616", "18446744073709551.616k", "20000000T",
+	} {
+		if got, err := ParseBandwidth(s); err == nil {
+			t.Errorf("%q: got %d, want an error", s, got)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	s := NewFakeServer()
+	defer s.Close()
+	f, err := ioutil.TempFile("", "skylark-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+
+	config := s.Config()
+	config.TokenFile = f.Name()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.token != "secret" {
+		t.Errorf("got token %q", c.token)
+	}
+}
+
+func TestListAndWatchPods(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	pods, err := c.ListPods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 2 || pods.Items[0].Metadata.Name != "mysql-0" {
+		t.Fatalf("got pods %+v", pods.Items)
+	}
+
+	stop := make(chan struct{})
+	events, err := c.WatchPods(pods.Metadata.ResourceVersion, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DeletePod("db", "mysql-0")
+	select {
+	case event := <-events:
+		if event.Type != Deleted || event.Object.Metadata.Name != "mysql-0" {
+			t.Errorf("got event %s %s", event.Type, event.Object.Metadata.Name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	close(stop)
+	for range events {
+	}
+}
@@ -0,0 +1,443 @@
+package k8s
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeClient keeps pods, namespaces, nodes, IPPools and network policies in
+// memory, it stands in for Client in tests. Changes of pods, namespaces and
+// network policies are streamed to the running watches.
+type FakeClient struct {
+	mu                sync.Mutex
+	pods              map[string]*Pod
+	namespaces        map[string]*Namespace
+	nodes             map[string]*Node
+	ippools           map[string]*IPPool
+	policies          map[string]*NetworkPolicy
+	resourceVersion   int
+	watchers          map[chan PodEvent]struct{}
+	namespaceWatchers map[chan NamespaceEvent]struct{}
+	policyWatchers    map[chan NetworkPolicyEvent]struct{}
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		pods:              map[string]*Pod{},
+		namespaces:        map[string]*Namespace{},
+		nodes:             map[string]*Node{},
+		ippools:           map[string]*IPPool{},
+		policies:          map[string]*NetworkPolicy{},
+		watchers:          map[chan PodEvent]struct{}{},
+		namespaceWatchers: map[chan NamespaceEvent]struct{}{},
+		policyWatchers:    map[chan NetworkPolicyEvent]struct{}{},
+	}
+}
+
+// AddPod creates or updates pod
+func (f *FakeClient) AddPod(pod *Pod) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	event := Added
+	if _, ok := f.pods[key]; ok {
+		event = Modified
+	}
+	f.resourceVersion++
+	pod.Metadata.ResourceVersion = strconv.Itoa(f.resourceVersion)
+	f.pods[key] = pod
+	f.notify(event, pod)
+}
+
+func (f *FakeClient) DeletePod(namespace, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := namespace + "/" + name
+	pod, ok := f.pods[key]
+	if !ok {
+		return
+	}
+	delete(f.pods, key)
+	f.resourceVersion++
+	f.notify(Deleted, pod)
+}
+
+// AddNamespace creates or updates ns
+func (f *FakeClient) AddNamespace(ns *Namespace) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event := Added
+	if _, ok := f.namespaces[ns.Metadata.Name]; ok {
+		event = Modified
+	}
+	f.resourceVersion++
+	ns.Metadata.ResourceVersion = strconv.Itoa(f.resourceVersion)
+	f.namespaces[ns.Metadata.Name] = ns
+	for watcher := range f.namespaceWatchers {
+		watcher <- NamespaceEvent{Type: event, Object: *ns}
+	}
+}
+
+// AddNetworkPolicy creates or updates policy
+func (f *FakeClient) AddNetworkPolicy(policy *NetworkPolicy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := policy.Metadata.Namespace + "/" + policy.Metadata.Name
+	event := Added
+	if _, ok := f.policies[key]; ok {
+		event = Modified
+	}
+	f.resourceVersion++
+	policy.Metadata.ResourceVersion = strconv.Itoa(f.resourceVersion)
+	f.policies[key] = policy
+	f.notifyPolicy(event, policy)
+}
+
+func (f *FakeClient) DeleteNetworkPolicy(namespace, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := namespace + "/" + name
+	policy, ok := f.policies[key]
+	if !ok {
+		return
+	}
+	delete(f.policies, key)
+	f.resourceVersion++
+	f.notifyPolicy(Deleted, policy)
+}
+
+// notifyPolicy is called with the lock held
+func (f *FakeClient) notifyPolicy(event string, policy *NetworkPolicy) {
+	for watcher := range f.policyWatchers {
+		watcher <- NetworkPolicyEvent{Type: event, Object: *policy}
+	}
+}
+
+func (f *FakeClient) AddNode(node *Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[node.Metadata.Name] = node
+}
+
+// AddIPPool creates or updates pool
+func (f *FakeClient) AddIPPool(pool *IPPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ippools[pool.Metadata.Name] = pool
+}
+
+func (f *FakeClient) DeleteIPPool(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.ippools, name)
+}
+
+func (f *FakeClient) GetIPPool(name string) (*IPPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pool, ok := f.ippools[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	p := *pool
+	return &p, nil
+}
+
+// notify is called with the lock held
+func (f *FakeClient) notify(event string, pod *Pod) {
+	for watcher := range f.watchers {
+		watcher <- PodEvent{Type: event, Object: *pod}
+	}
+}
+
+func (f *FakeClient) GetPod(namespace, name string) (*Pod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pod, ok := f.pods[namespace+"/"+name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	p := *pod
+	return &p, nil
+}
+
+func (f *FakeClient) GetNamespace(name string) (*Namespace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	n := *ns
+	return &n, nil
+}
+
+func (f *FakeClient) GetNode(name string) (*Node, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	n := *node
+	return &n, nil
+}
+
+func (f *FakeClient) ListPods() (*PodList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := &PodList{Metadata: ListMeta{ResourceVersion: strconv.Itoa(f.resourceVersion)}}
+	var keys []string
+	for key := range f.pods {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		list.Items = append(list.Items, *f.pods[key])
+	}
+	return list, nil
+}
+
+func (f *FakeClient) ListNamespaces() (*NamespaceList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := &NamespaceList{Metadata: ListMeta{ResourceVersion: strconv.Itoa(f.resourceVersion)}}
+	var names []string
+	for name := range f.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list.Items = append(list.Items, *f.namespaces[name])
+	}
+	return list, nil
+}
+
+func (f *FakeClient) ListNetworkPolicies() (*NetworkPolicyList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := &NetworkPolicyList{Metadata: ListMeta{ResourceVersion: strconv.Itoa(f.resourceVersion)}}
+	var keys []string
+	for key := range f.policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		list.Items = append(list.Items, *f.policies[key])
+	}
+	return list, nil
+}
+
+func (f *FakeClient) ListIPPools() (*IPPoolList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := &IPPoolList{}
+	var names []string
+	for name := range f.ippools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list.Items = append(list.Items, *f.ippools[name])
+	}
+	return list, nil
+}
+
+// UpdateIPPoolStatus only changes the status, like the status subresource
+func (f *FakeClient) UpdateIPPoolStatus(pool *IPPool) (*IPPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored, ok := f.ippools[pool.Metadata.Name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := *stored
+	updated.Status = pool.Status
+	f.ippools[pool.Metadata.Name] = &updated
+	p := updated
+	return &p, nil
+}
+
+// WaitForWatches waits until n watches of pods, namespaces or network
+// policies run, it tells whether they did before timeout
+func (f *FakeClient) WaitForWatches(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		f.mu.Lock()
+		running := len(f.watchers) + len(f.namespaceWatchers) + len(f.policyWatchers)
+		f.mu.Unlock()
+		if running >= n {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// WatchPods streams the changes made after the call, resourceVersion is
+// ignored. Events are buffered so changes do not block on slow watchers.
+func (f *FakeClient) WatchPods(resourceVersion string, stop <-chan struct{}) (<-chan PodEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	watcher := make(chan PodEvent, 100)
+	f.watchers[watcher] = struct{}{}
+	go func() {
+		<-stop
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.watchers, watcher)
+		close(watcher)
+	}()
+	return watcher, nil
+}
+
+func (f *FakeClient) WatchNamespaces(resourceVersion string, stop <-chan struct{}) (<-chan NamespaceEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	watcher := make(chan NamespaceEvent, 100)
+	f.namespaceWatchers[watcher] = struct{}{}
+	go func() {
+		<-stop
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.namespaceWatchers, watcher)
+		close(watcher)
+	}()
+	return watcher, nil
+}
+
+func (f *FakeClient) WatchNetworkPolicies(resourceVersion string, stop <-chan struct{}) (<-chan NetworkPolicyEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	watcher := make(chan NetworkPolicyEvent, 100)
+	f.policyWatchers[watcher] = struct{}{}
+	go func() {
+		<-stop
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.policyWatchers, watcher)
+		close(watcher)
+	}()
+	return watcher, nil
+}
+
+// FakeServer serves a FakeClient over HTTP like the API server does, for
+// tests of Client. Only pods are watched over HTTP.
+type FakeServer struct {
+	*httptest.Server
+	*FakeClient
+}
+
+func NewFakeServer() *FakeServer {
+	s := &FakeServer{FakeClient: NewFakeClient()}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Config returns the config of a client of the server
+func (s *FakeServer) Config() *Config {
+	return &Config{APIServer: s.URL}
+}
+
+func (s *FakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	ippools := "/apis/" + IPPoolGroupVersion + "/ippools"
+	if strings.HasPrefix(r.URL.Path, ippools) {
+		s.serveIPPools(w, r, strings.TrimPrefix(r.URL.Path, ippools))
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/apis/"+NetworkPolicyGroupVersion+"/networkpolicies" && r.URL.Query().Get("watch") != "true" {
+		obj, err := s.ListNetworkPolicies()
+		writeJSON(w, obj, err)
+		return
+	}
+	// pods, namespaces, nodes/<name>, namespaces/<ns> or
+	// namespaces/<ns>/pods/<name>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	var obj interface{}
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "pods" && r.URL.Query().Get("watch") == "true":
+		s.serveWatch(w, r)
+		return
+	case len(parts) == 1 && parts[0] == "pods":
+		obj, err = s.ListPods()
+	case len(parts) == 1 && parts[0] == "namespaces" && r.URL.Query().Get("watch") != "true":
+		obj, err = s.ListNamespaces()
+	case len(parts) == 2 && parts[0] == "nodes":
+		obj, err = s.GetNode(parts[1])
+	case len(parts) == 2 && parts[0] == "namespaces":
+		obj, err = s.GetNamespace(parts[1])
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "pods":
+		obj, err = s.GetPod(parts[1], parts[3])
+	default:
+		err = ErrNotFound
+	}
+	writeJSON(w, obj, err)
+}
+
+// serveIPPools serves the list and /<name>/status updates
+func (s *FakeServer) serveIPPools(w http.ResponseWriter, r *http.Request, path string) {
+	var obj interface{}
+	var err error
+	switch {
+	case r.Method == "GET" && path == "":
+		obj, err = s.ListIPPools()
+	case r.Method == "PUT" && strings.HasSuffix(path, "/status"):
+		pool := &IPPool{}
+		if err := json.NewDecoder(r.Body).Decode(pool); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj, err = s.UpdateIPPoolStatus(pool)
+	default:
+		err = ErrNotFound
+	}
+	writeJSON(w, obj, err)
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}, err error) {
+	if err != nil {
+		http.Error(w, `{"kind":"Status","status":"Failure","reason":"NotFound","code":404}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (s *FakeServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	stop := make(chan struct{})
+	defer close(stop)
+	events, _ := s.WatchPods(r.URL.Query().Get("resourceVersion"), stop)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-events:
+			if encoder.Encode(event) != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package k8s
+
+import "fmt"
+
+// IPPoolGroupVersion is the API group of the skylark custom resources
+const IPPoolGroupVersion = "skylark.io/v1"
+
+// LabelSelector selects the objects having all of MatchLabels and meeting
+// all of MatchExpressions, an empty selector selects everything
+type LabelSelector struct {
+	MatchLabels      map[string]string          `json:"matchLabels,omitempty"`
+	MatchExpressions []LabelSelectorRequirement `json:"matchExpressions,omitempty"`
+}
+
+// LabelSelectorRequirement is met by the labels with Key for the operator
+// Exists, without it for DoesNotExist, with one of Values for In and
+// without any of Values for NotIn
+type LabelSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (r *LabelSelectorRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case "Exists":
+		return ok
+	case "DoesNotExist":
+		return !ok
+	case "In", "NotIn":
+		in := false
+		for _, v := range r.Values {
+			if ok && v == value {
+				in = true
+			}
+		}
+		return in == (r.Operator == "In")
+	}
+	// an unknown operator selects nothing
+	return false
+}
+
+func (s *LabelSelector) Matches(labels map[string]string) bool {
+	if s == nil {
+		return true
+	}
+	for key, value := range s.MatchLabels {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	for i := range s.MatchExpressions {
+		if !s.MatchExpressions[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Bandwidth is the default limit of the pods of a pool, e.g. 10M
+type Bandwidth struct {
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+}
+
+// Route is a static route of the pods, through the gateway of the pool when
+// Gateway is empty
+type Route struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+type DNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type IPPoolSpec struct {
+	// CIDR is the subnet of the pool, e.g. 10.0.2.0/24
+	CIDR string `json:"cidr"`
+	// RangeStart and RangeEnd bound the addresses handed out, they default
+	// to the first and last host address of the subnet
+	RangeStart        string         `json:"rangeStart,omitempty"`
+	RangeEnd          string         `json:"rangeEnd,omitempty"`
+	Gateway           string         `json:"gateway,omitempty"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *LabelSelector `json:"podSelector,omitempty"`
+	NodeSelector      *LabelSelector `json:"nodeSelector,omitempty"`
+	// ContainerSelector matches the labels of the docker infra container of
+	// the pod
+	ContainerSelector *LabelSelector `json:"containerSelector,omitempty"`
+	Bandwidth         *Bandwidth     `json:"bandwidth,omitempty"`
+	Routes            []Route        `json:"routes,omitempty"`
+	DNS               *DNS           `json:"dns,omitempty"`
+	// SkipDefaultRoute leaves the default route of the pods to another
+	// interface
+	SkipDefaultRoute bool `json:"skipDefaultRoute,omitempty"`
+}
+
+type IPPoolStatus struct {
+	Synced    bool   `json:"synced"`
+	Message   string `json:"message,omitempty"`
+	Total     int    `json:"total"`
+	Allocated int    `json:"allocated"`
+	Free      int    `json:"free"`
+	// LastUpdateTime is when the counts last changed
+	LastUpdateTime string `json:"lastUpdateTime,omitempty"`
+}
+
+// IPPool is a cluster scoped custom resource declaring a skylark pool
+type IPPool struct {
+	APIVersion string       `json:"apiVersion,omitempty"`
+	Kind       string       `json:"kind,omitempty"`
+	Metadata   ObjectMeta   `json:"metadata"`
+	Spec       IPPoolSpec   `json:"spec"`
+	Status     IPPoolStatus `json:"status"`
+}
+
+type IPPoolList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []IPPool `json:"items"`
+}
+
+// ListIPPools returns ErrNotFound when the IPPool resource is not installed
+func (c *Client) ListIPPools() (*IPPoolList, error) {
+	pools := &IPPoolList{}
+	if err := c.get(fmt.Sprintf("/apis/%s/ippools", IPPoolGroupVersion), pools); err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+func (c *Client) UpdateIPPoolStatus(pool *IPPool) (*IPPool, error) {
+	pool.APIVersion, pool.Kind = IPPoolGroupVersion, "IPPool"
+	updated := &IPPool{}
+	path := fmt.Sprintf("/apis/%s/ippools/%s/status", IPPoolGroupVersion, pool.Metadata.Name)
+	if err := c.do("PUT", path, pool, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
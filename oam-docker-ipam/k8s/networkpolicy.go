@@ -0,0 +1,135 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// NetworkPolicyGroupVersion is the API group of the network policies
+const NetworkPolicyGroupVersion = "networking.k8s.io/v1"
+
+// Policy types
+const (
+	PolicyTypeIngress = "Ingress"
+	PolicyTypeEgress  = "Egress"
+)
+
+// IntOrString is a port number or the name of a container port
+type IntOrString struct {
+	IntVal int
+	StrVal string
+}
+
+func (v *IntOrString) UnmarshalJSON(b []byte) error {
+	if len(b) != 0 && b[0] == '"' {
+		return json.Unmarshal(b, &v.StrVal)
+	}
+	return json.Unmarshal(b, &v.IntVal)
+}
+
+func (v IntOrString) MarshalJSON() ([]byte, error) {
+	if v.StrVal != "" {
+		return json.Marshal(v.StrVal)
+	}
+	return json.Marshal(v.IntVal)
+}
+
+// NetworkPolicyPort is a port, or the ports Port to EndPort, of Protocol,
+// TCP when empty. No Port means all the ports of the protocol.
+type NetworkPolicyPort struct {
+	Protocol string       `json:"protocol,omitempty"`
+	Port     *IntOrString `json:"port,omitempty"`
+	EndPort  int          `json:"endPort,omitempty"`
+}
+
+// IPBlock is the CIDR without the CIDRs of Except
+type IPBlock struct {
+	CIDR   string   `json:"cidr"`
+	Except []string `json:"except,omitempty"`
+}
+
+// NetworkPolicyPeer is the pods of PodSelector in the namespaces of
+// NamespaceSelector, the namespace of the policy when nil, or IPBlock
+type NetworkPolicyPeer struct {
+	PodSelector       *LabelSelector `json:"podSelector,omitempty"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector,omitempty"`
+	IPBlock           *IPBlock       `json:"ipBlock,omitempty"`
+}
+
+// NetworkPolicyIngressRule allows the traffic from all of From, everything
+// when empty, to all of Ports, every port when empty
+type NetworkPolicyIngressRule struct {
+	Ports []NetworkPolicyPort `json:"ports,omitempty"`
+	From  []NetworkPolicyPeer `json:"from,omitempty"`
+}
+
+type NetworkPolicyEgressRule struct {
+	Ports []NetworkPolicyPort `json:"ports,omitempty"`
+	To    []NetworkPolicyPeer `json:"to,omitempty"`
+}
+
+type NetworkPolicySpec struct {
+	PodSelector LabelSelector              `json:"podSelector"`
+	Ingress     []NetworkPolicyIngressRule `json:"ingress,omitempty"`
+	Egress      []NetworkPolicyEgressRule  `json:"egress,omitempty"`
+	PolicyTypes []string                   `json:"policyTypes,omitempty"`
+}
+
+// Isolates tells whether the policy isolates the pods it selects for the
+// policy type. Without policyTypes it isolates ingress, and egress when it
+// has egress rules.
+func (s *NetworkPolicySpec) Isolates(policyType string) bool {
+	if len(s.PolicyTypes) == 0 {
+		return policyType == PolicyTypeIngress || policyType == PolicyTypeEgress && len(s.Egress) != 0
+	}
+	for _, t := range s.PolicyTypes {
+		if t == policyType {
+			return true
+		}
+	}
+	return false
+}
+
+type NetworkPolicy struct {
+	Metadata ObjectMeta        `json:"metadata"`
+	Spec     NetworkPolicySpec `json:"spec"`
+}
+
+type NetworkPolicyList struct {
+	Metadata ListMeta        `json:"metadata"`
+	Items    []NetworkPolicy `json:"items"`
+}
+
+type NetworkPolicyEvent struct {
+	Type   string        `json:"type"`
+	Object NetworkPolicy `json:"object"`
+}
+
+func (c *Client) ListNetworkPolicies() (*NetworkPolicyList, error) {
+	policies := &NetworkPolicyList{}
+	if err := c.get(fmt.Sprintf("/apis/%s/networkpolicies", NetworkPolicyGroupVersion), policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (c *Client) WatchNetworkPolicies(resourceVersion string, stop <-chan struct{}) (<-chan NetworkPolicyEvent, error) {
+	events := make(chan NetworkPolicyEvent)
+	path := fmt.Sprintf("/apis/%s/networkpolicies", NetworkPolicyGroupVersion)
+	err := c.watch(path, resourceVersion, stop, func(decoder *json.Decoder) error {
+		var event NetworkPolicyEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		select {
+		case events <- event:
+			return nil
+		case <-stop:
+			return errWatchStopped
+		}
+	}, func() { close(events) })
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,68 @@
+package k8s
+
+import "testing"
+
+func TestListNetworkPolicies(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	s.AddNetworkPolicy(&NetworkPolicy{
+		Metadata: ObjectMeta{Name: "mysql", Namespace: "db"},
+		Spec: NetworkPolicySpec{
+			PodSelector: LabelSelector{MatchLabels: map[string]string{"app": "mysql"}},
+			Ingress: []NetworkPolicyIngressRule{{
+				Ports: []NetworkPolicyPort{{Port: &IntOrString{IntVal: 3306}}, {Protocol: "UDP", Port: &IntOrString{StrVal: "dns"}}},
+				From:  []NetworkPolicyPeer{{NamespaceSelector: &LabelSelector{}}},
+			}},
+		},
+	})
+
+	policies, err := c.ListNetworkPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies.Items) != 1 {
+		t.Fatalf("got policies %+v", policies.Items)
+	}
+	spec := policies.Items[0].Spec
+	if ports := spec.Ingress[0].Ports; ports[0].Port.IntVal != 3306 || ports[1].Port.StrVal != "dns" {
+		t.Errorf("got ports %+v %+v", *ports[0].Port, *ports[1].Port)
+	}
+	if !spec.Isolates(PolicyTypeIngress) || spec.Isolates(PolicyTypeEgress) {
+		t.Errorf("a policy without policyTypes and egress rules only isolates ingress")
+	}
+	spec.PolicyTypes = []string{PolicyTypeEgress}
+	if spec.Isolates(PolicyTypeIngress) || !spec.Isolates(PolicyTypeEgress) {
+		t.Errorf("policyTypes Egress only isolates egress")
+	}
+
+	namespaces, err := c.ListNamespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces.Items) != 1 || namespaces.Items[0].Metadata.Labels["team"] != "storage" {
+		t.Errorf("got namespaces %+v", namespaces.Items)
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "front"}
+	for _, test := range []struct {
+		selector *LabelSelector
+		want     bool
+	}{
+		{nil, true},
+		{&LabelSelector{}, true},
+		{&LabelSelector{MatchLabels: map[string]string{"app": "web"}}, true},
+		{&LabelSelector{MatchLabels: map[string]string{"app": ""}}, false},
+		{&LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "tier", Operator: "In", Values: []string{"front", "back"}}}}, true},
+		{&LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "tier", Operator: "NotIn", Values: []string{"front"}}}}, false},
+		{&LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "env", Operator: "NotIn", Values: []string{"prod"}}}}, true},
+		{&LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "app", Operator: "Exists"}}}, true},
+		{&LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "app", Operator: "DoesNotExist"}}}, false},
+		{&LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "app", Operator: "Gt"}}}, false},
+	} {
+		if got := test.selector.Matches(labels); got != test.want {
+			t.Errorf("%+v: got %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
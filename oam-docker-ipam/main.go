@@ -19,10 +19,19 @@ func main() {
 	}
 	app.Commands = []cli.Command{
 		command.NewServerCommand(),
+		command.NewControllerCommand(),
+		command.NewPolicyAgentCommand(),
 		command.NewIPRangeCommand(),
 		command.NewReleaseIPCommand(),
+		command.NewQuarantineCommand(),
+		command.NewReleaseQuarantineCommand(),
+		command.NewRetainedCommand(),
+		command.NewReleaseRetainedCommand(),
+		command.NewFirewallCommand(),
 		command.NewHostRangeCommand(),
 		command.NewReleaseHostCommand(),
+		command.NewHostNetworksCommand(),
+		command.NewHostCommand(),
 		command.NewCreateNetworkCommand(),
 	}
 	app.Run(os.Args)
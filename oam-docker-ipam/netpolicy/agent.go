@@ -0,0 +1,231 @@
+// Package netpolicy enforces the kubernetes network policies on the pods
+// skylarkcni attached on a node, with iptables rules on their host veths.
+package netpolicy
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+)
+
+const (
+	DefaultResync = time.Minute
+	// watch_retry is the pause before watching again after an error
+	watch_retry = 5 * time.Second
+	// sync_delay gathers the events of a burst of changes into one sync
+	sync_delay = time.Second
+)
+
+// Store holds the endpoints of the pods and finds their host veths
+type Store interface {
+	ListEndpoints() ([]*ipamdriver.Endpoint, error)
+	EndpointVeth(e *ipamdriver.Endpoint) (string, error)
+}
+
+type etcdStore struct{}
+
+func (etcdStore) ListEndpoints() ([]*ipamdriver.Endpoint, error) {
+	return ipamdriver.ListEndpoints()
+}
+
+func (etcdStore) EndpointVeth(e *ipamdriver.Endpoint) (string, error) {
+	return ipamdriver.EndpointVeth(e)
+}
+
+// NewStore returns the store of the skylark etcd cluster, the veths are
+// looked up on this host
+func NewStore() Store {
+	return etcdStore{}
+}
+
+// Rules programs a ruleset on the host
+type Rules interface {
+	Apply(rs *Ruleset) error
+}
+
+// Agent keeps the rules of the pods of a node in line with the network
+// policies, the pods and the namespaces
+type Agent struct {
+	client k8s.Interface
+	store  Store
+	rules  Rules
+	// Node is the hostname the addresses of the pods of the node are
+	// assigned under
+	Node string
+	// Resync is the interval of syncs without changes
+	Resync time.Duration
+	sync   chan struct{}
+}
+
+func NewAgent(client k8s.Interface, store Store, rules Rules, node string) *Agent {
+	return &Agent{
+		client: client,
+		store:  store,
+		rules:  rules,
+		Node:   node,
+		Resync: DefaultResync,
+		sync:   make(chan struct{}, 1),
+	}
+}
+
+// Ruleset computes the rules of the pods of the node. Only the interfaces
+// with the default route are filtered, the addresses of the pods are theirs.
+// The traffic of an isolated pod whose host veth is unknown is dropped,
+// macvlan and ipvlan pods bypass the host and are left unfiltered.
+func (a *Agent) Ruleset() (*Ruleset, error) {
+	// the endpoints first, so their pods are listed too
+	endpoints, err := a.store.ListEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := a.client.ListPods()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := a.client.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := a.client.ListNetworkPolicies()
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{
+		pods:       pods.Items,
+		namespaces: map[string]*k8s.Namespace{},
+		policies:   policies.Items,
+	}
+	for i := range namespaces.Items {
+		c.namespaces[namespaces.Items[i].Metadata.Name] = &namespaces.Items[i]
+	}
+	sort.Slice(c.policies, func(i, j int) bool {
+		m, n := c.policies[i].Metadata, c.policies[j].Metadata
+		return m.Namespace+"/"+m.Name < n.Namespace+"/"+n.Name
+	})
+	by_name := map[string]*k8s.Pod{}
+	for i := range c.pods {
+		pod := &c.pods[i]
+		by_name[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod
+	}
+
+	var local []podEndpoint
+	for _, e := range endpoints {
+		if e.Hostname != a.Node || e.Pod == "" || e.Interface != "" && e.Interface != "eth0" {
+			continue
+		}
+		pod, ok := by_name[e.Pod]
+		if !ok || e.PodUID != "" && pod.Metadata.UID != "" && e.PodUID != pod.Metadata.UID {
+			// the pod is gone, the controller releases its address
+			continue
+		}
+		if !c.isolated(pod) {
+			continue
+		}
+		veth, err := a.store.EndpointVeth(e)
+		if _, ok := err.(*ipamdriver.NoVethError); ok {
+			log.Errorf("The network policies of %s are not enforced: %v", e.Pod, err)
+			continue
+		}
+		if err != nil {
+			// the pod stays isolated, by its address
+			log.Warnf("Blocking %s, its host veth is unknown: %v", e.Pod, err)
+		}
+		local = append(local, podEndpoint{pod: pod, ip: e.Ip, veth: veth})
+	}
+	return buildRuleset(c, local), nil
+}
+
+// Sync programs the rules of the pods of the node
+func (a *Agent) Sync() error {
+	rs, err := a.Ruleset()
+	if err != nil {
+		return err
+	}
+	return a.rules.Apply(rs)
+}
+
+func (a *Agent) trigger() {
+	select {
+	case a.sync <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs on every change of the network policies, pods and namespaces and
+// every Resync until stop is closed
+func (a *Agent) Run(stop <-chan struct{}) {
+	go a.watch(stop, "pods", func() error {
+		events, err := a.client.WatchPods("", stop)
+		if err != nil {
+			return err
+		}
+		for range events {
+			a.trigger()
+		}
+		return nil
+	})
+	go a.watch(stop, "namespaces", func() error {
+		events, err := a.client.WatchNamespaces("", stop)
+		if err != nil {
+			return err
+		}
+		for range events {
+			a.trigger()
+		}
+		return nil
+	})
+	go a.watch(stop, "network policies", func() error {
+		events, err := a.client.WatchNetworkPolicies("", stop)
+		if err != nil {
+			return err
+		}
+		for range events {
+			a.trigger()
+		}
+		return nil
+	})
+
+	ticker := time.NewTicker(a.Resync)
+	defer ticker.Stop()
+	for {
+		if err := a.Sync(); err != nil {
+			log.Errorf("Failed to sync the network policies: %v", err)
+		}
+		select {
+		case <-a.sync:
+			select {
+			case <-time.After(sync_delay):
+			case <-stop:
+				return
+			}
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// watch runs start, which drains a watch, again whenever the watch ends
+// until stop is closed
+func (a *Agent) watch(stop <-chan struct{}, kind string, start func() error) {
+	for {
+		if err := start(); err != nil {
+			log.Errorf("Failed to watch %s: %v", kind, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(watch_retry):
+			}
+			continue
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package netpolicy
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/k8s"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/ruleset.golden")
+
+type fakeStore struct {
+	endpoints []*ipamdriver.Endpoint
+	veths     map[string]string
+}
+
+func (s *fakeStore) ListEndpoints() ([]*ipamdriver.Endpoint, error) {
+	return s.endpoints, nil
+}
+
+func (s *fakeStore) EndpointVeth(e *ipamdriver.Endpoint) (string, error) {
+	if e.Type == "macvlan" || e.Type == "ipvlan" {
+		return ipamdriver.EndpointVeth(e)
+	}
+	veth, ok := s.veths[e.ContainerID]
+	if !ok {
+		return "", errors.New("not running")
+	}
+	return veth, nil
+}
+
+type fakeRules struct {
+	mu      sync.Mutex
+	applied []*Ruleset
+}
+
+func (r *fakeRules) Apply(rs *Ruleset) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied = append(r.applied, rs)
+	return nil
+}
+
+func (r *fakeRules) last() *Ruleset {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.applied) == 0 {
+		return nil
+	}
+	return r.applied[len(r.applied)-1]
+}
+
+func pod(namespace, name, ip string, labels map[string]string) *k8s.Pod {
+	return &k8s.Pod{
+		Metadata: k8s.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Status:   k8s.PodStatus{Phase: "Running", PodIP: ip},
+	}
+}
+
+func newTestAgent() (*k8s.FakeClient, *fakeRules, *Agent) {
+	client := k8s.NewFakeClient()
+	client.AddNamespace(&k8s.Namespace{Metadata: k8s.ObjectMeta{Name: "db", Labels: map[string]string{"team": "storage"}}})
+	client.AddNamespace(&k8s.Namespace{Metadata: k8s.ObjectMeta{Name: "web", Labels: map[string]string{"team": "web"}}})
+	client.AddNamespace(&k8s.Namespace{Metadata: k8s.ObjectMeta{Name: "default"}})
+	client.AddPod(pod("db", "mysql-0", "10.0.2.10", map[string]string{"app": "mysql"}))
+	client.AddPod(pod("db", "mysql-2", "10.0.2.12", map[string]string{"app": "mysql"}))
+	client.AddPod(pod("db", "mysql-3", "10.0.6.13", map[string]string{"app": "mysql"}))
+	client.AddPod(pod("web", "frontend-1", "10.0.2.20", map[string]string{"app": "frontend"}))
+	client.AddPod(pod("web", "frontend-2", "10.0.2.21", map[string]string{"app": "frontend"}))
+	client.AddPod(pod("default", "debug", "10.0.2.30", nil))
+	done := pod("web", "migrate", "10.0.2.22", map[string]string{"app": "frontend"})
+	done.Status.Phase = "Succeeded"
+	client.AddPod(done)
+
+	client.AddNetworkPolicy(&k8s.NetworkPolicy{
+		Metadata: k8s.ObjectMeta{Name: "allow-mysql", Namespace: "db"},
+		Spec: k8s.NetworkPolicySpec{
+			PodSelector: k8s.LabelSelector{MatchLabels: map[string]string{"app": "mysql"}},
+			Ingress: []k8s.NetworkPolicyIngressRule{
+				{
+					Ports: []k8s.NetworkPolicyPort{{Port: &k8s.IntOrString{IntVal: 3306}}},
+					From: []k8s.NetworkPolicyPeer{{
+						NamespaceSelector: &k8s.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+						PodSelector:       &k8s.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+					}},
+				},
+				{
+					From: []k8s.NetworkPolicyPeer{{IPBlock: &k8s.IPBlock{CIDR: "10.1.0.0/16", Except: []string{"10.1.2.0/24"}}}},
+				},
+			},
+		},
+	})
+	client.AddNetworkPolicy(&k8s.NetworkPolicy{
+		Metadata: k8s.ObjectMeta{Name: "deny-egress", Namespace: "web"},
+		Spec: k8s.NetworkPolicySpec{
+			PolicyTypes: []string{k8s.PolicyTypeEgress},
+			Egress: []k8s.NetworkPolicyEgressRule{
+				{
+					Ports: []k8s.NetworkPolicyPort{{Port: &k8s.IntOrString{IntVal: 3306}}},
+					To: []k8s.NetworkPolicyPeer{{
+						NamespaceSelector: &k8s.LabelSelector{},
+						PodSelector: &k8s.LabelSelector{MatchExpressions: []k8s.LabelSelectorRequirement{
+							{Key: "app", Operator: "In", Values: []string{"mysql"}},
+						}},
+					}},
+				},
+				{
+					Ports: []k8s.NetworkPolicyPort{
+						{Protocol: "UDP", Port: &k8s.IntOrString{IntVal: 53}},
+						{Protocol: "UDP", Port: &k8s.IntOrString{StrVal: "dns"}},
+						{Port: &k8s.IntOrString{IntVal: 8000}, EndPort: 8100},
+					},
+					To: []k8s.NetworkPolicyPeer{{IPBlock: &k8s.IPBlock{CIDR: "0.0.0.0/0"}}},
+				},
+			},
+		},
+	})
+
+	store := &fakeStore{
+		endpoints: []*ipamdriver.Endpoint{
+			{ContainerID: "c-mysql", Ip: "10.0.2.10", Hostname: "node-1", Pod: "db/mysql-0"},
+			// an isolated pod whose veth is not found
+			{ContainerID: "c-mysql-2", Ip: "10.0.2.12", Hostname: "node-1", Pod: "db/mysql-2"},
+			// an isolated macvlan pod, its traffic bypasses the host
+			{ContainerID: "c-mysql-3", Ip: "10.0.6.13", Hostname: "node-1", Pod: "db/mysql-3", Type: "macvlan"},
+			{ContainerID: "c-frontend-1", Ip: "10.0.2.20", Hostname: "node-2", Pod: "web/frontend-1"},
+			{ContainerID: "c-frontend-2", Ip: "10.0.2.21", Hostname: "node-1", Pod: "web/frontend-2"},
+			{ContainerID: "c-frontend-2-net1", Ip: "10.0.5.21", Hostname: "node-1", Pod: "web/frontend-2", Interface: "net1"},
+			{ContainerID: "c-debug", Ip: "10.0.2.30", Hostname: "node-1", Pod: "default/debug"},
+			// a docker container and a pod that is gone
+			{ContainerID: "c-docker", Ip: "10.0.2.40", Hostname: "node-1"},
+			{ContainerID: "c-gone", Ip: "10.0.2.50", Hostname: "node-1", Pod: "db/mysql-1"},
+		},
+		veths: map[string]string{
+			"c-mysql":           "veth1a2b3c",
+			"c-frontend-1":      "veth4d5e6f",
+			"c-frontend-2":      "veth7a8b9c",
+			"c-frontend-2-net1": "veth0d1e2f",
+			"c-debug":           "veth3a4b5c",
+		},
+	}
+	rules := &fakeRules{}
+	return client, rules, NewAgent(client, store, rules, "node-1")
+}
+
+func TestRuleset(t *testing.T) {
+	_, rules, agent := newTestAgent()
+	if err := agent.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	got := rules.last().String()
+	if *update {
+		if err := ioutil.WriteFile("testdata/ruleset.golden", []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile("testdata/ruleset.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("got ruleset\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRunFollowsPolicies(t *testing.T) {
+	client, rules, agent := newTestAgent()
+	stop := make(chan struct{})
+	defer close(stop)
+	go agent.Run(stop)
+	// the pod added below is only seen by a running watch
+	if !client.WaitForWatches(3, 2*time.Second) {
+		t.Fatal("the agent does not watch")
+	}
+
+	wait := func(what string, done func(rs string) bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if rs := rules.last(); rs != nil && done(rs.String()) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s: got ruleset\n%s", what, rules.last())
+	}
+	wait("initial sync", func(rs string) bool {
+		return strings.Contains(rs, "--physdev-out veth1a2b3c")
+	})
+
+	// a new frontend is allowed to reach mysql
+	client.AddPod(pod("web", "frontend-3", "10.0.2.23", map[string]string{"app": "frontend"}))
+	wait("new pod", func(rs string) bool {
+		return strings.Contains(rs, "-s 10.0.2.23 -p tcp --dport 3306")
+	})
+
+	client.DeleteNetworkPolicy("db", "allow-mysql")
+	client.DeleteNetworkPolicy("web", "deny-egress")
+	wait("deleted policies", func(rs string) bool {
+		return rs == ":"+policyChain+" - [0:0]\n"
+	})
+}
@@ -0,0 +1,98 @@
+package netpolicy
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-iptables/iptables"
+
+	"oam-docker-ipam/ipamdriver"
+)
+
+type iptablesRules struct{}
+
+// NewIPTables returns the Rules of the filter table of this host
+func NewIPTables() Rules {
+	return iptablesRules{}
+}
+
+// chains adds the SKY-NP chains reachable from chain to found
+func chains(ipt *iptables.IPTables, chain string, found map[string]bool) {
+	rules, err := ipt.List("filter", chain)
+	if err != nil {
+		return
+	}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		for i, field := range fields {
+			if field == "-j" && i+1 < len(fields) && strings.HasPrefix(fields[i+1], "SKY-NP") && !found[fields[i+1]] {
+				found[fields[i+1]] = true
+				chains(ipt, fields[i+1], found)
+			}
+		}
+	}
+}
+
+// Apply replaces the chains of the last ruleset with rs in one
+// iptables-restore, the pods are never open while their chains change
+func (iptablesRules) Apply(rs *Ruleset) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	isolated := len(rs.Chains[0].Rules) != 0
+	_, err = ipt.List("filter", policyChain)
+	set_up := err == nil
+	if !set_up && !isolated {
+		// never set up
+		return nil
+	}
+	stale := map[string]bool{}
+	chains(ipt, policyChain, stale)
+	for _, c := range rs.Chains {
+		delete(stale, c.Name)
+	}
+
+	rules := rs.String()
+	if isolated {
+		ipamdriver.EnableBridgeNetfilter()
+		forward := false
+		if set_up {
+			if forward, err = ipt.Exists("filter", "FORWARD", "-j", policyChain); err != nil {
+				return err
+			}
+		}
+		if !forward {
+			rules += fmt.Sprintf("-I FORWARD 1 -j %s\n", policyChain)
+		}
+	}
+	if err = ipamdriver.IptablesRestore("filter", rules); err != nil {
+		return err
+	}
+
+	// the chains of pods that are gone or no longer isolated, nothing
+	// jumps to them anymore
+	for chain := range stale {
+		if err = ipt.ClearChain("filter", chain); err != nil {
+			log.Warnf("Failed to flush chain %s: %v", chain, err)
+		}
+	}
+	for chain := range stale {
+		if err = ipt.DeleteChain("filter", chain); err != nil {
+			log.Warnf("Failed to delete chain %s: %v", chain, err)
+		}
+	}
+	if !isolated {
+		if exists, err := ipt.Exists("filter", "FORWARD", "-j", policyChain); err != nil {
+			return err
+		} else if exists {
+			if err = ipt.Delete("filter", "FORWARD", "-j", policyChain); err != nil {
+				return err
+			}
+		}
+		return ipt.DeleteChain("filter", policyChain)
+	}
+	log.Debugf("Network policies applied to %d chains", len(rs.Chains)-1)
+	return nil
+}
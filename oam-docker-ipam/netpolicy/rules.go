@@ -0,0 +1,273 @@
+package netpolicy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"oam-docker-ipam/k8s"
+)
+
+const (
+	// policyChain is the filter chain jumped to from FORWARD, it jumps to
+	// the chains of the host veths of isolated pods
+	policyChain = "SKYLARK-POLICY"
+	// allowMark is set on the packets a policy allows. The chain of a pod
+	// clears it first, so the chain of the other end decides on its own.
+	allowMark = "0x20000/0x20000"
+	clearMark = "0x0/0x20000"
+)
+
+// Chain is a filter chain, each rule the iptables arguments after -A chain
+type Chain struct {
+	Name  string
+	Rules [][]string
+}
+
+// Ruleset is the filter chains of the isolated pods of a node, policyChain
+// first
+type Ruleset struct {
+	Chains []Chain
+}
+
+// String formats the ruleset like iptables-save, as the input of
+// iptables-restore
+func (rs *Ruleset) String() string {
+	var b bytes.Buffer
+	for _, c := range rs.Chains {
+		fmt.Fprintf(&b, ":%s - [0:0]\n", c.Name)
+	}
+	for _, c := range rs.Chains {
+		for _, rule := range c.Rules {
+			fmt.Fprintf(&b, "-A %s %s\n", c.Name, strings.Join(rule, " "))
+		}
+	}
+	return b.String()
+}
+
+// podEndpoint is a pod of the node and the host end of its veth, empty when
+// it is unknown
+type podEndpoint struct {
+	pod  *k8s.Pod
+	ip   string
+	veth string
+}
+
+// cluster is what the rules are computed from
+type cluster struct {
+	pods       []k8s.Pod
+	namespaces map[string]*k8s.Namespace
+	policies   []k8s.NetworkPolicy
+}
+
+// selecting returns the policies selecting pod that isolate it for the
+// policy type
+func (c *cluster) selecting(pod *k8s.Pod, policyType string) []*k8s.NetworkPolicy {
+	var policies []*k8s.NetworkPolicy
+	for i := range c.policies {
+		policy := &c.policies[i]
+		if policy.Metadata.Namespace == pod.Metadata.Namespace &&
+			policy.Spec.PodSelector.Matches(pod.Metadata.Labels) && policy.Spec.Isolates(policyType) {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// isolated tells whether a policy selects pod
+func (c *cluster) isolated(pod *k8s.Pod) bool {
+	return len(c.selecting(pod, k8s.PolicyTypeIngress)) != 0 || len(c.selecting(pod, k8s.PolicyTypeEgress)) != 0
+}
+
+// peerIPs returns the addresses of the pods peer selects, sorted
+func (c *cluster) peerIPs(peer *k8s.NetworkPolicyPeer, namespace string) []string {
+	var ips []string
+	for i := range c.pods {
+		pod := &c.pods[i]
+		if pod.Status.PodIP == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		if peer.NamespaceSelector == nil {
+			if pod.Metadata.Namespace != namespace {
+				continue
+			}
+		} else {
+			ns, ok := c.namespaces[pod.Metadata.Namespace]
+			if !ok || !peer.NamespaceSelector.Matches(ns.Metadata.Labels) {
+				continue
+			}
+		}
+		if peer.PodSelector.Matches(pod.Metadata.Labels) {
+			ips = append(ips, pod.Status.PodIP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// portMatches returns the port arguments of ports, one entry without
+// arguments for all ports. Named ports are not resolved, they allow nothing.
+func portMatches(ports []k8s.NetworkPolicyPort) [][]string {
+	if len(ports) == 0 {
+		return [][]string{nil}
+	}
+	var matches [][]string
+	for _, port := range ports {
+		protocol := strings.ToLower(port.Protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		match := []string{"-p", protocol}
+		switch {
+		case port.Port == nil:
+		case port.Port.StrVal != "":
+			log.Debugf("Named port %s is not supported", port.Port.StrVal)
+			continue
+		case port.EndPort > port.Port.IntVal:
+			match = append(match, "--dport", fmt.Sprintf("%d:%d", port.Port.IntVal, port.EndPort))
+		default:
+			match = append(match, "--dport", strconv.Itoa(port.Port.IntVal))
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+func chainName(prefix, s string) string {
+	return prefix + fmt.Sprintf("%x", sha1.Sum([]byte(s)))[:16]
+}
+
+// podChain builds the chains filtering one direction of the traffic of a
+// pod. Peers are matched with flag, -s for ingress and -d for egress.
+type podChain struct {
+	chain  Chain
+	blocks []Chain
+	flag   string
+}
+
+func newPodChain(name, flag string) *podChain {
+	return &podChain{
+		chain: Chain{Name: name, Rules: [][]string{
+			{"-j", "MARK", "--set-xmark", clearMark},
+			{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+		}},
+		flag: flag,
+	}
+}
+
+// allow adds the rules allowing the traffic of peers, everything when
+// empty, to ports
+func (p *podChain) allow(c *cluster, policy *k8s.NetworkPolicy, peers []k8s.NetworkPolicyPeer, ports []k8s.NetworkPolicyPort) {
+	comment := []string{"-m", "comment", "--comment", policy.Metadata.Namespace + "/" + policy.Metadata.Name}
+	mark := []string{"-j", "MARK", "--set-xmark", allowMark}
+	type match struct {
+		args   []string
+		target []string
+	}
+	var matches []match
+	if len(peers) == 0 {
+		matches = append(matches, match{nil, mark})
+	}
+	for i := range peers {
+		peer := &peers[i]
+		if block := peer.IPBlock; block != nil {
+			if len(block.Except) == 0 {
+				matches = append(matches, match{[]string{p.flag, block.CIDR}, mark})
+				continue
+			}
+			// the excepted addresses return before they are marked
+			sub := Chain{Name: chainName("SKY-NPB-", p.chain.Name+"/"+strconv.Itoa(len(p.blocks)))}
+			for _, except := range block.Except {
+				sub.Rules = append(sub.Rules, []string{p.flag, except, "-j", "RETURN"})
+			}
+			sub.Rules = append(sub.Rules, mark)
+			p.blocks = append(p.blocks, sub)
+			matches = append(matches, match{[]string{p.flag, block.CIDR}, []string{"-j", sub.Name}})
+			continue
+		}
+		for _, ip := range c.peerIPs(peer, policy.Metadata.Namespace) {
+			matches = append(matches, match{[]string{p.flag, ip}, mark})
+		}
+	}
+	for _, m := range matches {
+		for _, port := range portMatches(ports) {
+			rule := append(append(append([]string{}, m.args...), port...), comment...)
+			p.chain.Rules = append(p.chain.Rules, append(rule, m.target...))
+		}
+	}
+}
+
+func (p *podChain) chains() []Chain {
+	p.chain.Rules = append(p.chain.Rules,
+		[]string{"-m", "mark", "--mark", allowMark, "-j", "RETURN"},
+		[]string{"-j", "DROP"})
+	return append([]Chain{p.chain}, p.blocks...)
+}
+
+// buildRuleset returns the chains enforcing the policies of c on the
+// endpoints. The traffic a pod receives leaves the bridge through its veth
+// and the traffic it sends enters it there. Allowed traffic returns to
+// FORWARD, so the chain of the other end still sees it. New connections of
+// an endpoint without veth are dropped in the directions it is isolated in.
+func buildRuleset(c *cluster, endpoints []podEndpoint) *Ruleset {
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].veth != endpoints[j].veth {
+			return endpoints[i].veth < endpoints[j].veth
+		}
+		return endpoints[i].ip < endpoints[j].ip
+	})
+	main := Chain{Name: policyChain}
+	var chains []Chain
+	for _, e := range endpoints {
+		if e.veth == "" {
+			main.Rules = append(main.Rules, blockRules(c, e)...)
+			continue
+		}
+		if policies := c.selecting(e.pod, k8s.PolicyTypeIngress); len(policies) != 0 {
+			p := newPodChain(chainName("SKY-NPI-", e.veth), "-s")
+			for _, policy := range policies {
+				for _, rule := range policy.Spec.Ingress {
+					p.allow(c, policy, rule.From, rule.Ports)
+				}
+			}
+			main.Rules = append(main.Rules, []string{"-m", "physdev", "--physdev-out", e.veth, "--physdev-is-bridged", "-j", p.chain.Name})
+			chains = append(chains, p.chains()...)
+		}
+		if policies := c.selecting(e.pod, k8s.PolicyTypeEgress); len(policies) != 0 {
+			p := newPodChain(chainName("SKY-NPE-", e.veth), "-d")
+			for _, policy := range policies {
+				for _, rule := range policy.Spec.Egress {
+					p.allow(c, policy, rule.To, rule.Ports)
+				}
+			}
+			main.Rules = append(main.Rules, []string{"-m", "physdev", "--physdev-in", e.veth, "--physdev-is-bridged", "-j", p.chain.Name})
+			chains = append(chains, p.chains()...)
+		}
+	}
+	return &Ruleset{Chains: append([]Chain{main}, chains...)}
+}
+
+// blockRules drops the new connections of the endpoint in the directions its
+// policies isolate it in
+func blockRules(c *cluster, e podEndpoint) [][]string {
+	var rules [][]string
+	name := e.pod.Metadata.Namespace + "/" + e.pod.Metadata.Name
+	for _, d := range []struct {
+		policyType string
+		flag       string
+	}{
+		{k8s.PolicyTypeIngress, "-d"},
+		{k8s.PolicyTypeEgress, "-s"},
+	} {
+		if len(c.selecting(e.pod, d.policyType)) != 0 {
+			rules = append(rules, []string{d.flag, e.ip, "-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED",
+				"-m", "comment", "--comment", name, "-j", "DROP"})
+		}
+	}
+	return rules
+}
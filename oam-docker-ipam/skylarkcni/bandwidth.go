@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"strconv"
+	"syscall"
+	"time"
+
+	"oam-docker-ipam/k8s"
+	"oam-docker-ipam/skylarkcni/cniapi"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+)
+
+// tbfLatency is how long a packet may wait in the token bucket
+const tbfLatency = 25 * time.Millisecond
+
+// BandwidthEntry is the bandwidth capability the runtime passes in the
+// runtimeConfig. Rates are in bits per second and bursts in bits, 0 is
+// unlimited or the default burst.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+func (bw *BandwidthEntry) isZero() bool {
+	return bw.IngressRate == 0 && bw.EgressRate == 0
+}
+
+// podBandwidth returns the shaping of the pod interface. The annotations
+// win over the runtimeConfig, which wins over the default of the pool. The
+// annotations and runtimeConfig are for the interface with the default
+// route only.
+func podBandwidth(pInfo *cniapi.CNIPodAttr, netconf *NetConf, pn *k8s.PodNetwork, data map[string]string) (*BandwidthEntry, error) {
+	bw := BandwidthEntry{}
+	if netconf.RuntimeConfig.Bandwidth != nil && netconf.defaultRoute(pInfo.IntfName) {
+		bw = *netconf.RuntimeConfig.Bandwidth
+	}
+	if pn.IngressBandwidth != 0 {
+		bw.IngressRate, bw.IngressBurst = pn.IngressBandwidth, 0
+	}
+	if pn.EgressBandwidth != 0 {
+		bw.EgressRate, bw.EgressBurst = pn.EgressBandwidth, 0
+	}
+	for key, rate := range map[string]*uint64{"IngressBandwidth": &bw.IngressRate, "EgressBandwidth": &bw.EgressRate} {
+		if value := data[key]; value != "" && *rate == 0 {
+			r, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+			*rate = r
+		}
+	}
+	// the kernel would get a truncated token bucket otherwise
+	for _, tbf := range [][2]uint64{{bw.IngressRate, bw.IngressBurst}, {bw.EgressRate, bw.EgressBurst}} {
+		if tbf[0] == 0 {
+			continue
+		}
+		if _, _, _, err := tbfParams(tbf[0], tbf[1]); err != nil {
+			return nil, err
+		}
+	}
+	return &bw, nil
+}
+
+// endpointHash identifies the interface ifName of a container in the names
+// of the host devices and chains made for it
+func endpointHash(containerID, ifName string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(containerID+"/"+ifName)))
+}
+
+// ifbName names the ifb device the egress of the pod interface is shaped on
+func ifbName(containerID, ifName string) string {
+	return "sky" + endpointHash(containerID, ifName)[:12]
+}
+
+// setupBandwidth shapes the traffic of the pod. Bridge pods are shaped on
+// the host end of the veth, ingress by a token bucket on it and egress by
+// redirecting what the veth receives to an ifb device with a token bucket.
+// macvlan and ipvlan pods have no host interface, their egress is shaped on
+// the pod interface and ingress is not supported.
+func setupBandwidth(netconf *NetConf, pInfo *cniapi.CNIPodAttr, result *current.Result, bw *BandwidthEntry) error {
+	if bw.isZero() {
+		return nil
+	}
+	if netconf.Type != "bridge" || len(result.Interfaces) < 2 {
+		if bw.IngressRate != 0 {
+			return fmt.Errorf("ingress bandwidth needs a bridge network, %s pods have no host interface", netconf.Type)
+		}
+		err := ns.WithNetNSPath(pInfo.NwNameSpace, func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(pInfo.IntfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", pInfo.IntfName, err)
+			}
+			return addTbf(link, bw.EgressRate, bw.EgressBurst)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to limit egress to %d bit/s: %v", bw.EgressRate, err)
+		}
+		return nil
+	}
+
+	host, err := netlink.LinkByName(result.Interfaces[0].Name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", result.Interfaces[0].Name, err)
+	}
+	if bw.IngressRate != 0 {
+		if err = addTbf(host, bw.IngressRate, bw.IngressBurst); err != nil {
+			return fmt.Errorf("failed to limit ingress to %d bit/s: %v", bw.IngressRate, err)
+		}
+	}
+	if bw.EgressRate != 0 {
+		if err = addEgressTbf(host, ifbName(pInfo.InfraContainerID, pInfo.IntfName), bw.EgressRate, bw.EgressBurst); err != nil {
+			return fmt.Errorf("failed to limit egress to %d bit/s: %v", bw.EgressRate, err)
+		}
+	}
+	return nil
+}
+
+// addEgressTbf redirects the traffic host receives to the ifb device name,
+// created when missing, and shapes it there
+func addEgressTbf(host netlink.Link, name string, rate, burst uint64) error {
+	ifb, err := netlink.LinkByName(name)
+	if err != nil {
+		if err.Error() != "Link not found" {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		la := netlink.NewLinkAttrs()
+		la.Name = name
+		la.TxQLen = 1000
+		if err = netlink.LinkAdd(&netlink.Ifb{LinkAttrs: la}); err != nil {
+			return fmt.Errorf("failed to create %q: %v", name, err)
+		}
+		if ifb, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+	}
+	if err = netlink.LinkSetUp(ifb); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	if err = addTbf(ifb, rate, burst); err != nil {
+		return err
+	}
+
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: host.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add the ingress qdisc to %q: %v", host.Attrs().Name, err)
+	}
+	// a u32 filter without a selector matches everything
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: host.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		RedirIndex: ifb.Attrs().Index,
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to redirect %q to %q: %v", host.Attrs().Name, name, err)
+	}
+	return nil
+}
+
+// teardownBandwidth removes the ifb device of the pod interface, it goes
+// away with the host veth otherwise unnoticed
+func teardownBandwidth(pInfo *cniapi.CNIPodAttr) error {
+	name := ifbName(pInfo.InfraContainerID, pInfo.IntfName)
+	link, err := netlink.LinkByName(name)
+	if err != nil && err.Error() == "Link not found" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	return netlink.LinkDel(link)
+}
+
+// addTbf replaces the root qdisc of link with a token bucket filter of rate
+// bits per second and burst bits, 0 picks a burst for the rate
+func addTbf(link netlink.Link, rate, burst uint64) error {
+	rateBytes, buffer, limit, err := tbfParams(rate, burst)
+	if err != nil {
+		return err
+	}
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateBytes,
+		Buffer: buffer,
+		Limit:  limit,
+	}
+	return netlink.QdiscReplace(qdisc)
+}
+
+// tbfParams returns the rate in bytes, the buffer in ticks and the limit in
+// bytes of a token bucket filter of rate bits per second and burst bits. The
+// kernel takes the buffer and limit as 32 bit values.
+func tbfParams(rate, burst uint64) (uint64, uint32, uint32, error) {
+	rateBytes := rate / 8
+	if rateBytes == 0 {
+		return 0, 0, 0, fmt.Errorf("rate %d is below 8 bit/s", rate)
+	}
+	burstBytes := burst / 8
+	if burstBytes == 0 {
+		// let 10ms worth of traffic through at once, but at least a few
+		// full sized packets
+		burstBytes = rateBytes / 100
+		if burstBytes < 16*1024 {
+			burstBytes = 16 * 1024
+		}
+	}
+	if burstBytes > math.MaxUint32 {
+		return 0, 0, 0, fmt.Errorf("burst %d is above %d bits", burst, uint64(math.MaxUint32)*8)
+	}
+	// the latency worth of traffic may queue behind the burst
+	queued := float64(rateBytes) * tbfLatency.Seconds()
+	if queued+float64(burstBytes) > math.MaxUint32 {
+		return 0, 0, 0, fmt.Errorf("rate %d bit/s with a burst of %d bytes queues more than %d bytes", rate, burstBytes, uint64(math.MaxUint32))
+	}
+	buffer := netlink.Xmittime(rateBytes, uint32(burstBytes))
+	if buffer > math.MaxUint32 {
+		return 0, 0, 0, fmt.Errorf("burst of %d bytes takes too long to send at %d bit/s", burstBytes, rate)
+	}
+	return rateBytes, uint32(buffer), uint32(queued) + uint32(burstBytes), nil
+}
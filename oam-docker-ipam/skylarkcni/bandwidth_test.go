@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"oam-docker-ipam/k8s"
+	"oam-docker-ipam/skylarkcni/cniapi"
+)
+
+func TestPodBandwidth(t *testing.T) {
+	runtime := &BandwidthEntry{IngressRate: 1e6, IngressBurst: 2e6, EgressRate: 3e6, EgressBurst: 4e6}
+	tests := []struct {
+		ifname  string
+		runtime *BandwidthEntry
+		pn      k8s.PodNetwork
+		data    map[string]string
+		want    BandwidthEntry
+	}{
+		{ifname: "eth0", want: BandwidthEntry{}},
+		{ifname: "eth0", runtime: runtime, want: *runtime},
+		// the runtimeConfig is for the interface with the default route
+		{ifname: "net1", runtime: runtime, want: BandwidthEntry{}},
+		// the annotations win and drop the burst of the runtimeConfig
+		{
+			ifname: "eth0", runtime: runtime, pn: k8s.PodNetwork{EgressBandwidth: 5e6},
+			want: BandwidthEntry{IngressRate: 1e6, IngressBurst: 2e6, EgressRate: 5e6},
+		},
+		{
+			ifname: "eth0", pn: k8s.PodNetwork{IngressBandwidth: 6e6, EgressBandwidth: 7e6},
+			data: map[string]string{"IngressBandwidth": "8000000", "EgressBandwidth": "9000000"},
+			want: BandwidthEntry{IngressRate: 6e6, EgressRate: 7e6},
+		},
+		// the pool default fills in what nothing else sets
+		{
+			ifname: "eth0", runtime: &BandwidthEntry{EgressRate: 3e6},
+			data: map[string]string{"IngressBandwidth": "8000000", "EgressBandwidth": "9000000"},
+			want: BandwidthEntry{IngressRate: 8e6, EgressRate: 3e6},
+		},
+		{
+			ifname: "net1", data: map[string]string{"EgressBandwidth": "9000000"},
+			want: BandwidthEntry{EgressRate: 9e6},
+		},
+	}
+	for i, test := range tests {
+		netconf := &NetConf{}
+		netconf.RuntimeConfig.Bandwidth = test.runtime
+		pn := test.pn
+		bw, err := podBandwidth(&cniapi.CNIPodAttr{IntfName: test.ifname}, netconf, &pn, test.data)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(*bw, test.want) {
+			t.Errorf("%d: got %+v, want %+v", i, *bw, test.want)
+		}
+	}
+
+	_, err := podBandwidth(&cniapi.CNIPodAttr{IntfName: "eth0"}, &NetConf{}, &k8s.PodNetwork{}, map[string]string{"EgressBandwidth": "10M"})
+	if err == nil {
+		t.Error("expected an error for an invalid pool bandwidth")
+	}
+	// a token bucket the kernel can not hold
+	for _, bw := range []*BandwidthEntry{{IngressRate: 1e6, IngressBurst: 1 << 40}, {EgressRate: 1 << 40}} {
+		netconf := &NetConf{}
+		netconf.RuntimeConfig.Bandwidth = bw
+		if _, err := podBandwidth(&cniapi.CNIPodAttr{IntfName: "eth0"}, netconf, &k8s.PodNetwork{}, nil); err == nil {
+			t.Errorf("%+v: expected an error", *bw)
+		}
+	}
+}
+
+func TestTbfParams(t *testing.T) {
+	rate, _, limit, err := tbfParams(8e6, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 25ms of 1MB/s behind the default burst of 16KB
+	if rate != 1e6 || limit != 25000+16*1024 {
+		t.Errorf("got rate %d and limit %d", rate, limit)
+	}
+	if _, _, _, err = tbfParams(100e9, 0); err != nil {
+		t.Errorf("100Gbit/s: %v", err)
+	}
+
+	tests := []struct {
+		rate, burst uint64
+	}{
+		{rate: 7},
+		// the burst is above 4GB
+		{rate: 8e6, burst: 1 << 35},
+		// 25ms of traffic is above 4GB
+		{rate: 1 << 40},
+		// 4GB takes longer to send at 8bit/s than the buffer can say
+		{rate: 8, burst: 1 << 34},
+	}
+	for _, test := range tests {
+		if _, _, _, err := tbfParams(test.rate, test.burst); err == nil {
+			t.Errorf("rate %d burst %d: expected an error", test.rate, test.burst)
+		}
+	}
+}
+
+func TestIfbName(t *testing.T) {
+	name := ifbName("8ec72deca647", "eth0")
+	if len(name) > 15 {
+		t.Errorf("%s is longer than an interface name may be", name)
+	}
+	if name == ifbName("8ec72deca647", "net1") || name == ifbName("8ec72deca648", "eth0") {
+		t.Errorf("%s is not unique to the interface", name)
+	}
+	if name != ifbName("8ec72deca647", "eth0") {
+		t.Errorf("%s is not stable", name)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -40,8 +41,70 @@ const (
 	requestAddressURL = "/IpamDriver.RequestAddress"
 	releaseAddressURL = "/IpamDriver.ReleaseAddress"
 	getAddressURL = "/IpamDriver.GetAddress"
+	setVethURL = "/IpamDriver.SetEndpointVeth"
 )
 
+// IPAMClient allocates and releases the addresses of pods
+type IPAMClient interface {
+	RequestAddress(podInfo *cniapi.CNIPodAttr, netConf *types.NetConf) (*ipamapi.RequestAddressResponse, error)
+	// ReleaseAddress releases the address of the pod interface, it is left
+	// alone when it went to another pod meanwhile
+	ReleaseAddress(podInfo *cniapi.CNIPodAttr, netconf *types.NetConf, ipaddress string) error
+	// GetAddress returns the address of interface ifname of the container
+	GetAddress(infracontainerid, ifname string) (string, error)
+	// SetEndpointVeth records veth as the host end of interface ifname of
+	// the container
+	SetEndpointVeth(infracontainerid, ifname, veth string) error
+}
+
+// addressRequest asks for an address of the netconf subnet, or of the pool
+// and the address the pod asked for. The pod name gets StatefulSet pods
+// their retained address back, the labels let pools select the pod.
+func addressRequest(podInfo *cniapi.CNIPodAttr, netConf *types.NetConf) *ipamapi.RequestAddressRequest {
+	poolId := strings.Split(netConf.IPAM.Subnet, "/")[0]
+	options := map[string]string{"InfraContainerid": podInfo.InfraContainerID}
+	if podInfo.IntfName != "" {
+		options["Interface"] = podInfo.IntfName
+	}
+	if netConf.Type != "" {
+		options["Type"] = netConf.Type
+	}
+	if podInfo.Pool != "" {
+		options["Pool"] = podInfo.Pool
+	}
+	if podInfo.Name != "" {
+		options["Pod"] = podInfo.K8sNameSpace + "/" + podInfo.Name
+	}
+	if podInfo.UID != "" {
+		options["PodUID"] = podInfo.UID
+	}
+	if podInfo.Retain > 0 {
+		options["Retain"] = strconv.Itoa(podInfo.Retain)
+	}
+	for key, labels := range map[string]map[string]string{
+		"NamespaceLabels": podInfo.NamespaceLabels,
+		"PodLabels":       podInfo.PodLabels,
+		"NodeLabels":      podInfo.NodeLabels,
+	} {
+		if len(labels) != 0 {
+			value, _ := json.Marshal(labels)
+			options[key] = string(value)
+		}
+	}
+	return &ipamapi.RequestAddressRequest{PoolID: poolId, Address: podInfo.RequestedIP, Options: options}
+}
+
+// releaseRequest releases ipaddress of the pod interface, in CIDR notation or
+// not
+func releaseRequest(podInfo *cniapi.CNIPodAttr, netConf *types.NetConf, ipaddress string) *ipamapi.ReleaseAddressRequest {
+	return &ipamapi.ReleaseAddressRequest{
+		PoolID:      strings.Split(netConf.IPAM.Subnet, "/")[0],
+		Address:     strings.Split(ipaddress, "/")[0],
+		ContainerID: podInfo.InfraContainerID,
+		Interface:   podInfo.IntfName,
+	}
+}
+
 // NWClient defines informatio needed for the k8s api client
 type NWClient struct {
 	baseURL string
@@ -66,10 +129,7 @@ func NewNWClient() *NWClient {
 
 // Request ip address with ipam interface
 func (c *NWClient) RequestAddress(podInfo *cniapi.CNIPodAttr, netConf *types.NetConf) (*ipamapi.RequestAddressResponse, error) {
-	poolId := strings.Split(netConf.IPAM.Subnet, "/")[0]
-	options := map[string]string{"InfraContainerid": podInfo.InfraContainerID}
-	req := ipamapi.RequestAddressRequest{PoolID: poolId, Address: nil,
-		Options: options}
+	req := addressRequest(podInfo, netConf)
 	res := ipamapi.RequestAddressResponse{}
 
 
@@ -79,7 +139,7 @@ func (c *NWClient) RequestAddress(podInfo *cniapi.CNIPodAttr, netConf *types.Net
 	}
 
 	body := bytes.NewBuffer(buf)
-	r, err := c.client.Post(requestAddressURL, "application/json", body)
+	r, err := c.client.Post(c.baseURL+requestAddressURL, "application/json", body)
 	if err != nil {
 		return nil, err
 	}
@@ -122,9 +182,8 @@ func (c *NWClient) RequestAddress(podInfo *cniapi.CNIPodAttr, netConf *types.Net
 }
 
 // Release IP address from ipam interface
-func (c *NWClient) ReleaseAddress(netconf *types.NetConf, ipaddress string) error {
-	poolId := strings.Split(netconf.IPAM.Subnet, "/")[0]
-	req := ipamapi.ReleaseAddressRequest{PoolID: poolId, Address: ipaddress}
+func (c *NWClient) ReleaseAddress(podInfo *cniapi.CNIPodAttr, netconf *types.NetConf, ipaddress string) error {
+	req := releaseRequest(podInfo, netconf, ipaddress)
 	res := ipamapi.ReleaseAddressResponse{}
 	buf, err := json.Marshal(req)
 	if err != nil {
@@ -132,7 +191,7 @@ func (c *NWClient) ReleaseAddress(netconf *types.NetConf, ipaddress string) erro
 	}
 
 	body := bytes.NewBuffer(buf)
-	r, err := c.client.Post(releaseAddressURL, "application/json", body)
+	r, err := c.client.Post(c.baseURL+releaseAddressURL, "application/json", body)
 	if err != nil {
 		return err
 	}
@@ -171,36 +230,62 @@ func (c *NWClient) ReleaseAddress(netconf *types.NetConf, ipaddress string) erro
 }
 
 // Hack interface: Query IP address from ipam by infra-container id
-func (c *NWClient) GetAddress(infracontainerid string) (string,error) {
-	req := ipamapi.GetAddressRequest{ContainerID: infracontainerid}
+func (c *NWClient) GetAddress(infracontainerid, ifname string) (string,error) {
+	req := ipamapi.GetAddressRequest{ContainerID: infracontainerid, Interface: ifname}
 	res := ipamapi.GetAddressResponse{}
 	buf, err := json.Marshal(req)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	body := bytes.NewBuffer(buf)
-	r, err := c.client.Post(getAddressURL, "application/json", body)
+	r, err := c.client.Post(c.baseURL+getAddressURL, "application/json", body)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer r.Body.Close()
 
 	switch {
 	case r.StatusCode != int(200):
 		log.Errorf("POST Status '%s' status code %d \n", r.Status, r.StatusCode)
-		return nil, fmt.Errorf("%s", r.Status)
+		return "", fmt.Errorf("%s", r.Status)
 	}
 
 	response, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	err = json.Unmarshal(response, &res)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
         return res.Address, nil
 
-}
\ No newline at end of file
+}
+
+// Record the host veth of the endpoint of the infra-container
+func (c *NWClient) SetEndpointVeth(infracontainerid, ifname, veth string) error {
+	req := ipamapi.SetEndpointVethRequest{ContainerID: infracontainerid, Interface: ifname, Veth: veth}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	body := bytes.NewBuffer(buf)
+	r, err := c.client.Post(c.baseURL+setVethURL, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != int(200) {
+		log.Errorf("POST Status '%s' status code %d \n", r.Status, r.StatusCode)
+		res := ipamapi.ErrorResponse{}
+		if info, err := ioutil.ReadAll(r.Body); err == nil && json.Unmarshal(info, &res) == nil && res.Err != "" {
+			return fmt.Errorf("%s", res.Err)
+		}
+		return fmt.Errorf("%s", r.Status)
+	}
+	return nil
+}
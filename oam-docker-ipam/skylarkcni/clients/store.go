@@ -0,0 +1,54 @@
+package clients
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"oam-docker-ipam/db"
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/skylarkcni/cniapi"
+	"oam-docker-ipam/skylarkcni/ipamapi"
+)
+
+// StoreClient allocates directly against the store with the logic of the
+// ipam driver, for nodes without the oam-docker-ipam server
+type StoreClient struct {
+	handler *ipamdriver.MyIPAMHandler
+}
+
+// NewStoreClient creates a client of the etcd cluster at endpoints. Candidate
+// IPs are probed on dad_interface unless it is empty.
+func NewStoreClient(endpoints []string, dad_interface string, dad_timeout time.Duration) *StoreClient {
+	db.SetDBAddr(strings.Join(endpoints, ","))
+	ipamdriver.InitializeHostname()
+	ipamdriver.SetDuplicateAddressDetection(dad_interface, dad_timeout)
+	return &StoreClient{handler: &ipamdriver.MyIPAMHandler{}}
+}
+
+// Request ip address from the store
+func (c *StoreClient) RequestAddress(podInfo *cniapi.CNIPodAttr, netConf *types.NetConf) (*ipamapi.RequestAddressResponse, error) {
+	return c.handler.RequestAddress(addressRequest(podInfo, netConf))
+}
+
+// Release IP address to the store
+func (c *StoreClient) ReleaseAddress(podInfo *cniapi.CNIPodAttr, netconf *types.NetConf, ipaddress string) error {
+	return c.handler.ReleaseAddress(releaseRequest(podInfo, netconf, ipaddress))
+}
+
+// Query IP address from the store by infra-container id and interface
+func (c *StoreClient) GetAddress(infracontainerid, ifname string) (string, error) {
+	res, err := c.handler.GetAddress(&ipamapi.GetAddressRequest{ContainerID: infracontainerid, Interface: ifname})
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Address of %s is %s", infracontainerid, res.Address)
+	return res.Address, nil
+}
+
+// Record the host veth of the endpoint in the store
+func (c *StoreClient) SetEndpointVeth(infracontainerid, ifname, veth string) error {
+	return c.handler.SetEndpointVeth(&ipamapi.SetEndpointVethRequest{ContainerID: infracontainerid, Interface: ifname, Veth: veth})
+}
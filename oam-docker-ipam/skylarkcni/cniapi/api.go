@@ -21,9 +21,22 @@ package cniapi
 type CNIPodAttr struct {
 	Name             string `json:"K8S_POD_NAME,omitempty"`
 	K8sNameSpace     string `json:"K8S_POD_NAMESPACE,omitempty"`
+	UID              string `json:"K8S_POD_UID,omitempty"`
 	InfraContainerID string `json:"K8S_POD_INFRA_CONTAINER_ID,omitempty"`
 	NwNameSpace      string `json:"CNI_NETNS,omitempty"`
 	IntfName         string `json:"CNI_IFNAME,omitempty"`
+
+	// RequestedIP and Pool come from the pod annotations
+	RequestedIP string `json:"-"`
+	Pool        string `json:"-"`
+	// Retain is how many seconds the IP of a StatefulSet pod is kept for
+	// it once released, 0 releases it right away
+	Retain int `json:"-"`
+	// the labels of the namespace, the pod and the node, pools select pods
+	// by them
+	NamespaceLabels map[string]string `json:"-"`
+	PodLabels       map[string]string `json:"-"`
+	NodeLabels      map[string]string `json:"-"`
 }
 
 // RspAddPod contains the response to the AddPod
@@ -0,0 +1,155 @@
+package cniapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// DefaultCNIVersion is the cniVersion of a netconf without one
+const DefaultCNIVersion = "0.1.0"
+
+// SupportedVersions are the cniVersions the skylark plugins understand
+var SupportedVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+func VersionSupported(version string) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionAtLeast compares the supported versions by their position
+func VersionAtLeast(version, min string) bool {
+	for _, v := range SupportedVersions {
+		if v == min {
+			return true
+		}
+		if v == version {
+			return false
+		}
+	}
+	return false
+}
+
+// PrintResult writes result to stdout in the format of the requested
+// cniVersion
+func PrintResult(result *current.Result, version string) error {
+	out, err := FormatResult(result, version)
+	if err != nil {
+		return err
+	}
+	return PrintJSON(out)
+}
+
+// FormatResult converts result to the requested cniVersion. 0.1.0 and 0.2.0
+// have a single ip4 section, 0.3.0 up to 0.4.0 share the same layout and
+// 1.0.0 drops the version of the ips.
+func FormatResult(result *current.Result, version string) (map[string]interface{}, error) {
+	var data []byte
+	var err error
+	switch version {
+	case "0.1.0", "0.2.0":
+		old, err := result.GetAsVersion("0.2.0")
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(old); err != nil {
+			return nil, err
+		}
+	default:
+		result.CNIVersion = current.ImplementedSpecVersion
+		if data, err = json.Marshal(result); err != nil {
+			return nil, err
+		}
+	}
+
+	out := map[string]interface{}{}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	out["cniVersion"] = version
+	ips, _ := out["ips"].([]interface{})
+	for i, ip := range ips {
+		m, ok := ip.(map[string]interface{})
+		if !ok || i >= len(result.IPs) {
+			continue
+		}
+		// the vendored types omit an interface index of 0. An ipam result
+		// has no interfaces to point to.
+		if len(result.Interfaces) == 0 {
+			delete(m, "interface")
+		} else {
+			m["interface"] = result.IPs[i].Interface
+		}
+		if version == "1.0.0" {
+			delete(m, "version")
+		}
+	}
+	return out, nil
+}
+
+// PrintVersion answers the VERSION command
+func PrintVersion(version string) error {
+	if !VersionSupported(version) {
+		version = SupportedVersions[len(SupportedVersions)-1]
+	}
+	return PrintJSON(map[string]interface{}{
+		"cniVersion":        version,
+		"SupportedVersions": SupportedVersions,
+	})
+}
+
+// PrintJSON writes obj to stdout
+func PrintJSON(obj interface{}) error {
+	data, err := json.MarshalIndent(obj, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
+
+// CNIError is the error a CNI plugin writes to stdout
+type CNIError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+// well known error codes of the CNI spec, codes from 100 are skylark's own
+const (
+	ErrIncompatibleVersion  uint = 1
+	ErrUnsupportedField     uint = 2
+	ErrUnknownContainer     uint = 3
+	ErrInvalidEnvironment   uint = 4
+	ErrIOFailure            uint = 5
+	ErrDecodingFailure      uint = 6
+	ErrInvalidNetworkConfig uint = 7
+	ErrTryAgainLater        uint = 11
+
+	ErrAllocateAddress uint = 100
+	ErrSetupInterface  uint = 101
+	ErrCheckInterface  uint = 102
+)
+
+// NewCNIError returns an error with code, details is optional
+func NewCNIError(code uint, msg string, details error) *CNIError {
+	e := &CNIError{Code: code, Msg: msg}
+	if details != nil {
+		e.Details = details.Error()
+	}
+	return e
+}
+
+func (e *CNIError) Error() string {
+	if e.Details == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Msg, e.Details)
+}
@@ -0,0 +1,117 @@
+package cniapi
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+func testResult(ifindex int) *current.Result {
+	if ifindex < 0 {
+		// the result of an ipam plugin
+		result := testResult(0)
+		result.Interfaces = nil
+		return result
+	}
+	_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+	return &current.Result{
+		Interfaces: []*current.Interface{{Name: "veth1"}, {Name: "eth0", Sandbox: "/proc/1/ns/net"}},
+		IPs: []*current.IPConfig{{
+			Version:   "4",
+			Interface: ifindex,
+			Address:   net.IPNet{IP: net.ParseIP("10.0.2.10").To4(), Mask: net.CIDRMask(24, 32)},
+			Gateway:   net.ParseIP("10.0.2.1"),
+		}},
+		Routes: []*types.Route{{Dst: *dst, GW: net.ParseIP("10.0.2.1")}},
+		DNS:    types.DNS{Nameservers: []string{"10.0.0.10"}},
+	}
+}
+
+const (
+	result020  = `{"dns":{"nameservers":["10.0.0.10"]},"ip4":{"gateway":"10.0.2.1","ip":"10.0.2.10/24","routes":[{"dst":"0.0.0.0/0","gw":"10.0.2.1"}]}}`
+	result030  = `{"dns":{"nameservers":["10.0.0.10"]},"interfaces":[{"name":"veth1"},{"name":"eth0","sandbox":"/proc/1/ns/net"}],"ips":[{"address":"10.0.2.10/24","gateway":"10.0.2.1","interface":1,"version":"4"}],"routes":[{"dst":"0.0.0.0/0","gw":"10.0.2.1"}]}`
+	resultIPAM = `{"dns":{"nameservers":["10.0.0.10"]},"ips":[{"address":"10.0.2.10/24","gateway":"10.0.2.1","version":"4"}],"routes":[{"dst":"0.0.0.0/0","gw":"10.0.2.1"}]}`
+	result100  = `{"dns":{"nameservers":["10.0.0.10"]},"interfaces":[{"name":"veth1"},{"name":"eth0","sandbox":"/proc/1/ns/net"}],"ips":[{"address":"10.0.2.10/24","gateway":"10.0.2.1","interface":1}],"routes":[{"dst":"0.0.0.0/0","gw":"10.0.2.1"}]}`
+	// the interface index 0 is kept
+	result040eth0 = `{"dns":{"nameservers":["10.0.0.10"]},"interfaces":[{"name":"veth1"},{"name":"eth0","sandbox":"/proc/1/ns/net"}],"ips":[{"address":"10.0.2.10/24","gateway":"10.0.2.1","interface":0,"version":"4"}],"routes":[{"dst":"0.0.0.0/0","gw":"10.0.2.1"}]}`
+)
+
+func TestFormatResult(t *testing.T) {
+	tests := []struct {
+		version string
+		ifindex int
+		want    string
+	}{
+		{"0.1.0", 1, result020},
+		{"0.2.0", 1, result020},
+		{"0.3.0", 1, result030},
+		{"0.3.1", 1, result030},
+		{"0.4.0", 1, result030},
+		{"0.4.0", 0, result040eth0},
+		{"0.4.0", -1, resultIPAM},
+		{"0.2.0", -1, result020},
+		{"1.0.0", 1, result100},
+	}
+	for _, test := range tests {
+		got, err := FormatResult(testResult(test.ifindex), test.version)
+		if err != nil {
+			t.Errorf("%s: %v", test.version, err)
+			continue
+		}
+		// compare what the runtime reads
+		data, _ := json.Marshal(got)
+		var read, want map[string]interface{}
+		if err = json.Unmarshal(data, &read); err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		want["cniVersion"] = test.version
+		if !reflect.DeepEqual(read, want) {
+			t.Errorf("%s: got %s, want %s", test.version, data, test.want)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version, min string
+		want         bool
+	}{
+		{"0.1.0", "0.1.0", true},
+		{"0.2.0", "0.3.0", false},
+		{"0.3.0", "0.3.0", true},
+		{"0.3.1", "0.3.0", true},
+		{"0.3.0", "0.3.1", false},
+		{"0.4.0", "0.4.0", true},
+		{"1.0.0", "0.4.0", true},
+		{"0.4.0", "1.0.0", false},
+		// an unknown version counts as newer than the supported ones
+		{"0.5.0", "0.1.0", true},
+		{"0.5.0", "0.4.0", true},
+		{"0.3.1", "0.5.0", false},
+	}
+	for _, test := range tests {
+		if got := VersionAtLeast(test.version, test.min); got != test.want {
+			t.Errorf("VersionAtLeast(%q, %q) = %v, want %v", test.version, test.min, got, test.want)
+		}
+	}
+}
+
+func TestVersionSupported(t *testing.T) {
+	for _, version := range []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0"} {
+		if !VersionSupported(version) {
+			t.Errorf("%s is not supported", version)
+		}
+	}
+	for _, version := range []string{"", "0.3", "0.5.0", "2.0.0"} {
+		if VersionSupported(version) {
+			t.Errorf("%s is supported", version)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"syscall"
 
+	"oam-docker-ipam/arp"
 	"oam-docker-ipam/skylarkcni/cniapi"
 	//"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -24,7 +25,6 @@ import (
 
 const defaultBrName = "br0"
 const defaultMtu = 1500
-const haripinMode = false
 
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
@@ -170,122 +170,387 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 }
 
 
+// renameInNetns gives the device tmpName moved into netns its final name.
+// The device is deleted when that fails.
+func renameInNetns(netns ns.NetNS, tmpName, ifName string) (*current.Interface, error) {
+	contIface := &current.Interface{}
+	err := netns.Do(func(_ ns.NetNS) error {
+		if err := ip.RenameLink(tmpName, ifName); err != nil {
+			if link, err := netlink.LinkByName(tmpName); err == nil {
+				netlink.LinkDel(link)
+			}
+			return fmt.Errorf("failed to rename %q to %q: %v", tmpName, ifName, err)
+		}
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch %q: %v", ifName, err)
+		}
+		contIface.Name = ifName
+		contIface.Mac = link.Attrs().HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contIface, nil
+}
+
 func calcGatewayIP(ipn *net.IPNet) net.IP {
 	nid := ipn.IP.Mask(ipn.Mask)
 	return ip.NextIP(nid)
 }
 
-func cmdAdd(pInfo *cniapi.CNIPodAttr, netconf *types.NetConf, ipaddress string) error {
-	ifname := pInfo.IntfName
-	networkns := pInfo.NwNameSpace
+// setupBridge creates the bridge of netconf and applies its options. gwNet
+// is assigned to the bridge when it is the gateway.
+func setupBridge(netconf *NetConf, gwNet *net.IPNet) (*netlink.Bridge, error) {
 	//create bridge if not existed
-	br0, err := ensureBridge(defaultBrName, defaultMtu)
+	br, err := ensureBridge(netconf.Bridge, netconf.MTU)
 	if err != nil {
-		log.Errorf("failed to create bridge %s", defaultBrName)
-		return err
+		return nil, err
+	}
+	if netconf.PromiscMode {
+		if err = netlink.SetPromiscOn(br); err != nil {
+			return nil, fmt.Errorf("could not set promiscuous mode on %q: %v", netconf.Bridge, err)
+		}
+	}
+	if netconf.Vlan != 0 {
+		uplink, err := ensureVlanLink(netconf.Master, netconf.Vlan)
+		if err != nil {
+			return nil, err
+		}
+		if uplink.Attrs().MasterIndex != br.Attrs().Index {
+			if err = netlink.LinkSetMaster(uplink, br); err != nil {
+				return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", uplink.Attrs().Name, netconf.Bridge, err)
+			}
+		}
+	}
+	if netconf.IsGateway {
+		if gwNet.IP == nil {
+			return nil, fmt.Errorf("no gateway address for bridge %q", netconf.Bridge)
+		}
+		if err = ensureBridgeAddr(br, gwNet, false); err != nil {
+			return nil, err
+		}
+		if err = ip.EnableIP4Forward(); err != nil {
+			return nil, fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+	}
+	// Refetch the bridge since its MAC address may change when the first
+	// port is added or after its IP address is set
+	return bridgeByName(netconf.Bridge)
+}
+
+// ensureVlanLink returns the <master>.<vlan> device, it is created when
+// missing
+func ensureVlanLink(master string, vlan int) (netlink.Link, error) {
+	name := fmt.Sprintf("%s.%d", master, vlan)
+	if link, err := netlink.LinkByName(name); err == nil {
+		v, ok := link.(*netlink.Vlan)
+		if !ok || v.VlanId != vlan {
+			return nil, fmt.Errorf("%q already exists but is not vlan %d", name, vlan)
+		}
+		return link, netlink.LinkSetUp(link)
+	}
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+	v := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: m.Attrs().Index},
+		VlanId:    vlan,
 	}
+	if err = netlink.LinkAdd(v); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", name, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+	log.Infof("Created vlan %s on %s", name, master)
+	return link, nil
+}
+
+// masterLink returns the uplink macvlan and ipvlan devices are created on
+// and the MTU they get
+func masterLink(netconf *NetConf) (netlink.Link, int, error) {
+	var m netlink.Link
+	var err error
+	if netconf.Vlan != 0 {
+		m, err = ensureVlanLink(netconf.Master, netconf.Vlan)
+	} else if m, err = netlink.LinkByName(netconf.Master); err != nil {
+		err = fmt.Errorf("failed to lookup master %q: %v", netconf.Master, err)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	mtu := netconf.MTU
+	if mtu == 0 {
+		mtu = m.Attrs().MTU
+	}
+	return m, mtu, nil
+}
+
+// parseAddress returns the container address from the CIDR address skylark
+// handed out, falling back to the prefix of the subnet of the netconf
+func parseAddress(address, subnet string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		ipaddr, ipnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		return &net.IPNet{IP: ipaddr, Mask: ipnet.Mask}, nil
+	}
+	parts := strings.Split(subnet, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid subnet %q", subnet)
+	}
+	prefix, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q", subnet)
+	}
+	ipaddr := net.ParseIP(address)
+	if ipaddr == nil {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	return &net.IPNet{IP: ipaddr, Mask: net.CIDRMask(prefix, net.IPv4len*8)}, nil
+}
+
+// cmdAdd attaches the pod to the network with ipaddress and returns what it
+// set up as a CNI result
+func cmdAdd(pInfo *cniapi.CNIPodAttr, netconf *NetConf, ipaddress string) (*current.Result, error) {
+	ifname := pInfo.IntfName
+	networkns := pInfo.NwNameSpace
 
 	//open network namespace
 	netns, err := ns.GetNS(networkns)
 	if err != nil {
 		log.Errorf("failed to open netns %q: %v", networkns, err)
-		return err
+		return nil, err
 	}
 	defer netns.Close()
 
-	//setup veth pair
-	hostInterface, containerInterface, err := setupVeth(netns, br0, ifname, defaultMtu, haripinMode)
+	ipaddr, err := parseAddress(ipaddress, netconf.IPAM.Subnet)
 	if err != nil {
-		log.Errorf("failed to setup veth pair for %s", networkns)
-		return err
+		return nil, err
 	}
-	log.Infof("Host Interface: %v", hostInterface)
-	log.Infof("Container Interface: %v", containerInterface)
+	gw := net.ParseIP(netconf.IPAM.Gateway)
+	if gw == nil && netconf.IsGateway {
+		gw = calcGatewayIP(ipaddr)
+	}
+
+	result := &current.Result{}
+	var containerInterface *current.Interface
+	switch netconf.Type {
+	case "macvlan":
+		containerInterface, err = setupMacvlan(netns, netconf, ifname)
+		if err != nil {
+			log.Errorf("failed to setup macvlan on %s for %s", netconf.uplink(), networkns)
+			return nil, err
+		}
+	case "ipvlan":
+		containerInterface, err = setupIpvlan(netns, netconf, ifname)
+		if err != nil {
+			log.Errorf("failed to setup ipvlan on %s for %s", netconf.uplink(), networkns)
+			return nil, err
+		}
+	default:
+		br, err := setupBridge(netconf, &net.IPNet{IP: gw, Mask: ipaddr.Mask})
+		if err != nil {
+			log.Errorf("failed to setup bridge %s", netconf.Bridge)
+			return nil, err
+		}
 
-	//provision container: ip address, default route, mac address
-        if err = netns.Do(func(_ ns.NetNS) error {
+		//setup veth pair
+		var hostInterface *current.Interface
+		hostInterface, containerInterface, err = setupVeth(netns, br, ifname, netconf.MTU, netconf.HairpinMode)
+		if err != nil {
+			log.Errorf("failed to setup veth pair for %s", networkns)
+			return nil, err
+		}
+		log.Infof("Host Interface: %v", hostInterface)
+		result.Interfaces = append(result.Interfaces, hostInterface)
+	}
+	result.Interfaces = append(result.Interfaces, containerInterface)
+
+	// ipvlan and passthru macvlan devices share the MAC of the master,
+	// changing it would change the master as well
+	setMac := netconf.MacMode == "ip" &&
+		(netconf.Type == "bridge" || netconf.Type == "macvlan" && netconf.Mode != "passthru")
+	// ipvlan l3 devices do not resolve neighbours, everything goes out
+	// through the device and the master routes it
+	l3 := netconf.Type == "ipvlan" && netconf.Mode != "l2"
+	if l3 {
+		gw = nil
+	}
+	routes := podRoutes(netconf, gw, netconf.defaultRoute(ifname))
 
+	//provision container: ip address, routes, mac address
+	if err = netns.Do(func(_ ns.NetNS) error {
+		if err := configureIface(ifname, ipaddr, routes, setMac, l3); err != nil {
+			return err
+		}
+		// refetch the device since its MAC address may have changed
 		link, err := netlink.LinkByName(ifname)
 		if err != nil {
-			log.Errorf("failed to lookup %q: %v", ifname, err)
 			return err
 		}
+		containerInterface.Mac = link.Attrs().HardwareAddr.String()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	log.Infof("Container Interface: %v", containerInterface)
 
-		if err := netlink.LinkSetUp(link); err != nil {
-			return fmt.Errorf("failed to set %q UP: %v", ifname, err)
+	result.IPs = []*current.IPConfig{{
+		Version:   "4",
+		Interface: len(result.Interfaces) - 1,
+		Address:   *ipaddr,
+		Gateway:   gw,
+	}}
+	result.Routes = routes
+	result.DNS = netconf.DNS
+
+	log.Infof("Success ADD: %s, %s", networkns, ifname)
+	return result, nil
+}
+
+// podRoutes returns the routes of the pod interface, the default route first
+// when it has it. Routes without a gateway of their own go through gw, or
+// straight out of the interface when gw is nil.
+func podRoutes(netconf *NetConf, gw net.IP, defaultRoute bool) []*types.Route {
+	var routes []*types.Route
+	if defaultRoute {
+		_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+		routes = append(routes, &types.Route{Dst: *defaultNet, GW: gw})
+	}
+	for _, r := range netconf.Routes {
+		route := *r
+		if route.GW == nil {
+			route.GW = gw
 		}
+		routes = append(routes, &route)
+	}
+	return routes
+}
 
-		//provision ip address
-		subnet := netconf.IPAM.Subnet
-		s1 := strings.Split(subnet, "/")[1]
-		prefix, _ := strconv.Atoi(s1)
-		ipaddr := net.IPNet{IP: net.ParseIP(ipaddress), Mask: net.CIDRMask(prefix, net.IPv4len*8)}
-		addr := &netlink.Addr{IPNet: &ipaddr, Label: ""}
-		if err = netlink.AddrAdd(link, addr); err != nil {
-			log.Errorf("failed to add IP addr %v to %q: %v", ipaddr, ifname, err)
+// cmdCheck verifies the interface of the pod still has ipaddress, and a
+// default route when it should
+func cmdCheck(pInfo *cniapi.CNIPodAttr, ipaddress string, defaultRoute bool) error {
+	ifname := pInfo.IntfName
+	return ns.WithNetNSPath(pInfo.NwNameSpace, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifname, err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%q is down", ifname)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
 			return err
 		}
-
-		//provision gateway
-		gw := net.ParseIP(netconf.IPAM.Gateway)
-		if err = ip.AddDefaultRoute(gw, link); err != nil {
-			// we skip over duplicate routes as we assume the first one wins
-			if !os.IsExist(err) {
-				log.Errorf("failed to add default route %v dev %v': %v", gw, ifname, err)
-				return err
+		found := false
+		for _, a := range addrs {
+			if a.IPNet.IP.String() == ipaddress {
+				found = true
 			}
 		}
-
-		//provision mac address
-		if err := ip.SetHWAddrByIP(ifname, ipaddr.IP, nil ); err != nil {
-			return err
+		if !found {
+			return fmt.Errorf("%q does not have address %s", ifname, ipaddress)
 		}
-
-		// Refetch the veth since its MAC address may changed
-		link, err = netlink.LinkByName(ifname)
+		if !defaultRoute {
+			return nil
+		}
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
 		if err != nil {
-			log.Errorf("could not lookup %q: %v", ifname, err)
 			return err
 		}
+		for _, r := range routes {
+			if r.Dst == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q has no default route", ifname)
+	})
+}
 
-		// Refetch the bridge since its MAC address may change when the first
-		// veth is added or after its IP address is set
-		br0, err = bridgeByName(defaultBrName)
-		if err != nil {
+// configureIface brings up ifname in the current netns with ipaddr and
+// routes
+func configureIface(ifname string, ipaddr *net.IPNet, routes []*types.Route, setMac, l3 bool) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		log.Errorf("failed to lookup %q: %v", ifname, err)
+		return err
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", ifname, err)
+	}
+
+	//provision ip address
+	addr := &netlink.Addr{IPNet: ipaddr, Label: ""}
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		log.Errorf("failed to add IP addr %v to %q: %v", ipaddr, ifname, err)
+		return err
+	}
+
+	//provision routes
+	for _, r := range routes {
+		if err = ip.AddRoute(&r.Dst, r.GW, link); err != nil {
+			// we skip over duplicate routes as we assume the first one wins
+			if !os.IsExist(err) {
+				log.Errorf("failed to add route %v via %v dev %v': %v", r.Dst.String(), r.GW, ifname, err)
+				return err
+			}
+		}
+	}
+
+	//provision mac address
+	if setMac {
+		if err := ip.SetHWAddrByIP(ifname, ipaddr.IP, nil); err != nil {
 			return err
 		}
+	}
 
-		log.Infof("Success ADD: %s, %s", networkns, ifname)
+	// announce the new address so neighbours drop stale arp entries
+	if l3 {
 		return nil
-        }); err != nil {
-		return err
 	}
-
-        return nil
+	if err := arp.Announce(ifname, ipaddr.IP); err != nil {
+		log.Warnf("failed to send gratuitous arp for %v on %q: %v", ipaddr.IP, ifname, err)
+	}
+	return nil
 }
 
+// cmdDel removes the pod interface. DEL may be called more than once and
+// after the netns is gone, a missing netns or interface is not an error.
 func cmdDel(networkns string, ifname string) error {
 	if networkns == "" {
-	        return nil
-        }
+		return nil
+	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	// If the device isn't there then don't try to clean up IP masq either.
-	var ipn *net.IPNet
+	// the veth or macvlan goes away with its address
 	err := ns.WithNetNSPath(networkns, func(_ ns.NetNS) error {
-		var err error
-		ipn, err = ip.DelLinkByNameAddr(ifname, netlink.FAMILY_V4)
-		if err != nil && err == ip.ErrLinkNotFound {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil && err.Error() == "Link not found" {
 			return nil
 		}
-		return err
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifname, err)
+		}
+		return netlink.LinkDel(link)
 	})
-
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-        fmt.Println("Success DEL: %s, %s", networkns, ifname)
+	log.Infof("Success DEL: %s, %s", networkns, ifname)
 	return nil
 }
 
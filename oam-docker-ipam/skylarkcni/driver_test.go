@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestPodRoutes(t *testing.T) {
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	_, dst1, _ := net.ParseCIDR("10.9.0.0/16")
+	_, dst2, _ := net.ParseCIDR("10.8.0.0/16")
+	gw, other := net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.6")
+	netconf := &NetConf{Routes: []*types.Route{{Dst: *dst1}, {Dst: *dst2, GW: other}}}
+
+	tests := []struct {
+		gw           net.IP
+		defaultRoute bool
+		want         []*types.Route
+	}{
+		{gw, true, []*types.Route{{Dst: *defaultNet, GW: gw}, {Dst: *dst1, GW: gw}, {Dst: *dst2, GW: other}}},
+		{gw, false, []*types.Route{{Dst: *dst1, GW: gw}, {Dst: *dst2, GW: other}}},
+		// no gateway, the routes go straight out of the interface
+		{nil, true, []*types.Route{{Dst: *defaultNet}, {Dst: *dst1}, {Dst: *dst2, GW: other}}},
+	}
+	for _, test := range tests {
+		routes := podRoutes(netconf, test.gw, test.defaultRoute)
+		if !reflect.DeepEqual(routes, test.want) {
+			t.Errorf("gw %v default %v: got %v, want %v", test.gw, test.defaultRoute, routes, test.want)
+		}
+	}
+	if netconf.Routes[0].GW != nil {
+		t.Error("the routes of the netconf were changed")
+	}
+	if routes := podRoutes(&NetConf{}, gw, false); len(routes) != 0 {
+		t.Errorf("got routes %v, want none", routes)
+	}
+}
@@ -17,6 +17,7 @@ const (
 	requestAddressPath = "/IpamDriver.RequestAddress"
 	releaseAddressPath = "/IpamDriver.ReleaseAddress"
 	getAddressPath     = "/IpamDriver.GetAddress"
+	setVethPath        = "/IpamDriver.SetEndpointVeth"
 )
 
 // PluginPath is the path to the listen socket directory for skylark
@@ -34,6 +35,7 @@ type Ipam interface {
 	RequestAddress(*RequestAddressRequest) (*RequestAddressResponse, error)
 	ReleaseAddress(*ReleaseAddressRequest) error
 	GetAddress(*GetAddressRequest) (*GetAddressResponse, error)
+	SetEndpointVeth(*SetEndpointVethRequest) error
 }
 
 // Response is the basic response structure used in all responses
@@ -114,6 +116,11 @@ type RequestAddressResponse struct {
 type ReleaseAddressRequest struct {
 	PoolID  string
 	Address string
+	// ContainerID and Interface name the endpoint the address is released
+	// for, it is kept when it went to another endpoint meanwhile (only used
+	// for cni)
+	ContainerID string `json:",omitempty"`
+	Interface   string `json:",omitempty"`
 }
 
 // ReleaseAddressResponse represents the response message to a ``release address`` request
@@ -121,9 +128,11 @@ type ReleaseAddressResponse struct {
 	//Response
 }
 
-// GetAddressRequest get the ip address by container id (only used for cni)
+// GetAddressRequest get the ip address by container id and interface (only
+// used for cni)
 type GetAddressRequest struct {
 	ContainerID string
+	Interface   string `json:",omitempty"`
 }
 
 // GetAddressResponse returns ip address by specified container id
@@ -131,6 +140,14 @@ type GetAddressResponse struct {
 	Address string
 }
 
+// SetEndpointVethRequest records the host end of the veth of the endpoint of
+// a container and interface (only used for cni)
+type SetEndpointVethRequest struct {
+	ContainerID string
+	Interface   string `json:",omitempty"`
+	Veth        string
+}
+
 
 // ErrorResponse is a formatted error message that libnetwork can understand
 type ErrorResponse struct {
@@ -243,5 +260,19 @@ func (h *Handler) initMux() {
 		}
 		sdk.EncodeResponse(w, res, "")
 	})
+	h.HandleFunc(setVethPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &SetEndpointVethRequest{}
+		err := sdk.DecodeRequest(w, r, req)
+		if err != nil {
+			return
+		}
+		err = h.ipam.SetEndpointVeth(req)
+		if err != nil {
+			msg := err.Error()
+			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			return
+		}
+		sdk.EncodeResponse(w, make(map[string]string), "")
+	})
 
 }
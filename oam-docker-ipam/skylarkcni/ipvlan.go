@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+)
+
+func ipvlanModeFromString(s string) (netlink.IPVlanMode, error) {
+	switch s {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+	}
+}
+
+// setupIpvlan creates an ipvlan device on the master and moves it into
+// netns as ifName. All ipvlan devices share the MAC of the master, so the
+// switch port only ever learns one address.
+func setupIpvlan(netns ns.NetNS, netconf *NetConf, ifName string) (*current.Interface, error) {
+	mode, err := ipvlanModeFromString(netconf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	m, mtu, err := masterLink(netconf)
+	if err != nil {
+		return nil, err
+	}
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+
+	iv := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			MTU:         mtu,
+			Name:        tmpName,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+	if err := netlink.LinkAdd(iv); err != nil {
+		return nil, fmt.Errorf("failed to create ipvlan: %v", err)
+	}
+
+	return renameInNetns(netns, tmpName, ifName)
+}
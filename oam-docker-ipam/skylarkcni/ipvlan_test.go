@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestIpvlanConf(t *testing.T) {
+	n, err := loadConf([]byte(`{"type": "ipvlan", "master": "eth1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Master != "eth1" || n.Mode != "l2" {
+		t.Errorf("got master %q mode %q, want eth1 l2", n.Master, n.Mode)
+	}
+
+	tests := []struct {
+		mode string
+		want netlink.IPVlanMode
+	}{
+		{"l2", netlink.IPVLAN_MODE_L2},
+		{"l3", netlink.IPVLAN_MODE_L3},
+		{"l3s", netlink.IPVLAN_MODE_L3S},
+	}
+	for _, test := range tests {
+		mode, err := ipvlanModeFromString(test.mode)
+		if err != nil || mode != test.want {
+			t.Errorf("%s: got %v %v, want %v", test.mode, mode, err, test.want)
+		}
+	}
+
+	for _, conf := range []string{
+		`{"type": "ipvlan"}`,
+		`{"type": "ipvlan", "master": "eth1", "mode": "bridge"}`,
+	} {
+		if _, err := loadConf([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", conf)
+		}
+	}
+}
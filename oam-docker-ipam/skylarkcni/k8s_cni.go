@@ -22,20 +22,27 @@ import (
 	"os"
 	"strings"
 	"io/ioutil"
+	"time"
 
+	"oam-docker-ipam/k8s"
 	"oam-docker-ipam/skylarkcni/cniapi"
 	"oam-docker-ipam/skylarkcni/clients"
-	"github.com/containernetworking/cni/pkg/types"
+	"oam-docker-ipam/skylarkcni/ipamapi"
 
 	logger "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types/current"
 )
 
-//CNIError : return format from CNI plugin
-type CNIError struct {
-	CNIVersion string `json:"cniVersion"`
-	Code       uint   `json:"code"`
-	Msg        string `json:"msg"`
-	Details    string `json:"details,omitempty"`
+// exitWithError writes err to stdout as a CNI error and exits non-zero
+func exitWithError(err error, version string) {
+	e, ok := err.(*cniapi.CNIError)
+	if !ok {
+		e = cniapi.NewCNIError(cniapi.ErrSetupInterface, err.Error(), nil)
+	}
+	e.CNIVersion = version
+	log.Errorf("%s", e.Error())
+	cniapi.PrintJSON(e)
+	os.Exit(1)
 }
 
 var log *logger.Entry
@@ -61,49 +68,250 @@ func getPodInfo(ppInfo *cniapi.CNIPodAttr) error {
 	return nil
 }
 
-func addPodToNet(nc *clients.NWClient, pInfo *cniapi.CNIPodAttr, netconf *types.NetConf) {
+// podNetwork reads the annotations of the pod when the netconf has a
+// kubernetes section and records the IP and pool they ask for and the labels
+// pools select by in pInfo. A pod unknown to the API server gets the
+// defaults.
+func podNetwork(pInfo *cniapi.CNIPodAttr, netconf *NetConf) (*k8s.PodNetwork, error) {
+	if netconf.Kubernetes == nil || pInfo.Name == "" {
+		return &k8s.PodNetwork{}, nil
+	}
+	kc, err := k8s.NewClient(netconf.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+	pn, err := kc.GetPodNetwork(pInfo.K8sNameSpace, pInfo.Name)
+	if err == k8s.ErrNotFound {
+		log.Warnf("Pod %s/%s not found, ignoring its annotations", pInfo.K8sNameSpace, pInfo.Name)
+		return &k8s.PodNetwork{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Annotations of %s/%s: %+v", pInfo.K8sNameSpace, pInfo.Name, pn)
+	pInfo.RequestedIP = pn.IP
+	pInfo.Pool = pn.Pool
+	pInfo.NamespaceLabels = pn.NamespaceLabels
+	pInfo.PodLabels = pn.PodLabels
+	pInfo.NodeLabels = pn.NodeLabels
+	if pn.StatefulSet {
+		pInfo.Retain = int(netconf.retention / time.Second)
+	}
+	return pn, nil
+}
+
+// addPodToNet attaches the pod to the networks of netconf. The networks
+// attached before one fails are detached again.
+func addPodToNet(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, netconf *NetConf) error {
+	pn, err := podNetwork(pInfo, netconf)
+	if err != nil {
+		return cniapi.NewCNIError(cniapi.ErrTryAgainLater, "failed to read the pod annotations", err)
+	}
+
+	result := &current.Result{}
+	var attached []*cniapi.CNIPodAttr
+	for i, network := range netconf.attachments() {
+		p, npn := attachment(pInfo, network, pn)
+		r, err := attachPod(nc, p, network, npn)
+		if err != nil {
+			for j := len(attached) - 1; j >= 0; j-- {
+				if err := detachPod(nc, attached[j], netconf.attachments()[j]); err != nil {
+					log.Errorf("Failed to detach %s: %v", attached[j].IntfName, err)
+				}
+			}
+			return err
+		}
+		attached = append(attached, p)
+		if i == 0 {
+			*result = *r
+			continue
+		}
+		mergeResult(result, r)
+	}
+	if len(netconf.networks) != 0 && len(netconf.DNS.Nameservers) != 0 {
+		result.DNS = netconf.DNS
+	}
+	return cniapi.PrintResult(result, netconf.CNIVersion)
+}
+
+// mergeResult appends the interfaces, ips and routes of r to result. The ips
+// of r keep pointing at the interfaces of their network.
+func mergeResult(result, r *current.Result) {
+	offset := len(result.Interfaces)
+	result.Interfaces = append(result.Interfaces, r.Interfaces...)
+	for _, ipc := range r.IPs {
+		c := *ipc
+		c.Interface += offset
+		result.IPs = append(result.IPs, &c)
+	}
+	result.Routes = append(result.Routes, r.Routes...)
+}
+
+// attachment returns the pod attributes and annotations of network. The IP,
+// pool, labels and bandwidth the pod asks for are for the interface with the
+// default route, the other interfaces get any address of their subnet.
+func attachment(pInfo *cniapi.CNIPodAttr, network *NetConf, pn *k8s.PodNetwork) (*cniapi.CNIPodAttr, *k8s.PodNetwork) {
+	p := *pInfo
+	p.IntfName = network.ifName(pInfo.IntfName)
+	if network.defaultRoute(p.IntfName) {
+		return &p, pn
+	}
+	p.RequestedIP, p.Pool = "", ""
+	p.NamespaceLabels, p.PodLabels, p.NodeLabels = nil, nil, nil
+	return &p, &k8s.PodNetwork{}
+}
+
+// attachPod allocates an address and sets up the pod interface. A repeated
+// ADD gets the same address and replaces the interface an earlier ADD left,
+// on failure the interface is removed and the address released.
+func attachPod(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, netconf *NetConf, pn *k8s.PodNetwork) (*current.Result, error) {
+	switch netconf.Type {
+	case "bridge", "macvlan", "ipvlan":
+	default:
+		return nil, cniapi.NewCNIError(cniapi.ErrInvalidNetworkConfig, fmt.Sprintf("unsupported network type %q", netconf.Type), nil)
+	}
 
 	// Add Pod to network
-	result, err := nc.RequestAddress(pInfo, netconf)
-	if err != nil  {
+	address, err := nc.RequestAddress(pInfo, &netconf.NetConf)
+	if err != nil {
 		log.Errorf("EP create failed for pod: %s/%s",
 			pInfo.K8sNameSpace, pInfo.Name)
-		os.Exit(1)
+		return nil, cniapi.NewCNIError(cniapi.ErrAllocateAddress, "failed to allocate an address", err)
 	}
 
-        if netconf.Type == "bridge" {
-		err := cmdAdd(pInfo, netconf, result.Address)
-		if err != nil {
-			log.Errorf("fail to add pod to net %v", err)
-			fmt.Printf(err)
+	result, err := podSetup(pInfo, netconf, pn, address)
+	if err == nil {
+		err = recordVeth(nc, pInfo, result)
+	}
+	if err != nil {
+		log.Errorf("Rolling back %s of %s: %v", address.Address, pInfo.IntfName, err)
+		if e := podTeardown(pInfo); e != nil {
+			log.Errorf("Failed to remove %s: %v", pInfo.IntfName, e)
 		}
+		if e := nc.ReleaseAddress(pInfo, &netconf.NetConf, address.Address); e != nil {
+			log.Errorf("Failed to release %s: %v", address.Address, e)
+		}
+		return nil, err
 	}
 
-	if netconf.Type == "macvlan" {
+	log.Infof("EP created IP: %s on %s\n", address.Address, pInfo.IntfName)
+	return result, nil
+}
+
+// podSetup and podTeardown change the host, tests replace them
+var (
+	podSetup    = setupPod
+	podTeardown = teardownPod
+)
+
+func setupPod(pInfo *cniapi.CNIPodAttr, netconf *NetConf, pn *k8s.PodNetwork, address *ipamapi.RequestAddressResponse) (*current.Result, error) {
+	if err := applyPoolData(netconf, address.Data); err != nil {
+		return nil, cniapi.NewCNIError(cniapi.ErrAllocateAddress, "invalid pool settings", err)
+	}
+	bw, err := podBandwidth(pInfo, netconf, pn, address.Data)
+	if err != nil {
+		return nil, cniapi.NewCNIError(cniapi.ErrAllocateAddress, "invalid pool settings", err)
+	}
+	// the interface of an earlier ADD that did not complete
+	if err = cmdDel(pInfo.NwNameSpace, pInfo.IntfName); err != nil {
+		return nil, cniapi.NewCNIError(cniapi.ErrSetupInterface, "failed to remove the stale pod interface", err)
+	}
+	result, err := cmdAdd(pInfo, netconf, address.Address)
+	if err != nil {
+		return nil, cniapi.NewCNIError(cniapi.ErrSetupInterface, "failed to add pod to net", err)
+	}
+	if err = setupBandwidth(netconf, pInfo, result, bw); err != nil {
+		return nil, cniapi.NewCNIError(cniapi.ErrSetupInterface, "failed to limit the pod bandwidth", err)
+	}
+	if err = setupPortMappings(netconf, pInfo, result); err != nil {
+		return nil, cniapi.NewCNIError(cniapi.ErrSetupInterface, "failed to map the host ports of the pod", err)
+	}
+	return result, nil
+}
 
+// teardownPod removes the pod interface, its ifb device and its host ports.
+// It carries on after a failure and returns the first error.
+func teardownPod(pInfo *cniapi.CNIPodAttr) error {
+	var err error
+	if e := cmdDel(pInfo.NwNameSpace, pInfo.IntfName); e != nil {
+		err = cniapi.NewCNIError(cniapi.ErrIOFailure, "failed to remove the pod interface", e)
+	}
+	if e := teardownBandwidth(pInfo); e != nil && err == nil {
+		err = cniapi.NewCNIError(cniapi.ErrIOFailure, "failed to remove the ifb device of the pod", e)
 	}
+	if e := teardownPortMappings(pInfo); e != nil && err == nil {
+		err = cniapi.NewCNIError(cniapi.ErrIOFailure, "failed to remove the host ports of the pod", e)
+	}
+	return err
+}
 
-	log.Infof("EP created IP: %s\n", result.Address)
-	// Write the ip address of the created endpoint to stdout
-	fmt.Printf("{\n\"cniVersion\": \"0.1.0\",\n")
-	fmt.Printf("\"ip4\": {\n")
-	fmt.Printf("\"ip\": \"%s\"\n}\n}\n", result.Address)
+// recordVeth stores the host veth of a bridge pod with its endpoint, the
+// network policies of the node are enforced on it
+func recordVeth(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, result *current.Result) error {
+	if len(result.Interfaces) < 2 || result.Interfaces[0].Sandbox != "" {
+		return nil
+	}
+	if err := nc.SetEndpointVeth(pInfo.InfraContainerID, pInfo.IntfName, result.Interfaces[0].Name); err != nil {
+		return cniapi.NewCNIError(cniapi.ErrTryAgainLater, "failed to record the host veth", err)
+	}
+	return nil
 }
 
-func deletePodFromNet(nc *clients.NWClient, pInfo *cniapi.CNIPodAttr, netconf *types.NetConf) {
-	//Query ip address by infracontainer id
-	ipaddress, err := nc.GetAddress(pInfo.InfraContainerID)
-	if err != nil {
-		log.Errorf("Failed to get ip address for %s, %v",pInfo.InfraContainerID, err)
+// deletePodFromNet detaches the pod from all the networks of netconf
+func deletePodFromNet(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, netconf *NetConf) error {
+	var err error
+	for _, network := range netconf.attachments() {
+		p := *pInfo
+		p.IntfName = network.ifName(pInfo.IntfName)
+		if e := detachPod(nc, &p, network); e != nil && err == nil {
+			err = e
+		}
 	}
+	return err
+}
 
-	err = nc.ReleaseAddress(netconf, ipaddress)
+// detachPod releases the address of the pod interface and removes it. DEL
+// may be repeated, an unknown container or a missing netns is not an error.
+// When the address can not be released the interface is still removed, and
+// the DEL fails so the runtime retries it.
+func detachPod(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, netconf *NetConf) error {
+	var released error
+	//Query ip address by infracontainer id
+	ipaddress, err := nc.GetAddress(pInfo.InfraContainerID, pInfo.IntfName)
 	if err != nil {
+		log.Errorf("Failed to get ip address for %s, %v", pInfo.InfraContainerID, err)
+		released = cniapi.NewCNIError(cniapi.ErrTryAgainLater, fmt.Sprintf("failed to look up the address of %s", pInfo.IntfName), err)
+	} else if ipaddress == "" {
+		log.Infof("No address recorded for %s of %s", pInfo.IntfName, pInfo.InfraContainerID)
+	} else if err = nc.ReleaseAddress(pInfo, &netconf.NetConf, ipaddress); err != nil {
 		log.Errorf("DelEndpoint returned %v", err)
+		released = cniapi.NewCNIError(cniapi.ErrTryAgainLater, fmt.Sprintf("failed to release %s", ipaddress), err)
 	} else {
-		log.Infof("EP deleted pod: %s\n", pInfo.Name)
+		log.Infof("EP deleted pod: %s %s\n", pInfo.Name, pInfo.IntfName)
+	}
+	if err = podTeardown(pInfo); err != nil {
+		return err
 	}
-	cmdDel(pInfo.NwNameSpace, pInfo.IntfName)
+	return released
+}
+
+func checkPodInNet(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, netconf *NetConf) error {
+	if !cniapi.VersionAtLeast(netconf.CNIVersion, "0.4.0") {
+		return cniapi.NewCNIError(cniapi.ErrIncompatibleVersion, fmt.Sprintf("CHECK is not supported by cniVersion %s", netconf.CNIVersion), nil)
+	}
+	for _, network := range netconf.attachments() {
+		ifname := network.ifName(pInfo.IntfName)
+		ipaddress, err := nc.GetAddress(pInfo.InfraContainerID, ifname)
+		if err != nil || ipaddress == "" {
+			return cniapi.NewCNIError(cniapi.ErrUnknownContainer, fmt.Sprintf("no address recorded for %s of container %s", ifname, pInfo.InfraContainerID), err)
+		}
+		p := *pInfo
+		p.IntfName = ifname
+		if err = cmdCheck(&p, ipaddress, network.defaultRoute(ifname)); err != nil {
+			return cniapi.NewCNIError(cniapi.ErrCheckInterface, fmt.Sprintf("pod interface %s does not match", ifname), err)
+		}
+	}
+	return nil
 }
 
 func getPrefixedLogger() *logger.Entry {
@@ -125,14 +333,6 @@ func getPrefixedLogger() *logger.Entry {
 	return l
 }
 
-func loadConf(bytes []byte) (*types.NetConf, error) {
-	n := &types.NetConf{}
-	if err := json.Unmarshal(bytes, n); err != nil {
-		return nil, log.Errorf("failed to load netconf: %v %q", err, string(bytes))
-	}
-	return n, nil
-}
-
 func saveStdin() ([]byte, error) {
 	// Read original stdin
 	stdinData, err := ioutil.ReadAll(os.Stdin)
@@ -195,28 +395,55 @@ func mainfunc() {
 	log.Infof("==> Start New Log <==\n")
 	log.Infof("command: %s, cni_args: %s", cniCmd, os.Getenv("CNI_ARGS"))
 
-	// Collect information passed by CNI
-	err = getPodInfo(&pInfo)
-	if err != nil {
-		log.Fatalf("Error parsing environment. Err: %v", err)
-	}
-
 	//Load network config
 	stdinData, err := saveStdin()
 	if err != nil {
-		log.Errorf("Error read stdin data %v", err)
+		exitWithError(cniapi.NewCNIError(cniapi.ErrIOFailure, "failed to read stdin", err), cniapi.DefaultCNIVersion)
+	}
+	if cniCmd == "VERSION" {
+		version := struct {
+			CNIVersion string `json:"cniVersion"`
+		}{}
+		json.Unmarshal(stdinData, &version)
+		cniapi.PrintVersion(version.CNIVersion)
+		return
 	}
 	netConf, err := loadConf(stdinData)
 	if err != nil {
-		log.Errorf("Error parse network config %v", err)
+		exitWithError(cniapi.NewCNIError(cniapi.ErrDecodingFailure, "failed to parse network config", err), cniapi.DefaultCNIVersion)
 	}
-	log.Infof("netConf: %s", netConf)
+	if netConf.CNIVersion == "" {
+		netConf.CNIVersion = cniapi.DefaultCNIVersion
+	}
+	if !cniapi.VersionSupported(netConf.CNIVersion) {
+		exitWithError(cniapi.NewCNIError(cniapi.ErrIncompatibleVersion, fmt.Sprintf("unsupported cniVersion %s", netConf.CNIVersion), nil), netConf.CNIVersion)
+	}
+	log.Infof("netConf: %+v", netConf)
 
-	nc := clients.NewNWClient()
-	if cniCmd == "ADD" {
-		addPodToNet(nc, &pInfo, netConf)
-	} else if cniCmd == "DEL" {
-		deletePodFromNet(nc, &pInfo, netConf)
+	// Collect information passed by CNI
+	err = getPodInfo(&pInfo)
+	if err != nil {
+		exitWithError(cniapi.NewCNIError(cniapi.ErrInvalidEnvironment, "failed to parse environment", err), netConf.CNIVersion)
 	}
 
+	var nc clients.IPAMClient
+	if len(netConf.EtcdEndpoints) != 0 {
+		// serverless, allocate straight from the store
+		nc = clients.NewStoreClient(netConf.EtcdEndpoints, netConf.DadInterface, time.Duration(netConf.DadTimeout)*time.Millisecond)
+	} else {
+		nc = clients.NewNWClient()
+	}
+	switch cniCmd {
+	case "ADD":
+		err = addPodToNet(nc, &pInfo, netConf)
+	case "DEL":
+		err = deletePodFromNet(nc, &pInfo, netConf)
+	case "CHECK":
+		err = checkPodInNet(nc, &pInfo, netConf)
+	default:
+		err = cniapi.NewCNIError(cniapi.ErrInvalidEnvironment, fmt.Sprintf("unknown CNI_COMMAND %q", cniCmd), nil)
+	}
+	if err != nil {
+		exitWithError(err, netConf.CNIVersion)
+	}
 }
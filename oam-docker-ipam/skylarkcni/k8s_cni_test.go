@@ -1,206 +1,296 @@
-/***
-Copyright 2016 Cisco Systems Inc. All rights reserved.
-
-Licensed under the Apache License, Version 2.0 (the "License");
-you may not use this file except in compliance with the License.
-You may obtain a copy of the License at
-http://www.apache.org/licenses/LICENSE-2.0
-
-Unless required by applicable law or agreed to in writing, software
-distributed under the License is distributed on an "AS IS" BASIS,
-WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-See the License for the specific language governing permissions and
-limitations under the License.
-*/
-
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
-	"os"
-	osexec "os/exec"
-	"strconv"
-	"strings"
+	"reflect"
 	"testing"
-	"time"
 
 	logger "github.com/Sirupsen/logrus"
-	"github.com/contiv/netplugin/mgmtfn/k8splugin/cniapi"
-	"github.com/gorilla/mux"
-)
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 
-const (
-	utPodIP    = "44.55.66.77/22"
-	utCNIARG1  = "K8S_POD_NAMESPACE=utK8sNS"
-	utCNIARG2  = "K8S_POD_NAME=utPod"
-	utCNIARG3  = "K8S_POD_INFRA_CONTAINER_ID=8ec72deca647bfa60a4b815aa735c87de859b47e872828586749b9d852af1f49"
-	utCNINETNS = "/proc/98765/ns/net"
+	"oam-docker-ipam/k8s"
+	"oam-docker-ipam/skylarkcni/cniapi"
+	"oam-docker-ipam/skylarkcni/ipamapi"
 )
 
-type restAPIFunc func(r *http.Request) (interface{}, error)
-
-// nsToPID is a utility that extracts the PID from the netns
-func nsToPID(ns string) (int, error) {
-	// Make sure ns is well formed
-	ok := strings.HasPrefix(ns, "/proc/")
-	if !ok {
-		return -1, fmt.Errorf("Invalid nw name space: %v", ns)
+func podResult(host, ifname, ip string) *current.Result {
+	result := &current.Result{
+		IPs: []*current.IPConfig{{
+			Version: "4",
+			Address: net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(24, 32)},
+		}},
+		Routes: []*types.Route{{Dst: net.IPNet{IP: net.ParseIP(ip).To4().Mask(net.CIDRMask(16, 32)), Mask: net.CIDRMask(16, 32)}}},
 	}
-
-	elements := strings.Split(ns, "/")
-	return strconv.Atoi(elements[2])
+	if host != "" {
+		result.Interfaces = append(result.Interfaces, &current.Interface{Name: host})
+	}
+	result.Interfaces = append(result.Interfaces, &current.Interface{Name: ifname, Sandbox: "/proc/1/ns/net"})
+	result.IPs[0].Interface = len(result.Interfaces) - 1
+	return result
 }
 
-// stubAddPod is the handler for testing pod additions
-func stubAddPod(r *http.Request) (interface{}, error) {
-
-	resp := cniapi.RspAddPod{}
+func TestMergeResult(t *testing.T) {
+	// a bridge, a macvlan and another bridge network
+	result := podResult("veth1", "eth0", "10.0.2.10")
+	mergeResult(result, podResult("", "net1", "10.1.2.10"))
+	mergeResult(result, podResult("veth2", "net2", "10.2.2.10"))
 
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logger.Errorf("Failed to read request: %v", err)
-		return resp, err
+	var names []string
+	for _, intf := range result.Interfaces {
+		names = append(names, intf.Name)
 	}
+	if want := []string{"veth1", "eth0", "net1", "veth2", "net2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got interfaces %v, want %v", names, want)
+	}
+	tests := []struct {
+		ip     string
+		ifname string
+	}{
+		{"10.0.2.10", "eth0"},
+		{"10.1.2.10", "net1"},
+		{"10.2.2.10", "net2"},
+	}
+	if len(result.IPs) != len(tests) || len(result.Routes) != len(tests) {
+		t.Fatalf("got %d ips and %d routes, want %d", len(result.IPs), len(result.Routes), len(tests))
+	}
+	for i, test := range tests {
+		ipc := result.IPs[i]
+		if ipc.Address.IP.String() != test.ip || result.Interfaces[ipc.Interface].Name != test.ifname {
+			t.Errorf("got %s on %s, want %s on %s", ipc.Address.IP, result.Interfaces[ipc.Interface].Name, test.ip, test.ifname)
+		}
+	}
+}
 
-	pInfo := cniapi.CNIPodAttr{}
-	if err := json.Unmarshal(content, &pInfo); err != nil {
-		return resp, err
+func TestMergeResultKeepsInput(t *testing.T) {
+	result := podResult("veth1", "eth0", "10.0.2.10")
+	r := podResult("veth2", "net1", "10.1.2.10")
+	mergeResult(result, r)
+	if r.IPs[0].Interface != 1 {
+		t.Errorf("the ips of the merged result were changed: interface %d", r.IPs[0].Interface)
 	}
+}
 
-	// verify pod attributes are as expected.
-	if pInfo.Name == "utPod" && pInfo.K8sNameSpace == "utK8sNS" &&
-		pInfo.InfraContainerID != "" && pInfo.IntfName != "" {
-		_, err := nsToPID(pInfo.NwNameSpace)
-		if err != nil {
-			logger.Errorf("Failed to fetch pid from netns %s: %v", pInfo.NwNameSpace,
-				err)
-		} else {
-			// respond with success
-			resp.IPAddress = utPodIP
-			resp.EndpointID = pInfo.InfraContainerID
-			return resp, nil
+func TestAttachment(t *testing.T) {
+	pInfo := &cniapi.CNIPodAttr{
+		Name:            "web-0",
+		IntfName:        "eth0",
+		RequestedIP:     "10.0.2.10",
+		Pool:            "10.0.2.0",
+		PodLabels:       map[string]string{"app": "web"},
+		NamespaceLabels: map[string]string{"team": "web"},
+		NodeLabels:      map[string]string{"zone": "a"},
+	}
+	pn := &k8s.PodNetwork{IP: "10.0.2.10", EgressBandwidth: 10e6, PodLabels: pInfo.PodLabels}
+	no := false
+	tests := []struct {
+		network   *NetConf
+		ifname    string
+		annotated bool
+	}{
+		{&NetConf{}, "eth0", true},
+		{&NetConf{IfName: "net1"}, "net1", false},
+		{&NetConf{DefaultRoute: &no}, "eth0", false},
+	}
+	for _, test := range tests {
+		p, npn := attachment(pInfo, test.network, pn)
+		if p.IntfName != test.ifname || p.Name != pInfo.Name {
+			t.Errorf("%+v: got pod %s interface %s, want %s", test.network, p.Name, p.IntfName, test.ifname)
 		}
+		if test.annotated {
+			if p.RequestedIP != pInfo.RequestedIP || p.Pool != pInfo.Pool || !reflect.DeepEqual(p.PodLabels, pInfo.PodLabels) || npn != pn {
+				t.Errorf("%+v: the annotations of the pod were dropped: %+v %+v", test.network, p, npn)
+			}
+			continue
+		}
+		if p.RequestedIP != "" || p.Pool != "" || p.PodLabels != nil || p.NamespaceLabels != nil || p.NodeLabels != nil ||
+			!reflect.DeepEqual(npn, &k8s.PodNetwork{}) {
+			t.Errorf("%+v: got the annotations of the pod: %+v %+v", test.network, p, npn)
+		}
+	}
+	if pInfo.IntfName != "eth0" || pInfo.RequestedIP == "" {
+		t.Errorf("the pod attributes were changed: %+v", pInfo)
 	}
-	logger.Errorf("Failed pod %v", pInfo)
-	return resp, fmt.Errorf("Failed to add pod")
 }
 
-// stubDeletePod is the handler for testing pod additions
-func stubDeletePod(r *http.Request) (interface{}, error) {
+// fakeIPAM hands out 10.0.2.10, 10.0.2.11... and gives an endpoint that has
+// an address the same one again, like the ipam driver
+type fakeIPAM struct {
+	addresses  map[string]string
+	veths      map[string]string
+	allocated  int
+	released   []string
+	getErr     error
+	releaseErr error
+	vethErr    error
+}
 
-	resp := cniapi.RspAddPod{}
+func newFakeIPAM() *fakeIPAM {
+	return &fakeIPAM{addresses: map[string]string{}, veths: map[string]string{}}
+}
 
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logger.Errorf("Failed to read request: %v", err)
-		return resp, err
+func (f *fakeIPAM) RequestAddress(podInfo *cniapi.CNIPodAttr, netConf *types.NetConf) (*ipamapi.RequestAddressResponse, error) {
+	key := podInfo.InfraContainerID + "/" + podInfo.IntfName
+	if address, ok := f.addresses[key]; ok {
+		return &ipamapi.RequestAddressResponse{Address: address}, nil
 	}
+	address := fmt.Sprintf("10.0.2.%d/24", 10+f.allocated)
+	f.allocated++
+	f.addresses[key] = address
+	return &ipamapi.RequestAddressResponse{Address: address}, nil
+}
 
-	pInfo := cniapi.CNIPodAttr{}
-	if err := json.Unmarshal(content, &pInfo); err != nil {
-		return resp, err
+func (f *fakeIPAM) ReleaseAddress(podInfo *cniapi.CNIPodAttr, netconf *types.NetConf, ipaddress string) error {
+	if f.releaseErr != nil {
+		return f.releaseErr
 	}
+	f.released = append(f.released, ipaddress)
+	delete(f.addresses, podInfo.InfraContainerID+"/"+podInfo.IntfName)
+	return nil
+}
 
-	// verify pod attributes are as expected.
-	if pInfo.Name == "utPod" && pInfo.K8sNameSpace == "utK8sNS" &&
-		pInfo.InfraContainerID != "" && pInfo.IntfName != "" {
-		resp.EndpointID = pInfo.InfraContainerID
-		return resp, nil
+func (f *fakeIPAM) GetAddress(infracontainerid, ifname string) (string, error) {
+	return f.addresses[infracontainerid+"/"+ifname], f.getErr
+}
+
+func (f *fakeIPAM) SetEndpointVeth(infracontainerid, ifname, veth string) error {
+	if f.vethErr != nil {
+		return f.vethErr
 	}
-	logger.Errorf("Failed pod %v", pInfo)
-	return resp, fmt.Errorf("Failed to delete pod")
+	f.veths[infracontainerid+"/"+ifname] = veth
+	return nil
 }
 
-// Simple Wrapper for http handlers
-func httpWrapper(handlerFunc restAPIFunc) http.HandlerFunc {
-	// Create a closure and return an anonymous function
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Call the handler
-		resp, err := handlerFunc(r)
-		if err != nil {
-			// Log error
-			logger.Errorf("Handler for %s %s returned error: %s", r.Method, r.URL, err)
-
-			// Send HTTP response
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		} else {
-			// Send HTTP response as Json
-			content, err := json.Marshal(resp)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.Write(content)
+// fakeHost replaces the host side of ADD and DEL, setup fails with setupErr
+type fakeHost struct {
+	setups    []string
+	teardowns int
+	setupErr  error
+}
+
+func (h *fakeHost) install() func() {
+	log = logger.NewEntry(logger.StandardLogger())
+	podSetup = func(pInfo *cniapi.CNIPodAttr, netconf *NetConf, pn *k8s.PodNetwork, address *ipamapi.RequestAddressResponse) (*current.Result, error) {
+		h.setups = append(h.setups, address.Address)
+		if h.setupErr != nil {
+			return nil, h.setupErr
 		}
+		ip, _, _ := net.ParseCIDR(address.Address)
+		return podResult("veth1", pInfo.IntfName, ip.String()), nil
+	}
+	podTeardown = func(pInfo *cniapi.CNIPodAttr) error {
+		h.teardowns++
+		return nil
+	}
+	return func() {
+		podSetup, podTeardown = setupPod, teardownPod
 	}
 }
 
-// setupTestServer creates a listener for the rest requests.
-func setupTestServer() {
-
-	router := mux.NewRouter()
+func cniCode(err error) uint {
+	if e, ok := err.(*cniapi.CNIError); ok {
+		return e.Code
+	}
+	return 0
+}
 
-	// register handlers for cni
-	t := router.Headers("Content-Type", "application/json").Methods("POST").Subrouter()
-	t.HandleFunc(cniapi.EPAddURL, httpWrapper(stubAddPod))
-	t.HandleFunc(cniapi.EPDelURL, httpWrapper(stubDeletePod))
+var testPod = &cniapi.CNIPodAttr{Name: "web-0", K8sNameSpace: "default", InfraContainerID: "c-web-0", IntfName: "eth0"}
 
-	driverPath := cniapi.ContivCniSocket
-	os.Remove(driverPath)
-	os.MkdirAll(cniapi.PluginPath, 0700)
+func TestAttachPodRepeated(t *testing.T) {
+	host := &fakeHost{}
+	defer host.install()()
+	nc := newFakeIPAM()
+	netconf := &NetConf{NetConf: types.NetConf{Type: "bridge"}}
 
-	go func() {
-		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: driverPath, Net: "unix"})
+	for i := 0; i < 2; i++ {
+		result, err := attachPod(nc, testPod, netconf, &k8s.PodNetwork{})
 		if err != nil {
-			panic(err)
+			t.Fatalf("ADD %d: %v", i, err)
 		}
-
-		logger.Infof("k8s test plugin listening on %s", driverPath)
-		http.Serve(l, router)
-		l.Close()
-		logger.Infof("k8s test plugin closing %s", driverPath)
-	}()
-
-	// make sure the listener is ready before returning
-	for count := 0; count < 5; count++ {
-		_, err := osexec.Command("ls", driverPath).CombinedOutput()
-		if err == nil {
-			return
+		if ip := result.IPs[0].Address.IP.String(); ip != "10.0.2.10" {
+			t.Errorf("ADD %d: got %s, want 10.0.2.10", i, ip)
 		}
-		time.Sleep(time.Second)
 	}
-
-	logger.Fatalf("Listener not ready after 5 sec")
-
+	// the second ADD sets the pod up again with the same address
+	if nc.allocated != 1 || len(nc.released) != 0 || !reflect.DeepEqual(host.setups, []string{"10.0.2.10/24", "10.0.2.10/24"}) {
+		t.Errorf("got %d allocated, released %v, setups %v", nc.allocated, nc.released, host.setups)
+	}
+	if veth := nc.veths["c-web-0/eth0"]; veth != "veth1" {
+		t.Errorf("got veth %q, want veth1", veth)
+	}
 }
 
-// TestMain sets up an http server for testing k8s plugin REST interface
-func TestMain(m *testing.M) {
-	setupTestServer()
-	os.Exit(m.Run())
-}
+func TestAttachPodRollback(t *testing.T) {
+	netconf := &NetConf{NetConf: types.NetConf{Type: "bridge"}}
+	tests := []struct {
+		setupErr error
+		vethErr  error
+		code     uint
+	}{
+		{setupErr: cniapi.NewCNIError(cniapi.ErrSetupInterface, "failed to add pod to net", nil), code: cniapi.ErrSetupInterface},
+		{vethErr: errors.New("etcd is down"), code: cniapi.ErrTryAgainLater},
+	}
+	for _, test := range tests {
+		host := &fakeHost{setupErr: test.setupErr}
+		restore := host.install()
+		nc := newFakeIPAM()
+		nc.vethErr = test.vethErr
+		_, err := attachPod(nc, testPod, netconf, &k8s.PodNetwork{})
+		restore()
+		if cniCode(err) != test.code {
+			t.Errorf("%v %v: got %v, want code %d", test.setupErr, test.vethErr, err, test.code)
+		}
+		if host.teardowns != 1 || !reflect.DeepEqual(nc.released, []string{"10.0.2.10/24"}) || len(nc.addresses) != 0 {
+			t.Errorf("%v %v: got %d teardowns and released %v, want the pod rolled back", test.setupErr, test.vethErr, host.teardowns, nc.released)
+		}
+	}
 
-func setupTestEnv() {
-	testCNIARGS := utCNIARG1 + ";" + utCNIARG2 + ";" + utCNIARG3
-	os.Setenv("CNI_ARGS", testCNIARGS)
-	os.Setenv("CNI_NETNS", utCNINETNS)
-	os.Setenv("CNI_IFNAME", "eth0")
+	// the address is not touched when it can not be allocated
+	host := &fakeHost{}
+	defer host.install()()
+	if _, err := attachPod(newFakeIPAM(), testPod, &NetConf{NetConf: types.NetConf{Type: "ptp"}}, &k8s.PodNetwork{}); err == nil || len(host.setups) != 0 {
+		t.Errorf("got %v and setups %v, want an error", err, host.setups)
+	}
 }
 
-// TestAddpod tests the AddPod interface
-func TestAddpod(m *testing.T) {
-	setupTestEnv()
-	os.Setenv("CNI_COMMAND", "ADD")
-	mainfunc()
-}
+func TestDetachPod(t *testing.T) {
+	host := &fakeHost{}
+	defer host.install()()
+	nc := newFakeIPAM()
+	netconf := &NetConf{NetConf: types.NetConf{Type: "bridge"}}
+	if _, err := attachPod(nc, testPod, netconf, &k8s.PodNetwork{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// DEL may be repeated, the second one finds no address
+	for i := 0; i < 2; i++ {
+		if err := detachPod(nc, testPod, netconf); err != nil {
+			t.Errorf("DEL %d: %v", i, err)
+		}
+	}
+	if host.teardowns != 2 || !reflect.DeepEqual(nc.released, []string{"10.0.2.10/24"}) {
+		t.Errorf("got %d teardowns and released %v", host.teardowns, nc.released)
+	}
 
-// TestAddpod tests the DeletePod interface
-func TestDelpod(m *testing.T) {
-	setupTestEnv()
-	os.Setenv("CNI_COMMAND", "DEL")
-	mainfunc()
+	// the interface is removed and the runtime asked to retry when the
+	// address can not be looked up or released
+	for _, fail := range []func(){
+		func() { nc.getErr = errors.New("etcd is down") },
+		func() { nc.releaseErr = errors.New("etcd is down") },
+	} {
+		nc = newFakeIPAM()
+		if _, err := attachPod(nc, testPod, netconf, &k8s.PodNetwork{}); err != nil {
+			t.Fatal(err)
+		}
+		fail()
+		host.teardowns = 0
+		if err := detachPod(nc, testPod, netconf); cniCode(err) != cniapi.ErrTryAgainLater {
+			t.Errorf("got %v, want code %d", err, cniapi.ErrTryAgainLater)
+		}
+		if host.teardowns != 1 || len(nc.addresses) != 1 {
+			t.Errorf("got %d teardowns and addresses %v, want the interface removed and the address kept", host.teardowns, nc.addresses)
+		}
+	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+)
+
+func macvlanModeFromString(s string) (netlink.MacvlanMode, error) {
+	switch s {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	default:
+		return 0, fmt.Errorf("unknown macvlan mode: %q", s)
+	}
+}
+
+// setupMacvlan creates a macvlan device on the master and moves it into
+// netns as ifName. The device is created under a temporary name so it can
+// not clash with an interface of the host.
+func setupMacvlan(netns ns.NetNS, netconf *NetConf, ifName string) (*current.Interface, error) {
+	mode, err := macvlanModeFromString(netconf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	m, mtu, err := masterLink(netconf)
+	if err != nil {
+		return nil, err
+	}
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+
+	mv := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			MTU:         mtu,
+			Name:        tmpName,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+	if err := netlink.LinkAdd(mv); err != nil {
+		return nil, fmt.Errorf("failed to create macvlan: %v", err)
+	}
+
+	return renameInNetns(netns, tmpName, ifName)
+}
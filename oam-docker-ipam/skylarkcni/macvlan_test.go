@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestMacvlanConf(t *testing.T) {
+	n, err := loadConf([]byte(`{"type": "macvlan", "master": "eth1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Master != "eth1" || n.Mode != "bridge" {
+		t.Errorf("got master %q mode %q, want eth1 bridge", n.Master, n.Mode)
+	}
+
+	tests := []struct {
+		mode string
+		want netlink.MacvlanMode
+	}{
+		{"bridge", netlink.MACVLAN_MODE_BRIDGE},
+		{"private", netlink.MACVLAN_MODE_PRIVATE},
+		{"vepa", netlink.MACVLAN_MODE_VEPA},
+		{"passthru", netlink.MACVLAN_MODE_PASSTHRU},
+	}
+	for _, test := range tests {
+		mode, err := macvlanModeFromString(test.mode)
+		if err != nil || mode != test.want {
+			t.Errorf("%s: got %v %v, want %v", test.mode, mode, err, test.want)
+		}
+	}
+
+	for _, conf := range []string{
+		`{"type": "macvlan"}`,
+		`{"type": "macvlan", "master": "eth1", "mode": "l2"}`,
+	} {
+		if _, err := loadConf([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", conf)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		subnet  string
+		want    string
+		fails   bool
+	}{
+		{address: "10.1.2.10/16", subnet: "10.1.2.0/24", want: "10.1.2.10/16"},
+		// the prefix of the subnet is used for a plain address
+		{address: "10.1.2.10", subnet: "10.1.2.0/24", want: "10.1.2.10/24"},
+		{address: "10.1.2.10", subnet: "", fails: true},
+		{address: "10.1.2", subnet: "10.1.2.0/24", fails: true},
+		{address: "10.1.2.10/33", subnet: "10.1.2.0/24", fails: true},
+	}
+	for _, test := range tests {
+		ipaddr, err := parseAddress(test.address, test.subnet)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s %s: got %v, want an error", test.address, test.subnet, ipaddr)
+			}
+			continue
+		}
+		if err != nil || ipaddr.String() != test.want {
+			t.Errorf("%s %s: got %v %v, want %s", test.address, test.subnet, ipaddr, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"oam-docker-ipam/k8s"
+)
+
+// defaultRetention keeps the IP of a restarted StatefulSet pod long enough for
+// it to be rescheduled
+const defaultRetention = "1h"
+
+// defaultDadTimeout is the dad-timeout of the server in milliseconds
+const defaultDadTimeout = 1000
+
+// NetConf is the skylark network configuration passed on stdin
+type NetConf struct {
+	types.NetConf
+	// Master is the host device macvlan and ipvlan interfaces are created on
+	Master string `json:"master"`
+	// Mode is the macvlan mode: bridge, private, vepa or passthru, or the
+	// ipvlan mode: l2, l3 or l3s
+	Mode string `json:"mode"`
+
+	// Bridge is the linux bridge the veth of bridge pods is enslaved to
+	Bridge string `json:"bridge"`
+	// MTU of the pod interface, the MTU of the master when 0 for macvlan
+	// and ipvlan
+	MTU         int  `json:"mtu"`
+	HairpinMode bool `json:"hairpinMode"`
+	// IsGateway assigns the gateway address to the bridge
+	IsGateway   bool `json:"isGateway"`
+	PromiscMode bool `json:"promiscMode"`
+	// Vlan makes <master>.<vlan> the uplink, it is created when missing.
+	// Bridge pods get it enslaved to the bridge.
+	Vlan int `json:"vlan"`
+	// MacMode is "ip" to derive the pod MAC from its IP or "random" to keep
+	// the MAC the kernel generated
+	MacMode string `json:"macMode"`
+	// EtcdEndpoints make the plugin allocate straight from the store, the
+	// oam-docker-ipam server is not needed then
+	EtcdEndpoints []string `json:"etcdEndpoints"`
+	// DadInterface makes the plugin probe candidate IPs with arp on this
+	// interface before it hands them out, like the dad-interface of the
+	// server. DadTimeout is the milliseconds to wait for replies. Both only
+	// apply with EtcdEndpoints.
+	DadInterface string `json:"dadInterface"`
+	DadTimeout   int    `json:"dadTimeout"`
+	// Kubernetes makes the plugin read the skylark.io annotations of the pod
+	// and its namespace, an empty object means in-cluster
+	Kubernetes *k8s.Config `json:"kubernetes"`
+	// StatefulSetRetention is how long the IP of a StatefulSet pod is kept
+	// for the pod after DEL, e.g. 30m. 0 releases it right away.
+	StatefulSetRetention string `json:"statefulSetRetention"`
+	retention            time.Duration
+
+	// Routes are added through the pod interface, through the gateway
+	// unless they have their own
+	Routes []*types.Route `json:"routes"`
+	// DefaultRoute puts the default route on the pod interface. It defaults
+	// to true for eth0, the interface kubelet asks for, and false for the
+	// net1, net2... of the additional networks Multus delegates. The pod
+	// annotations and pool selectors only apply to the interface with the
+	// default route.
+	DefaultRoute *bool `json:"defaultRoute"`
+
+	// Networks attach the pod to several skylark networks at once, each
+	// one a netconf of its own. IfName names the interface of a network,
+	// the first one defaults to CNI_IFNAME and the others to net1, net2...
+	Networks []json.RawMessage `json:"networks"`
+	IfName   string            `json:"ifName"`
+	networks []*NetConf
+
+	// RuntimeConfig carries the capabilities the runtime fills in, the
+	// bandwidth kubelet derives from the kubernetes.io/ingress-bandwidth
+	// and egress-bandwidth annotations and the hostPorts of the pod
+	RuntimeConfig struct {
+		Bandwidth    *BandwidthEntry `json:"bandwidth,omitempty"`
+		PortMappings []PortMapEntry  `json:"portMappings,omitempty"`
+	} `json:"runtimeConfig"`
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v %q", err, string(bytes))
+	}
+	if n.MacMode == "" {
+		n.MacMode = "ip"
+	}
+	if n.MacMode != "ip" && n.MacMode != "random" {
+		return nil, fmt.Errorf("unknown macMode %q, must be ip or random", n.MacMode)
+	}
+	if n.StatefulSetRetention == "" {
+		n.StatefulSetRetention = defaultRetention
+	}
+	retention, err := time.ParseDuration(n.StatefulSetRetention)
+	if err != nil || retention < 0 {
+		return nil, fmt.Errorf("invalid statefulSetRetention %q", n.StatefulSetRetention)
+	}
+	n.retention = retention
+	if n.DadTimeout == 0 {
+		n.DadTimeout = defaultDadTimeout
+	}
+	if n.DadTimeout < 0 {
+		return nil, fmt.Errorf("invalid dadTimeout %d", n.DadTimeout)
+	}
+	if len(n.Networks) != 0 {
+		return loadNetworks(n)
+	}
+	if n.Vlan < 0 || n.Vlan > 4094 {
+		return nil, fmt.Errorf("invalid vlan %d", n.Vlan)
+	}
+	switch n.Type {
+	case "bridge":
+		if n.Bridge == "" {
+			n.Bridge = defaultBrName
+		}
+		if n.MTU == 0 {
+			n.MTU = defaultMtu
+		}
+		if n.Vlan != 0 && n.Master == "" {
+			return nil, fmt.Errorf(`"master" field is required with "vlan". It specifies the host interface carrying the vlan`)
+		}
+	case "macvlan":
+		if n.Master == "" {
+			return nil, fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
+		}
+		if n.Mode == "" {
+			n.Mode = "bridge"
+		}
+		if _, err := macvlanModeFromString(n.Mode); err != nil {
+			return nil, err
+		}
+	case "ipvlan":
+		if n.Master == "" {
+			return nil, fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
+		}
+		if n.Mode == "" {
+			n.Mode = "l2"
+		}
+		if _, err := ipvlanModeFromString(n.Mode); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// loadNetworks loads the networks of n. They inherit the settings of the
+// pod as a whole from n.
+func loadNetworks(n *NetConf) (*NetConf, error) {
+	names := map[string]bool{}
+	for i, raw := range n.Networks {
+		network, err := loadConf(raw)
+		if err != nil {
+			return nil, fmt.Errorf("network %d: %v", i, err)
+		}
+		if len(network.networks) != 0 {
+			return nil, fmt.Errorf("network %d: networks can not be nested", i)
+		}
+		switch network.Type {
+		case "bridge", "macvlan", "ipvlan":
+		default:
+			return nil, fmt.Errorf("network %d: unsupported network type %q", i, network.Type)
+		}
+		if i != 0 && network.IfName == "" {
+			network.IfName = fmt.Sprintf("net%d", i)
+		}
+		if network.IfName != "" && names[network.IfName] {
+			return nil, fmt.Errorf("network %d: interface %s is used twice", i, network.IfName)
+		}
+		names[network.IfName] = true
+		if network.DefaultRoute == nil {
+			primary := i == 0
+			network.DefaultRoute = &primary
+		}
+		network.CNIVersion = n.CNIVersion
+		if network.Name == "" {
+			network.Name = n.Name
+		}
+		network.Kubernetes = n.Kubernetes
+		network.EtcdEndpoints = n.EtcdEndpoints
+		network.retention = n.retention
+		network.RuntimeConfig = n.RuntimeConfig
+		n.networks = append(n.networks, network)
+	}
+	return n, nil
+}
+
+// attachments returns the networks of the pod, n itself unless it lists
+// networks
+func (n *NetConf) attachments() []*NetConf {
+	if len(n.networks) != 0 {
+		return n.networks
+	}
+	return []*NetConf{n}
+}
+
+// ifName returns the pod interface of the network, ifname is CNI_IFNAME
+func (n *NetConf) ifName(ifname string) string {
+	if n.IfName != "" {
+		return n.IfName
+	}
+	return ifname
+}
+
+// defaultRoute tells whether the pod interface ifname gets the default route
+func (n *NetConf) defaultRoute(ifname string) bool {
+	if n.DefaultRoute != nil {
+		return *n.DefaultRoute
+	}
+	return ifname == "eth0"
+}
+
+// applyPoolData applies the settings of the pool an address came from, as
+// returned in RequestAddressResponse.Data: its gateway, routes and DNS win
+// over those of the netconf.
+func applyPoolData(n *NetConf, data map[string]string) error {
+	if gw := data["Gateway"]; gw != "" {
+		n.IPAM.Gateway = gw
+	}
+	if value := data["Routes"]; value != "" {
+		var routes []*types.Route
+		if err := json.Unmarshal([]byte(value), &routes); err != nil {
+			return fmt.Errorf("invalid routes %q: %v", value, err)
+		}
+		n.Routes = append(n.Routes, routes...)
+	}
+	if value := data["DNS"]; value != "" {
+		dns := types.DNS{}
+		if err := json.Unmarshal([]byte(value), &dns); err != nil {
+			return fmt.Errorf("invalid dns %q: %v", value, err)
+		}
+		n.DNS = dns
+	}
+	if data["SkipDefaultRoute"] == "true" {
+		skip := false
+		n.DefaultRoute = &skip
+	}
+	return nil
+}
+
+// uplink returns the host device pods are attached through
+func (n *NetConf) uplink() string {
+	if n.Vlan == 0 {
+		return n.Master
+	}
+	return fmt.Sprintf("%s.%d", n.Master, n.Vlan)
+}
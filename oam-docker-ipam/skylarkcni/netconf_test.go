@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestLoadConf(t *testing.T) {
+	n, err := loadConf([]byte(`{"type": "bridge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Bridge != defaultBrName || n.MTU != defaultMtu || n.MacMode != "ip" || n.HairpinMode || n.IsGateway {
+		t.Errorf("got bridge %q mtu %d mac mode %q hairpin %v gateway %v", n.Bridge, n.MTU, n.MacMode, n.HairpinMode, n.IsGateway)
+	}
+	if n.DadInterface != "" || n.DadTimeout != defaultDadTimeout {
+		t.Errorf("got dad interface %q timeout %d", n.DadInterface, n.DadTimeout)
+	}
+
+	n, err = loadConf([]byte(`{"type": "bridge", "bridge": "br1", "mtu": 9000, "hairpinMode": true,
+		"isGateway": true, "promiscMode": true, "vlan": 100, "master": "eth1", "macMode": "random"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Bridge != "br1" || n.MTU != 9000 || !n.HairpinMode || !n.IsGateway || !n.PromiscMode || n.MacMode != "random" {
+		t.Errorf("the settings of the netconf were dropped: %+v", n)
+	}
+	if uplink := n.uplink(); uplink != "eth1.100" {
+		t.Errorf("got uplink %s, want eth1.100", uplink)
+	}
+
+	for _, conf := range []string{
+		`{"type": "bridge", "macMode": "eui64"}`,
+		`{"type": "bridge", "vlan": 100}`,
+		`{"type": "bridge", "vlan": -1, "master": "eth1"}`,
+		`{"type": "bridge", "vlan": 4095, "master": "eth1"}`,
+		`{"type": "bridge", "dadTimeout": -1}`,
+	} {
+		if _, err := loadConf([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", conf)
+		}
+	}
+}
+
+const networksConf = `{
+	"cniVersion": "0.3.1",
+	"name": "skylark",
+	"type": "skylark",
+	"etcdEndpoints": ["http://10.0.0.1:2379"],
+	"statefulSetRetention": "30m",
+	"runtimeConfig": {"portMappings": [{"hostPort": 8080, "containerPort": 80}]},
+	"networks": [
+		{"type": "bridge", "ipam": {"subnet": "10.0.2.0/24"}},
+		{"name": "storage", "type": "macvlan", "master": "eth1"},
+		{"type": "ipvlan", "master": "eth2", "ifName": "data", "defaultRoute": true}
+	]
+}`
+
+func TestLoadNetworks(t *testing.T) {
+	n, err := loadConf([]byte(networksConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks := n.attachments()
+	if len(networks) != 3 {
+		t.Fatalf("got %d networks, want 3", len(networks))
+	}
+	tests := []struct {
+		name         string
+		typ          string
+		mode         string
+		ifName       string
+		defaultRoute bool
+	}{
+		{"skylark", "bridge", "", "", true},
+		{"storage", "macvlan", "bridge", "net1", false},
+		{"skylark", "ipvlan", "l2", "data", true},
+	}
+	for i, test := range tests {
+		network := networks[i]
+		if network.Name != test.name || network.Type != test.typ || network.Mode != test.mode ||
+			network.IfName != test.ifName || *network.DefaultRoute != test.defaultRoute {
+			t.Errorf("network %d: got %s %s %q %q %v, want %+v", i, network.Name, network.Type,
+				network.Mode, network.IfName, *network.DefaultRoute, test)
+		}
+		// the settings of the pod as a whole are inherited
+		if network.CNIVersion != "0.3.1" || network.retention != 30*time.Minute ||
+			!reflect.DeepEqual(network.EtcdEndpoints, n.EtcdEndpoints) ||
+			len(network.RuntimeConfig.PortMappings) != 1 {
+			t.Errorf("network %d does not inherit the pod settings: %+v", i, network)
+		}
+	}
+	if networks[0].Bridge != defaultBrName || networks[0].IPAM.Subnet != "10.0.2.0/24" {
+		t.Errorf("got bridge %q subnet %q of network 0", networks[0].Bridge, networks[0].IPAM.Subnet)
+	}
+
+	for _, conf := range []string{
+		`{"networks": [{"type": "ptp"}]}`,
+		`{"networks": [{"type": "macvlan"}]}`,
+		`{"networks": [{"type": "bridge", "networks": [{"type": "bridge"}]}]}`,
+		`{"networks": [{"type": "bridge"}, {"type": "bridge", "ifName": "eth1"}, {"type": "bridge", "ifName": "eth1"}]}`,
+		`{"networks": [{"type": "bridge"}, {"type": "bridge"}, {"type": "bridge", "ifName": "net1"}]}`,
+		`{"networks": [{"type": "bridge", "vlan": 4095, "master": "eth1"}]}`,
+	} {
+		if _, err := loadConf([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", conf)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	n, err := loadConf([]byte(`{"type": "bridge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networks := n.attachments(); len(networks) != 1 || networks[0] != n {
+		t.Errorf("got networks %v, want the netconf itself", networks)
+	}
+
+	yes, no := true, false
+	tests := []struct {
+		conf         *NetConf
+		ifname       string
+		wantIfName   string
+		defaultRoute bool
+	}{
+		{&NetConf{}, "eth0", "eth0", true},
+		{&NetConf{}, "net1", "net1", false},
+		{&NetConf{IfName: "data"}, "eth0", "data", false},
+		{&NetConf{DefaultRoute: &yes}, "net1", "net1", true},
+		{&NetConf{DefaultRoute: &no}, "eth0", "eth0", false},
+	}
+	for _, test := range tests {
+		ifname := test.conf.ifName(test.ifname)
+		if ifname != test.wantIfName {
+			t.Errorf("%+v: got interface %s, want %s", test.conf, ifname, test.wantIfName)
+		}
+		if route := test.conf.defaultRoute(ifname); route != test.defaultRoute {
+			t.Errorf("%+v: got default route %v on %s, want %v", test.conf, route, ifname, test.defaultRoute)
+		}
+	}
+}
+
+func TestApplyPoolData(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.9.0.0/16")
+	confRoute := &types.Route{Dst: *dst}
+	tests := []struct {
+		data         map[string]string
+		gateway      string
+		routes       int
+		nameservers  []string
+		defaultRoute bool
+		fails        bool
+	}{
+		{data: nil, gateway: "10.0.2.1", routes: 1, nameservers: []string{"10.0.0.2"}, defaultRoute: true},
+		{data: map[string]string{"Gateway": "10.0.2.254"}, gateway: "10.0.2.254", routes: 1, nameservers: []string{"10.0.0.2"}, defaultRoute: true},
+		{
+			data:    map[string]string{"Routes": `[{"dst":"10.8.0.0/16"},{"dst":"10.7.0.0/16","gw":"10.0.2.6"}]`},
+			gateway: "10.0.2.1", routes: 3, nameservers: []string{"10.0.0.2"}, defaultRoute: true,
+		},
+		{
+			data:    map[string]string{"DNS": `{"nameservers":["10.0.0.3"],"search":["db.svc"]}`},
+			gateway: "10.0.2.1", routes: 1, nameservers: []string{"10.0.0.3"}, defaultRoute: true,
+		},
+		{data: map[string]string{"SkipDefaultRoute": "true"}, gateway: "10.0.2.1", routes: 1, nameservers: []string{"10.0.0.2"}},
+		{data: map[string]string{"Routes": `[{"dst":"10.8.0.0"}]`}, fails: true},
+		{data: map[string]string{"DNS": `nameservers`}, fails: true},
+	}
+	for _, test := range tests {
+		n := &NetConf{Routes: []*types.Route{confRoute}}
+		n.IPAM.Gateway = "10.0.2.1"
+		n.DNS.Nameservers = []string{"10.0.0.2"}
+		err := applyPoolData(n, test.data)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.data, err)
+			continue
+		}
+		if n.IPAM.Gateway != test.gateway || len(n.Routes) != test.routes ||
+			!reflect.DeepEqual(n.DNS.Nameservers, test.nameservers) || n.defaultRoute("eth0") != test.defaultRoute {
+			t.Errorf("%v: got gateway %s, %d routes, dns %v, default route %v", test.data,
+				n.IPAM.Gateway, len(n.Routes), n.DNS.Nameservers, n.defaultRoute("eth0"))
+		}
+		if n.Routes[0] != confRoute {
+			t.Errorf("%v: the routes of the netconf come first", test.data)
+		}
+	}
+}
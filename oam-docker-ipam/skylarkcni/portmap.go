@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"oam-docker-ipam/ipamdriver"
+	"oam-docker-ipam/skylarkcni/cniapi"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// hostPortsChain is the nat chain jumped to for traffic to the host, it
+// jumps to the chain of each pod with host ports
+const hostPortsChain = "SKYLARK-HOSTPORTS"
+
+// hostPortsMasqChain is the nat chain jumped to from POSTROUTING, it
+// masquerades the connections marked with hostPortsMark
+const hostPortsMasqChain = "SKYLARK-HOSTPORTS-MASQ"
+
+// hostPortsMark marks the connections to a host port that come from the
+// pod itself or from 127.0.0.1, the pod could not answer them otherwise
+const hostPortsMark = "0x2000/0x2000"
+
+// PortMapEntry is an entry of the portMappings capability the runtime
+// passes in the runtimeConfig, kubelet fills it from the hostPorts of the
+// pod
+type PortMapEntry struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// portMapChain names the nat chain of the host ports of the pod interface
+func portMapChain(containerID, ifName string) string {
+	return "SKY-HP-" + endpointHash(containerID, ifName)[:16]
+}
+
+// portMapRules returns the DNAT rules of mappings to podIP, each one behind
+// the rules marking the connections to masquerade
+func portMapRules(mappings []PortMapEntry, podIP net.IP) ([][]string, error) {
+	var rules [][]string
+	for _, m := range mappings {
+		if m.HostPort <= 0 || m.HostPort > 65535 || m.ContainerPort <= 0 || m.ContainerPort > 65535 {
+			return nil, fmt.Errorf("invalid port mapping %d:%d", m.HostPort, m.ContainerPort)
+		}
+		protocol := strings.ToLower(m.Protocol)
+		switch protocol {
+		case "":
+			protocol = "tcp"
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("unsupported protocol %q of host port %d", m.Protocol, m.HostPort)
+		}
+		rule := []string{"-p", protocol, "--dport", strconv.Itoa(m.HostPort)}
+		if m.HostIP != "" && m.HostIP != "0.0.0.0" {
+			ip := net.ParseIP(m.HostIP)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid host ip %q of host port %d", m.HostIP, m.HostPort)
+			}
+			rule = append(rule, "-d", ip.String())
+		}
+		for _, source := range []string{podIP.String() + "/32", "127.0.0.1"} {
+			mark := append(append([]string{}, rule...), "-s", source, "-j", "MARK", "--set-xmark", hostPortsMark)
+			rules = append(rules, mark)
+		}
+		rule = append(rule, "-j", "DNAT", "--to-destination", net.JoinHostPort(podIP.String(), strconv.Itoa(m.ContainerPort)))
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// setupPortMappings forwards the host ports of the pod to its address. Only
+// the interface with the default route of a bridge pod gets host ports, the
+// host cannot reach macvlan and ipvlan pods. Connections to a host port
+// from the pod itself or through 127.0.0.1 are not forwarded.
+func setupPortMappings(netconf *NetConf, pInfo *cniapi.CNIPodAttr, result *current.Result) error {
+	mappings := netconf.RuntimeConfig.PortMappings
+	if len(mappings) == 0 || !netconf.defaultRoute(pInfo.IntfName) {
+		return nil
+	}
+	if netconf.Type != "bridge" {
+		return fmt.Errorf("host ports need a bridge network, the host cannot reach %s pods", netconf.Type)
+	}
+	if len(result.IPs) == 0 {
+		return fmt.Errorf("no address to forward the host ports to")
+	}
+	rules, err := portMapRules(mappings, result.IPs[0].Address.IP)
+	if err != nil {
+		return err
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	if err = ipt.NewChain("nat", hostPortsChain); err != nil {
+		if e, ok := err.(*iptables.Error); !ok || e.ExitStatus() != 1 {
+			return err
+		}
+	}
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		if err = ipt.AppendUnique("nat", chain, "-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortsChain); err != nil {
+			return err
+		}
+	}
+	if err = setupHostPortsMasq(ipt, netconf.Bridge); err != nil {
+		return err
+	}
+	// the pods on the bridge would get the replies of the other pods
+	// straight from them, with the pod address instead of the host port
+	ipamdriver.EnableBridgeNetfilter()
+
+	// a repeated ADD replaces the rules of the earlier one
+	chain := portMapChain(pInfo.InfraContainerID, pInfo.IntfName)
+	if err = ipt.ClearChain("nat", chain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err = ipt.Append("nat", chain, rule...); err != nil {
+			return fmt.Errorf("failed to add %v: %v", rule, err)
+		}
+	}
+	return ipt.AppendUnique("nat", hostPortsChain, portMapJump(pInfo)...)
+}
+
+// setupHostPortsMasq masquerades the marked connections. The connections
+// from 127.0.0.1 are only routed to the pods of bridge with route_localnet.
+func setupHostPortsMasq(ipt *iptables.IPTables, bridge string) error {
+	err := ipt.NewChain("nat", hostPortsMasqChain)
+	if err != nil {
+		if e, ok := err.(*iptables.Error); !ok || e.ExitStatus() != 1 {
+			return err
+		}
+	}
+	if err = ipt.AppendUnique("nat", hostPortsMasqChain, "-m", "mark", "--mark", hostPortsMark, "-j", "MASQUERADE"); err != nil {
+		return err
+	}
+	if err = ipt.AppendUnique("nat", "POSTROUTING", "-j", hostPortsMasqChain); err != nil {
+		return err
+	}
+	err = ioutil.WriteFile("/proc/sys/net/ipv4/conf/"+bridge+"/route_localnet", []byte("1"), 0644)
+	if err != nil {
+		log.Warnf("Failed to enable route_localnet on %s, host ports are not reachable through 127.0.0.1: %v", bridge, err)
+	}
+	return nil
+}
+
+func portMapJump(pInfo *cniapi.CNIPodAttr) []string {
+	return []string{"-j", portMapChain(pInfo.InfraContainerID, pInfo.IntfName),
+		"-m", "comment", "--comment", pInfo.InfraContainerID + "/" + pInfo.IntfName}
+}
+
+// teardownPortMappings removes the host ports of the pod interface. A host
+// without iptables has none, and neither has a pod without its chain.
+func teardownPortMappings(pInfo *cniapi.CNIPodAttr) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		log.Debugf("No host ports to remove: %v", err)
+		return nil
+	}
+	chain := portMapChain(pInfo.InfraContainerID, pInfo.IntfName)
+	exists, err := chainExists(ipt, "nat", chain)
+	if err != nil || !exists {
+		return err
+	}
+	jump := portMapJump(pInfo)
+	if exists, err = ipt.Exists("nat", hostPortsChain, jump...); err != nil {
+		return err
+	}
+	if exists {
+		if err = ipt.Delete("nat", hostPortsChain, jump...); err != nil {
+			return err
+		}
+	}
+	if err = ipt.ClearChain("nat", chain); err != nil {
+		return err
+	}
+	return ipt.DeleteChain("nat", chain)
+}
+
+// chainExists tells whether table has chain. iptables exits with 1 when
+// listing a missing chain.
+func chainExists(ipt *iptables.IPTables, table, chain string) (bool, error) {
+	if _, err := ipt.List(table, chain); err != nil {
+		if e, ok := err.(*iptables.Error); ok && e.ExitStatus() == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPortMapRules(t *testing.T) {
+	podIP := net.ParseIP("10.0.2.10")
+	tests := []struct {
+		mappings []PortMapEntry
+		want     [][]string
+	}{
+		{nil, nil},
+		{
+			[]PortMapEntry{{HostPort: 8080, ContainerPort: 80}},
+			[][]string{
+				{"-p", "tcp", "--dport", "8080", "-s", "10.0.2.10/32", "-j", "MARK", "--set-xmark", "0x2000/0x2000"},
+				{"-p", "tcp", "--dport", "8080", "-s", "127.0.0.1", "-j", "MARK", "--set-xmark", "0x2000/0x2000"},
+				{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.2.10:80"},
+			},
+		},
+		{
+			[]PortMapEntry{
+				{HostPort: 53, ContainerPort: 5353, Protocol: "UDP", HostIP: "0.0.0.0"},
+				{HostPort: 9000, ContainerPort: 9000, Protocol: "sctp", HostIP: "192.168.1.5"},
+			},
+			[][]string{
+				{"-p", "udp", "--dport", "53", "-s", "10.0.2.10/32", "-j", "MARK", "--set-xmark", "0x2000/0x2000"},
+				{"-p", "udp", "--dport", "53", "-s", "127.0.0.1", "-j", "MARK", "--set-xmark", "0x2000/0x2000"},
+				{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "10.0.2.10:5353"},
+				{"-p", "sctp", "--dport", "9000", "-d", "192.168.1.5", "-s", "10.0.2.10/32", "-j", "MARK", "--set-xmark", "0x2000/0x2000"},
+				{"-p", "sctp", "--dport", "9000", "-d", "192.168.1.5", "-s", "127.0.0.1", "-j", "MARK", "--set-xmark", "0x2000/0x2000"},
+				{"-p", "sctp", "--dport", "9000", "-d", "192.168.1.5", "-j", "DNAT", "--to-destination", "10.0.2.10:9000"},
+			},
+		},
+	}
+	for _, test := range tests {
+		rules, err := portMapRules(test.mappings, podIP)
+		if err != nil {
+			t.Errorf("%+v: %v", test.mappings, err)
+			continue
+		}
+		if !reflect.DeepEqual(rules, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.mappings, rules, test.want)
+		}
+	}
+
+	for _, m := range []PortMapEntry{
+		{HostPort: 0, ContainerPort: 80},
+		{HostPort: 8080, ContainerPort: 65536},
+		{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"},
+		{HostPort: 8080, ContainerPort: 80, HostIP: "localhost"},
+		{HostPort: 8080, ContainerPort: 80, HostIP: "fe80::1"},
+	} {
+		if _, err := portMapRules([]PortMapEntry{{HostPort: 80, ContainerPort: 80}, m}, podIP); err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
+
+func TestPortMapChain(t *testing.T) {
+	chain := portMapChain("8ec72deca647", "eth0")
+	// iptables chain names are at most 28 characters
+	if len(chain) > 28 {
+		t.Errorf("%s is too long for a chain name", chain)
+	}
+	if chain == portMapChain("8ec72deca647", "net1") {
+		t.Errorf("%s is not unique to the interface", chain)
+	}
+}
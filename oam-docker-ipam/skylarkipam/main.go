@@ -0,0 +1,258 @@
+// skylark-ipam is a CNI IPAM plugin handing out addresses of the skylark
+// pools, so they can be used with the bridge, macvlan or ipvlan main plugins
+// or inside Multus. It asks the oam-docker-ipam server over its plugin socket,
+// or the store directly when etcdEndpoints are configured.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	"oam-docker-ipam/skylarkcni/clients"
+	"oam-docker-ipam/skylarkcni/cniapi"
+)
+
+// defaultDadTimeout is the dad-timeout of the server in milliseconds
+const defaultDadTimeout = 1000
+
+// IPAMConfig is the ipam section of the netconf
+type IPAMConfig struct {
+	Type    string `json:"type"`
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// Routes default to a default route through the gateway
+	Routes []*types.Route `json:"routes"`
+	DNS    types.DNS      `json:"dns"`
+	// EtcdEndpoints allocate straight from the store instead of asking the
+	// oam-docker-ipam server
+	EtcdEndpoints []string `json:"etcdEndpoints"`
+	// DadInterface makes skylark-ipam probe candidate IPs with arp on this
+	// interface, DadTimeout is the milliseconds to wait for replies. Both
+	// only apply with EtcdEndpoints.
+	DadInterface string `json:"dadInterface"`
+	DadTimeout   int    `json:"dadTimeout"`
+}
+
+// NetConf is the part of the netconf of the main plugin skylark-ipam reads
+type NetConf struct {
+	CNIVersion string      `json:"cniVersion"`
+	Name       string      `json:"name"`
+	IPAM       *IPAMConfig `json:"ipam"`
+}
+
+var log *logger.Entry
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v %q", err, string(bytes))
+	}
+	if n.IPAM == nil {
+		return nil, fmt.Errorf(`"ipam" section is missing`)
+	}
+	if _, _, err := net.ParseCIDR(n.IPAM.Subnet); err != nil {
+		return nil, fmt.Errorf("invalid ipam subnet %q: %v", n.IPAM.Subnet, err)
+	}
+	if n.IPAM.DadTimeout == 0 {
+		n.IPAM.DadTimeout = defaultDadTimeout
+	}
+	if n.IPAM.DadTimeout < 0 {
+		return nil, fmt.Errorf("invalid ipam dadTimeout %d", n.IPAM.DadTimeout)
+	}
+	if n.CNIVersion == "" {
+		n.CNIVersion = cniapi.DefaultCNIVersion
+	}
+	return n, nil
+}
+
+// getPodInfo reads the container the address is for. Outside of kubernetes
+// CNI_ARGS carries no pod, the container id stands in for the infra
+// container then.
+func getPodInfo() (*cniapi.CNIPodAttr, error) {
+	pInfo := &cniapi.CNIPodAttr{
+		InfraContainerID: os.Getenv("CNI_CONTAINERID"),
+		NwNameSpace:      os.Getenv("CNI_NETNS"),
+		IntfName:         os.Getenv("CNI_IFNAME"),
+	}
+	for _, arg := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "K8S_POD_NAME":
+			pInfo.Name = kv[1]
+		case "K8S_POD_NAMESPACE":
+			pInfo.K8sNameSpace = kv[1]
+		case "K8S_POD_UID":
+			pInfo.UID = kv[1]
+		case "K8S_POD_INFRA_CONTAINER_ID":
+			pInfo.InfraContainerID = kv[1]
+		}
+	}
+	if pInfo.InfraContainerID == "" {
+		return nil, fmt.Errorf("CNI_CONTAINERID is not set")
+	}
+	return pInfo, nil
+}
+
+// toNetConf fills the fields the clients read
+func toNetConf(n *NetConf) *types.NetConf {
+	conf := &types.NetConf{CNIVersion: n.CNIVersion, Name: n.Name}
+	conf.IPAM.Type = n.IPAM.Type
+	conf.IPAM.Subnet = n.IPAM.Subnet
+	conf.IPAM.Gateway = n.IPAM.Gateway
+	return conf
+}
+
+func cmdAdd(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, n *NetConf) error {
+	res, err := nc.RequestAddress(pInfo, toNetConf(n))
+	if err != nil {
+		return cniapi.NewCNIError(cniapi.ErrAllocateAddress, "failed to allocate an address", err)
+	}
+	ipaddr, ipnet, err := net.ParseCIDR(res.Address)
+	if err != nil {
+		return cniapi.NewCNIError(cniapi.ErrAllocateAddress, fmt.Sprintf("invalid address %q", res.Address), err)
+	}
+	gw := net.ParseIP(n.IPAM.Gateway)
+	if gw == nil {
+		gw = net.ParseIP(res.Data["Gateway"])
+	}
+	result := &current.Result{
+		IPs: []*current.IPConfig{{
+			Version: "4",
+			Address: net.IPNet{IP: ipaddr, Mask: ipnet.Mask},
+			Gateway: gw,
+		}},
+		Routes: n.IPAM.Routes,
+		DNS:    n.IPAM.DNS,
+	}
+	// without routes of its own the netconf gets those of the pool
+	if len(result.Routes) == 0 {
+		if gw != nil && res.Data["SkipDefaultRoute"] != "true" {
+			_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+			result.Routes = []*types.Route{{Dst: *defaultNet, GW: gw}}
+		}
+		if value := res.Data["Routes"]; value != "" {
+			var routes []*types.Route
+			if err := json.Unmarshal([]byte(value), &routes); err != nil {
+				return cniapi.NewCNIError(cniapi.ErrAllocateAddress, fmt.Sprintf("invalid routes %q", value), err)
+			}
+			result.Routes = append(result.Routes, routes...)
+		}
+	}
+	if value := res.Data["DNS"]; value != "" && len(result.DNS.Nameservers) == 0 {
+		if err := json.Unmarshal([]byte(value), &result.DNS); err != nil {
+			return cniapi.NewCNIError(cniapi.ErrAllocateAddress, fmt.Sprintf("invalid dns %q", value), err)
+		}
+	}
+	log.Infof("Allocated %s to %s", res.Address, pInfo.InfraContainerID)
+	return cniapi.PrintResult(result, n.CNIVersion)
+}
+
+// cmdDel releases the address of the container, an unknown container is
+// not an error since DEL may be called more than once
+func cmdDel(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, n *NetConf) error {
+	ipaddress, err := nc.GetAddress(pInfo.InfraContainerID, pInfo.IntfName)
+	if err != nil {
+		return cniapi.NewCNIError(cniapi.ErrTryAgainLater, fmt.Sprintf("failed to look up the address of %s", pInfo.InfraContainerID), err)
+	}
+	if ipaddress == "" {
+		log.Infof("No address recorded for %s", pInfo.InfraContainerID)
+		return nil
+	}
+	if err = nc.ReleaseAddress(pInfo, toNetConf(n), ipaddress); err != nil {
+		return cniapi.NewCNIError(cniapi.ErrTryAgainLater, fmt.Sprintf("failed to release %s", ipaddress), err)
+	}
+	log.Infof("Released %s of %s", ipaddress, pInfo.InfraContainerID)
+	return nil
+}
+
+func cmdCheck(nc clients.IPAMClient, pInfo *cniapi.CNIPodAttr, n *NetConf) error {
+	if !cniapi.VersionAtLeast(n.CNIVersion, "0.4.0") {
+		return cniapi.NewCNIError(cniapi.ErrIncompatibleVersion, fmt.Sprintf("CHECK is not supported by cniVersion %s", n.CNIVersion), nil)
+	}
+	ipaddress, err := nc.GetAddress(pInfo.InfraContainerID, pInfo.IntfName)
+	if err != nil || ipaddress == "" {
+		return cniapi.NewCNIError(cniapi.ErrUnknownContainer, fmt.Sprintf("no address recorded for container %s", pInfo.InfraContainerID), err)
+	}
+	return nil
+}
+
+func exitWithError(err error, version string) {
+	e, ok := err.(*cniapi.CNIError)
+	if !ok {
+		e = cniapi.NewCNIError(cniapi.ErrAllocateAddress, err.Error(), nil)
+	}
+	e.CNIVersion = version
+	log.Errorf("%s", e.Error())
+	cniapi.PrintJSON(e)
+	os.Exit(1)
+}
+
+func main() {
+	cniCmd := os.Getenv("CNI_COMMAND")
+
+	f, err := os.OpenFile("/var/log/skylark-ipam.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err == nil {
+		defer f.Close()
+		logger.SetOutput(f)
+	} else {
+		logger.SetOutput(ioutil.Discard)
+	}
+	log = logger.WithFields(logger.Fields{"CONTAINERID": os.Getenv("CNI_CONTAINERID")})
+	log.Infof("command: %s, cni_args: %s", cniCmd, os.Getenv("CNI_ARGS"))
+
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		exitWithError(cniapi.NewCNIError(cniapi.ErrIOFailure, "failed to read stdin", err), cniapi.DefaultCNIVersion)
+	}
+	if cniCmd == "VERSION" {
+		version := struct {
+			CNIVersion string `json:"cniVersion"`
+		}{}
+		json.Unmarshal(stdinData, &version)
+		cniapi.PrintVersion(version.CNIVersion)
+		return
+	}
+	n, err := loadConf(stdinData)
+	if err != nil {
+		exitWithError(cniapi.NewCNIError(cniapi.ErrDecodingFailure, "failed to parse network config", err), cniapi.DefaultCNIVersion)
+	}
+	if !cniapi.VersionSupported(n.CNIVersion) {
+		exitWithError(cniapi.NewCNIError(cniapi.ErrIncompatibleVersion, fmt.Sprintf("unsupported cniVersion %s", n.CNIVersion), nil), n.CNIVersion)
+	}
+	pInfo, err := getPodInfo()
+	if err != nil {
+		exitWithError(cniapi.NewCNIError(cniapi.ErrInvalidEnvironment, "failed to parse environment", err), n.CNIVersion)
+	}
+
+	var nc clients.IPAMClient
+	if len(n.IPAM.EtcdEndpoints) != 0 {
+		nc = clients.NewStoreClient(n.IPAM.EtcdEndpoints, n.IPAM.DadInterface, time.Duration(n.IPAM.DadTimeout)*time.Millisecond)
+	} else {
+		nc = clients.NewNWClient()
+	}
+	switch cniCmd {
+	case "ADD":
+		err = cmdAdd(nc, pInfo, n)
+	case "DEL":
+		err = cmdDel(nc, pInfo, n)
+	case "CHECK":
+		err = cmdCheck(nc, pInfo, n)
+	default:
+		err = cniapi.NewCNIError(cniapi.ErrInvalidEnvironment, fmt.Sprintf("unknown CNI_COMMAND %q", cniCmd), nil)
+	}
+	if err != nil {
+		exitWithError(err, n.CNIVersion)
+	}
+}